@@ -0,0 +1,338 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dedup suppresses inbound HL7 messages that partners resend after they
+// were already ingested, recognizing them by sending facility (MSH-4) and
+// message control ID (MSH-10).
+package dedup
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/hl7ack"
+	"github.com/GoogleCloudPlatform/mllp/shared/hl7"
+	"github.com/GoogleCloudPlatform/mllp/shared/monitoring"
+)
+
+const (
+	duplicatesMetric = "receiver-duplicates"
+	entriesMetric    = "receiver-dedup-entries"
+
+	logName = "dedup.log"
+	// compactMin is the number of records the log may hold before it is
+	// rewritten without the expired ones.
+	compactMin = 1024
+)
+
+// The sender interface represents the destination of messages that have not
+// been seen before.
+type sender interface {
+	Send(context.Context, []byte) ([]byte, error)
+}
+
+// Option contains settings for the Filter.
+type Option struct {
+	// Window is how long an ingested message is remembered.
+	Window time.Duration
+	// Dir is an optional directory in which ingested messages are recorded, so
+	// that they are remembered across restarts.
+	Dir string
+}
+
+type key struct {
+	facility, controlID string
+}
+
+// record is an ingested message and the ACK it was answered with. Records are
+// stored in the log as JSON lines.
+type record struct {
+	Facility  string    `json:"facility"`
+	ControlID string    `json:"control_id"`
+	Time      time.Time `json:"time"`
+	ACK       []byte    `json:"ack"`
+}
+
+func (r *record) key() key {
+	return key{r.Facility, r.ControlID}
+}
+
+// Filter forwards messages to a sender unless a message with the same sending
+// facility and control ID was ingested within the window, in which case the
+// original ACK is returned again.
+type Filter struct {
+	sender  sender
+	metrics monitoring.Client
+	window  time.Duration
+	dir     string
+	// now is replaced in tests.
+	now func() time.Time
+
+	// mu guards the fields below.
+	mu   sync.Mutex
+	seen map[key]*record
+	// order holds the records by ingestion time. It may contain records that
+	// were replaced in seen by a later ingestion of the same message.
+	order []*record
+	// inflight has a channel for every message being sent, closed when the
+	// send completes.
+	inflight map[key]chan struct{}
+	log      *os.File
+	// logged is the number of records in the log.
+	logged int
+}
+
+// New creates a Filter in front of s. If opt.Dir is set, the messages recorded
+// there by a previous run are loaded.
+func New(s sender, mt monitoring.Client, opt Option) (*Filter, error) {
+	if opt.Window <= 0 {
+		return nil, fmt.Errorf("invalid window %v", opt.Window)
+	}
+	mt.NewCounter(duplicatesMetric, "Number of duplicate HL7 messages answered with the original ACK")
+	mt.NewGauge(entriesMetric, "Number of HL7 messages remembered for duplicate detection")
+	f := &Filter{
+		sender:   s,
+		metrics:  mt,
+		window:   opt.Window,
+		dir:      opt.Dir,
+		now:      time.Now,
+		seen:     make(map[key]*record),
+		inflight: make(map[key]chan struct{}),
+	}
+	if f.dir != "" {
+		if err := os.MkdirAll(f.dir, 0700); err != nil {
+			return nil, fmt.Errorf("creating dedup directory: %v", err)
+		}
+		if err := f.load(); err != nil {
+			return nil, err
+		}
+		f.mu.Lock()
+		err := f.compact()
+		f.mu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("rewriting dedup log: %v", err)
+		}
+	}
+	return f, nil
+}
+
+// load reads the records left in the log by a previous run.
+func (f *Filter) load() error {
+	file, err := os.Open(filepath.Join(f.dir, logName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening dedup log: %v", err)
+	}
+	defer file.Close()
+	s := bufio.NewScanner(file)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		r := &record{}
+		if err := json.Unmarshal(s.Bytes(), r); err != nil {
+			// The last line may be partial after a crash.
+			log.Warningf("Dedup: ignoring unreadable record: %v", err)
+			continue
+		}
+		f.seen[r.key()] = r
+		f.order = append(f.order, r)
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("reading dedup log: %v", err)
+	}
+	f.expire()
+	return nil
+}
+
+// Close closes the log.
+func (f *Filter) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.log == nil {
+		return nil
+	}
+	err := f.log.Close()
+	f.log = nil
+	return err
+}
+
+// Send forwards msg to the sender, unless it is a duplicate of a message
+// ingested within the window. Messages without a control ID are always
+// forwarded. Only messages that were accepted (AA or CA) are remembered, so
+// that a partner can fix a rejected message and send it again.
+func (f *Filter) Send(ctx context.Context, msg []byte) ([]byte, error) {
+	k, ok := keyOf(msg)
+	if !ok {
+		return f.sender.Send(ctx, msg)
+	}
+	done := make(chan struct{})
+	for {
+		f.mu.Lock()
+		f.expire()
+		if r, ok := f.seen[k]; ok {
+			f.mu.Unlock()
+			f.metrics.IncCounter(duplicatesMetric)
+			log.Infof("Dedup: message %q from %q was already ingested, replying with the original ACK", k.controlID, k.facility)
+			return r.ACK, nil
+		}
+		wait, ok := f.inflight[k]
+		if !ok {
+			f.inflight[k] = done
+			f.mu.Unlock()
+			break
+		}
+		// Wait for the first copy, then use its ACK or send again if it
+		// failed.
+		f.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	ack, err := f.sender.Send(ctx, msg)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.inflight, k)
+	close(done)
+	if err == nil && accepted(ack) {
+		f.add(&record{Facility: k.facility, ControlID: k.controlID, Time: f.now(), ACK: ack})
+	}
+	return ack, err
+}
+
+// keyOf returns the sending facility and control ID of msg.
+func keyOf(msg []byte) (key, bool) {
+	parsed, err := hl7.Parse(msg)
+	if err != nil {
+		return key{}, false
+	}
+	facility, _ := parsed.Get("MSH-4")
+	controlID, _ := parsed.Get("MSH-10")
+	return key{facility, controlID}, controlID != ""
+}
+
+// accepted reports whether ack means that its message was ingested. An empty
+// ACK comes from a Release 2 queue that committed the message.
+func accepted(ack []byte) bool {
+	if len(ack) == 0 {
+		return true
+	}
+	code, err := hl7ack.ParseCode(ack)
+	return err == nil && code.Accepted()
+}
+
+// add remembers r and appends it to the log. Failing to write the log only
+// loses the record after a restart, so it is not reported to the caller.
+func (f *Filter) add(r *record) {
+	f.seen[r.key()] = r
+	f.order = append(f.order, r)
+	f.metrics.SetGauge(entriesMetric, int64(len(f.seen)))
+	if f.log == nil {
+		return
+	}
+	if err := f.append(r); err != nil {
+		log.Warningf("Dedup: failed to record message: %v", err)
+	}
+	if f.logged > compactMin && f.logged > 2*len(f.seen) {
+		if err := f.compact(); err != nil {
+			log.Warningf("Dedup: failed to rewrite log: %v", err)
+		}
+	}
+}
+
+func (f *Filter) append(r *record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f.logged++
+	_, err = f.log.Write(append(line, '\n'))
+	return err
+}
+
+// expire forgets the records older than the window.
+func (f *Filter) expire() {
+	cutoff := f.now().Add(-f.window)
+	i := 0
+	for ; i < len(f.order) && !f.order[i].Time.After(cutoff); i++ {
+		r := f.order[i]
+		if f.seen[r.key()] == r {
+			delete(f.seen, r.key())
+		}
+	}
+	if i > 0 {
+		f.order = f.order[i:]
+		f.metrics.SetGauge(entriesMetric, int64(len(f.seen)))
+	}
+}
+
+// compact replaces the log with one holding only the remembered records, and
+// opens it for appending.
+func (f *Filter) compact() error {
+	path := filepath.Join(f.dir, logName)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	logged := 0
+	for _, r := range f.order {
+		if f.seen[r.key()] != r {
+			continue
+		}
+		line, err := json.Marshal(r)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+		logged++
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if f.log != nil {
+		f.log.Close()
+		f.log = nil
+	}
+	if file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return err
+	}
+	f.log = file
+	f.logged = logged
+	return nil
+}
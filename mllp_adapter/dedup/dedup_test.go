@@ -0,0 +1,264 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/hl7ack"
+	"github.com/GoogleCloudPlatform/mllp/shared/testingutil"
+)
+
+type fakeSender struct {
+	mu    sync.Mutex
+	calls int
+	err   error
+	// release, if set, blocks Send until it is closed.
+	release chan struct{}
+	// code is the acknowledgment code of the returned ACKs, AA if empty.
+	code hl7ack.Code
+}
+
+func (s *fakeSender) Send(ctx context.Context, msg []byte) ([]byte, error) {
+	if s.release != nil {
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	code := s.code
+	if code == "" {
+		code = hl7ack.ApplicationAccept
+	}
+	return []byte(ackFor(code, s.calls)), s.err
+}
+
+// ackFor returns the ACK with the given code for the n-th message sent.
+func ackFor(code hl7ack.Code, n int) string {
+	return fmt.Sprintf("MSH|^~\\&|RECV|RECVFAC|APP|LAB|20180101000000||ACK|%d|P|2.5\rMSA|%v|%d\r", n, code, n)
+}
+
+func (s *fakeSender) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func hl7Msg(facility, controlID string) []byte {
+	return []byte(fmt.Sprintf("MSH|^~\\&|APP|%v|RECV|RECVFAC|20180101000000||ADT^A01^ADT_A01|%v|P|2.5\r", facility, controlID))
+}
+
+// clock is a manually advanced time source.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time { return c.t }
+
+func newFilter(t *testing.T, s sender, opt Option) (*Filter, *testingutil.FakeMonitoringClient, *clock) {
+	t.Helper()
+	mt := testingutil.NewFakeMonitoringClient()
+	f, err := New(s, mt, opt)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	c := &clock{t: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}
+	f.now = c.now
+	return f, mt, c
+}
+
+func send(t *testing.T, f *Filter, msg []byte) string {
+	t.Helper()
+	ack, err := f.Send(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	return string(ack)
+}
+
+func TestDuplicate(t *testing.T) {
+	s := &fakeSender{}
+	f, mt, c := newFilter(t, s, Option{Window: time.Hour})
+
+	if got := send(t, f, hl7Msg("LAB", "1")); got != ackFor(hl7ack.ApplicationAccept, 1) {
+		t.Errorf("Send() = %q, want ack 1", got)
+	}
+	c.t = c.t.Add(30 * time.Minute)
+	if got := send(t, f, hl7Msg("LAB", "1")); got != ackFor(hl7ack.ApplicationAccept, 1) {
+		t.Errorf("Send() of a duplicate = %q, want the original ack 1", got)
+	}
+	// The same control ID from another facility is a different message.
+	if got := send(t, f, hl7Msg("WARD", "1")); got != ackFor(hl7ack.ApplicationAccept, 2) {
+		t.Errorf("Send() = %q, want ack 2", got)
+	}
+	// Once the window has passed the message is sent again.
+	c.t = c.t.Add(31 * time.Minute)
+	if got := send(t, f, hl7Msg("LAB", "1")); got != ackFor(hl7ack.ApplicationAccept, 3) {
+		t.Errorf("Send() after the window = %q, want ack 3", got)
+	}
+	if s.count() != 3 {
+		t.Errorf("sender got %d messages, want 3", s.count())
+	}
+	testingutil.CheckMetrics(t, mt, map[string]int64{duplicatesMetric: 1})
+	if got := mt.GaugeValue(entriesMetric); got != 2 {
+		t.Errorf("%v = %d, want 2", entriesMetric, got)
+	}
+}
+
+func TestErrorsNotRemembered(t *testing.T) {
+	s := &fakeSender{err: fmt.Errorf("unavailable")}
+	f, mt, _ := newFilter(t, s, Option{Window: time.Hour})
+	for i := 0; i < 2; i++ {
+		if _, err := f.Send(context.Background(), hl7Msg("LAB", "1")); err == nil {
+			t.Errorf("Send() succeeded, want error")
+		}
+	}
+	// Messages without a control ID cannot be recognized.
+	s.err = nil
+	for i := 0; i < 2; i++ {
+		send(t, f, []byte("garbage"))
+	}
+	if s.count() != 4 {
+		t.Errorf("sender got %d messages, want 4", s.count())
+	}
+	testingutil.CheckMetrics(t, mt, map[string]int64{duplicatesMetric: 0})
+}
+
+func TestNACKsNotRemembered(t *testing.T) {
+	s := &fakeSender{code: hl7ack.ApplicationError}
+	f, mt, _ := newFilter(t, s, Option{Window: time.Hour})
+	if got := send(t, f, hl7Msg("LAB", "1")); got != ackFor(hl7ack.ApplicationError, 1) {
+		t.Errorf("Send() = %q, want NACK 1", got)
+	}
+	// The partner fixes the message and sends it again with the same control
+	// ID.
+	s.code = ""
+	if got := send(t, f, hl7Msg("LAB", "1")); got != ackFor(hl7ack.ApplicationAccept, 2) {
+		t.Errorf("Send() after a NACK = %q, want ack 2", got)
+	}
+	if s.count() != 2 {
+		t.Errorf("sender got %d messages, want 2", s.count())
+	}
+	testingutil.CheckMetrics(t, mt, map[string]int64{duplicatesMetric: 0})
+}
+
+func TestConcurrentDuplicate(t *testing.T) {
+	s := &fakeSender{release: make(chan struct{})}
+	f, _, _ := newFilter(t, s, Option{Window: time.Hour})
+	acks := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			ack, _ := f.Send(context.Background(), hl7Msg("LAB", "1"))
+			acks <- string(ack)
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(s.release)
+	for i := 0; i < 2; i++ {
+		if got := <-acks; got != ackFor(hl7ack.ApplicationAccept, 1) {
+			t.Errorf("Send() = %q, want ack 1", got)
+		}
+	}
+	if s.count() != 1 {
+		t.Errorf("sender got %d messages, want 1", s.count())
+	}
+}
+
+func TestDuplicateWaitCancelled(t *testing.T) {
+	s := &fakeSender{release: make(chan struct{})}
+	f, _, _ := newFilter(t, s, Option{Window: time.Hour})
+	first := make(chan struct{})
+	go func() {
+		f.Send(context.Background(), hl7Msg("LAB", "1"))
+		close(first)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := f.Send(ctx, hl7Msg("LAB", "1")); err != context.DeadlineExceeded {
+		t.Errorf("Send() of a duplicate in flight = %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(s.release)
+	<-first
+}
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	s := &fakeSender{}
+	mt := testingutil.NewFakeMonitoringClient()
+	f, err := New(s, mt, Option{Window: time.Hour, Dir: dir})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	send(t, f, hl7Msg("LAB", "1"))
+	send(t, f, hl7Msg("LAB", "2"))
+	f.Close()
+
+	// Append a partial record, as left by a crash.
+	path := filepath.Join(dir, logName)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if err := ioutil.WriteFile(path, append(data, []byte(`{"facility":"LA`)...), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	restarted, err := New(s, mt, Option{Window: time.Hour, Dir: dir})
+	if err != nil {
+		t.Fatalf("New after restart: %v", err)
+	}
+	defer restarted.Close()
+	if got := send(t, restarted, hl7Msg("LAB", "2")); got != ackFor(hl7ack.ApplicationAccept, 2) {
+		t.Errorf("Send() after restart = %q, want the original ack 2", got)
+	}
+	if s.count() != 2 {
+		t.Errorf("sender got %d messages, want 2", s.count())
+	}
+	testingutil.CheckMetrics(t, mt, map[string]int64{duplicatesMetric: 1})
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	f, err := New(&fakeSender{}, testingutil.NewFakeMonitoringClient(), Option{Window: time.Hour, Dir: dir})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer f.Close()
+	c := &clock{t: time.Now()}
+	f.now = c.now
+	for i := 0; i < 3*compactMin; i++ {
+		send(t, f, hl7Msg("LAB", fmt.Sprint(i)))
+		c.t = c.t.Add(time.Minute)
+	}
+	// Only the last hour of messages is remembered, and the log is rewritten
+	// once it grows past compactMin records.
+	if len(f.seen) != 60 || f.logged > compactMin+1 {
+		t.Errorf("log has %d records for %d messages, want 60 messages and at most %d records", f.logged, len(f.seen), compactMin+1)
+	}
+}
+
+func TestNewInvalidWindow(t *testing.T) {
+	if _, err := New(&fakeSender{}, testingutil.NewFakeMonitoringClient(), Option{}); err == nil {
+		t.Errorf("New() without a window succeeded, want error")
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/mllp/shared/fakehealthcare"
+	"github.com/GoogleCloudPlatform/mllp/shared/hl7"
+	"github.com/GoogleCloudPlatform/mllp/shared/monitoring"
+)
+
+const (
+	// Metrics checked by the tests.
+	handlerFetchErrorMetric = "pubsub-messages-fetch-error"
+	handlerSendErrorMetric  = "pubsub-messages-send-error"
+	senderSentMetric        = "mllpsender-messages-sent"
+)
+
+// hl7Msg returns an ADT^A01 message with control ID ctrl.
+func hl7Msg(ctrl string) []byte {
+	return []byte(fmt.Sprintf("MSH|^~\\&|SEND_APP|SEND_FAC|RECV_APP|RECV_FAC|20180101000000||ADT^A01|%v|P|2.5\rPID|1||%v\r", ctrl, ctrl))
+}
+
+// checkACK checks the code and control ID of ack.
+func checkACK(t *testing.T, ack []byte, wantCode, wantCtrl string) {
+	t.Helper()
+	parsed, err := hl7.Parse(ack)
+	if err != nil {
+		t.Fatalf("Parsing ACK %q: %v", ack, err)
+	}
+	code, _ := parsed.Value("MSA-1")
+	ctrl, _ := parsed.Value("MSA-2")
+	if code != wantCode || ctrl != wantCtrl {
+		t.Errorf("ACK %q has code %q and control ID %q, want %q and %q", ack, code, ctrl, wantCode, wantCtrl)
+	}
+}
+
+func TestInboundACK(t *testing.T) {
+	e := newEnv(t)
+	a := e.startAdapter(adapterOption{})
+
+	msg := hl7Msg("in-1")
+	checkACK(t, a.send(msg), "AA", "in-1")
+	if stored := e.stored(); len(stored) != 1 || !bytes.Equal(stored[0], msg) {
+		t.Errorf("Stored messages = %q, want %q", stored, msg)
+	}
+}
+
+func TestInboundNACK(t *testing.T) {
+	testCases := []struct {
+		name     string
+		msg      []byte
+		fault    *fakehealthcare.Fault
+		wantCode string
+		wantCtrl string
+	}{
+		{
+			name:     "rejected by the store",
+			msg:      []byte("MSH|^~\\&|SEND_APP|SEND_FAC|RECV_APP|RECV_FAC|20180101000000||ADT^A01||P|2.5\r"),
+			wantCode: "AR",
+		},
+		{
+			name:     "NACK from the API",
+			msg:      hl7Msg("in-2"),
+			fault:    &fakehealthcare.Fault{Method: fakehealthcare.Ingest, NACK: "AE"},
+			wantCode: "AE",
+			wantCtrl: "in-2",
+		},
+		{
+			name:     "API unavailable",
+			msg:      hl7Msg("in-3"),
+			fault:    &fakehealthcare.Fault{Method: fakehealthcare.Ingest, Code: http.StatusServiceUnavailable},
+			wantCode: "AE",
+			wantCtrl: "in-3",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newEnv(t)
+			if tc.fault != nil {
+				e.api.Inject(*tc.fault)
+			}
+			a := e.startAdapter(adapterOption{localNACK: "unavailable=AE"})
+
+			checkACK(t, a.send(tc.msg), tc.wantCode, tc.wantCtrl)
+			if stored := e.stored(); len(stored) != 0 {
+				t.Errorf("Stored messages = %q, want none", stored)
+			}
+		})
+	}
+}
+
+func TestOutbound(t *testing.T) {
+	e := newEnv(t)
+	e.startAdapter(adapterOption{})
+
+	msg := hl7Msg("out-1")
+	name := e.create(msg)
+	if got := e.partner.next(); !bytes.Equal(got, msg) {
+		t.Errorf("Partner received %q, want %q", got, msg)
+	}
+	if n := e.waitAcked(name); n.Deliveries != 1 {
+		t.Errorf("Notification delivered %d times, want 1", n.Deliveries)
+	}
+}
+
+func TestOutboundPartnerNACK(t *testing.T) {
+	e := newEnv(t)
+	a := e.startAdapter(adapterOption{})
+	e.partner.script(replyAE)
+
+	msg := hl7Msg("out-2")
+	name := e.create(msg)
+	e.partner.next()
+	// A NACK is an answer from the partner, so the message is not sent again.
+	if n := e.waitAcked(name); n.Deliveries != 1 {
+		t.Errorf("Notification delivered %d times, want 1", n.Deliveries)
+	}
+	if got := a.metrics.LabeledCounterValue(senderSentMetric, monitoring.MessageType(msg), monitoring.Label{Key: monitoring.AckCodeKey, Value: "AE"}); got != 1 {
+		t.Errorf("%v with ack code AE = %d, want 1", senderSentMetric, got)
+	}
+}
+
+func TestOutboundPartnerFailure(t *testing.T) {
+	e := newEnv(t)
+	e.startAdapter(adapterOption{})
+	e.partner.script(hangUp, hangUp)
+
+	msg := hl7Msg("out-3")
+	name := e.create(msg)
+	for i := 0; i < 3; i++ {
+		if got := e.partner.next(); !bytes.Equal(got, msg) {
+			t.Errorf("Attempt %d: partner received %q, want %q", i+1, got, msg)
+		}
+	}
+	if n := e.waitAcked(name); n.Deliveries != 3 {
+		t.Errorf("Notification delivered %d times, want 3", n.Deliveries)
+	}
+}
+
+func TestOutboundAPIFailure(t *testing.T) {
+	e := newEnv(t)
+	e.api.Inject(fakehealthcare.Fault{Method: fakehealthcare.Get, Code: http.StatusInternalServerError, Times: 3})
+	e.startAdapter(adapterOption{})
+
+	msg := hl7Msg("out-4")
+	name := e.create(msg)
+	if got := e.partner.next(); !bytes.Equal(got, msg) {
+		t.Errorf("Partner received %q, want %q", got, msg)
+	}
+	e.waitAcked(name)
+}
+
+func TestOutboundMessageGone(t *testing.T) {
+	e := newEnv(t)
+	e.api.Inject(fakehealthcare.Fault{Method: fakehealthcare.Get, Code: http.StatusNotFound})
+	a := e.startAdapter(adapterOption{})
+
+	// Fetching the message again cannot help, so the notification is dropped
+	// instead of being delivered over and over.
+	name := e.create(hl7Msg("out-8"))
+	if n := e.waitAcked(name); n.Deliveries != 1 {
+		t.Errorf("Notification delivered %d times, want 1", n.Deliveries)
+	}
+	if got := a.metrics.CounterValue(handlerFetchErrorMetric); got != 1 {
+		t.Errorf("%v = %d, want 1", handlerFetchErrorMetric, got)
+	}
+	if n := len(e.partner.received); n != 0 {
+		t.Errorf("Partner received %d messages, want none", n)
+	}
+}
+
+func TestPartnerRestart(t *testing.T) {
+	e := newEnv(t)
+	a := e.startAdapter(adapterOption{senderPoolSize: 1})
+
+	first := hl7Msg("out-5")
+	e.waitAcked(e.create(first))
+	e.partner.next()
+
+	e.partner.stop()
+	second := hl7Msg("out-6")
+	name := e.create(second)
+	waitFor(t, "a failed delivery", func() bool { return a.metrics.CounterValue(handlerSendErrorMetric) > 0 })
+	e.partner.restart()
+
+	if got := e.partner.next(); !bytes.Equal(got, second) {
+		t.Errorf("Partner received %q after restarting, want %q", got, second)
+	}
+	e.waitAcked(name)
+}
+
+func TestAdapterRestart(t *testing.T) {
+	e := newEnv(t)
+	dir := t.TempDir()
+	e.api.Inject(fakehealthcare.Fault{Method: fakehealthcare.Ingest, Code: http.StatusServiceUnavailable})
+	a := e.startAdapter(adapterOption{queueDir: dir})
+
+	// The queue commits to the message although the store is unavailable.
+	inbound := hl7Msg("in-4")
+	checkACK(t, a.send(inbound), "AA", "in-4")
+	// The partner is down while the adapter tries to send a message.
+	e.partner.stop()
+	outbound := hl7Msg("out-7")
+	name := e.create(outbound)
+	waitFor(t, "a failed delivery", func() bool { return a.metrics.CounterValue(handlerSendErrorMetric) > 0 })
+	a.stop()
+	if stored := e.stored(); len(stored) != 0 {
+		t.Fatalf("Stored messages = %q before the store recovered, want none", stored)
+	}
+
+	// Both messages are delivered once everything is back.
+	e.api.ClearFaults()
+	e.partner.restart()
+	e.startAdapter(adapterOption{queueDir: dir})
+	waitFor(t, "the queued message to be stored", func() bool { return len(e.stored()) > 0 })
+	// A request cancelled by the shutdown may still have reached the store,
+	// so the message can be stored twice.
+	for _, m := range e.stored() {
+		if !bytes.Equal(m, inbound) {
+			t.Errorf("Stored message = %q, want %q", m, inbound)
+		}
+	}
+	if got := e.partner.next(); !bytes.Equal(got, outbound) {
+		t.Errorf("Partner received %q, want %q", got, outbound)
+	}
+	e.waitAcked(name)
+}
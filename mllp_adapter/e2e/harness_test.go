@@ -0,0 +1,447 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package e2e runs the adapter end to end against in-process fakes of
+// everything it talks to: a Pub/Sub server, the Cloud Healthcare API and an MLLP
+// partner. It needs no network access or Google Cloud project.
+package e2e
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	cloudpubsub "cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	healthcare "google.golang.org/api/healthcare/v1"
+	"google.golang.org/api/option"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/handler"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/hl7ack"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/mllp"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/mllpreceiver"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/mllpsender"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/queue"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/router"
+	"github.com/GoogleCloudPlatform/mllp/shared/fakehealthcare"
+	"github.com/GoogleCloudPlatform/mllp/shared/healthapiclient"
+	"github.com/GoogleCloudPlatform/mllp/shared/pubsub"
+	"github.com/GoogleCloudPlatform/mllp/shared/testingutil"
+	"github.com/GoogleCloudPlatform/mllp/shared/util"
+)
+
+const (
+	projectID      = "test-project"
+	locationID     = "test-location"
+	datasetID      = "test-dataset"
+	storeID        = "test-store"
+	topicID        = "outbound"
+	subscriptionID = "mllp-adapter"
+
+	// ackDeadline is the ack deadline of the subscription, the shortest the
+	// fake accepts. Notifications that were neither acked nor nacked, e.g.
+	// by an adapter that was stopped, are redelivered after it.
+	ackDeadline = 10 * time.Second
+	// waitTimeout bounds the wait for anything that happens asynchronously.
+	// It leaves room for a redelivery after ackDeadline and the retries of
+	// the adapter that follow it.
+	waitTimeout = 3 * ackDeadline
+)
+
+var storeName = util.GenerateHL7V2StoreName(projectID, locationID, datasetID, storeID)
+
+// env holds the fakes the adapter talks to. They outlive the adapters
+// started in a test, so that restarts can be observed.
+type env struct {
+	t       *testing.T
+	api     *fakehealthcare.Server
+	pubsub  *pstest.Server
+	partner *partner
+
+	// mu guards notifications, the IDs of the Pub/Sub messages published for
+	// created messages, by message name.
+	mu            sync.Mutex
+	notifications map[string]string
+}
+
+func newEnv(t *testing.T) *env {
+	e := &env{t: t, notifications: make(map[string]string)}
+	e.pubsub = pstest.NewServer()
+	t.Cleanup(func() { e.pubsub.Close() })
+	// Both the harness and pubsub.Listen connect to the fake through the
+	// emulator variable.
+	t.Setenv("PUBSUB_EMULATOR_HOST", e.pubsub.Addr)
+
+	ctx := context.Background()
+	client, err := cloudpubsub.NewClient(ctx, projectID)
+	if err != nil {
+		t.Fatalf("pubsub.NewClient: %v", err)
+	}
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, topicID)
+	if err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+	if _, err := client.CreateSubscription(ctx, subscriptionID, cloudpubsub.SubscriptionConfig{Topic: topic, AckDeadline: ackDeadline}); err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+
+	e.api = fakehealthcare.New(fakehealthcare.Option{Notify: e.notify})
+	t.Cleanup(e.api.Close)
+	e.api.AddStore(storeName)
+	e.partner = newPartner(t)
+	return e
+}
+
+// notify publishes the notifications of created messages only, like a
+// notification config whose filter selects the messages meant for partners.
+func (e *env) notify(n fakehealthcare.Notification) {
+	if n.Attributes["publish"] != "true" {
+		return
+	}
+	id := e.pubsub.Publish("projects/"+projectID+"/topics/"+topicID, []byte(n.Name), n.Attributes)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.notifications[n.Name] = id
+}
+
+// create stores msg with messages.create, which makes the adapter send it to
+// the partner, and returns its name.
+func (e *env) create(msg []byte) string {
+	e.t.Helper()
+	svc, err := healthcare.NewService(context.Background(), option.WithEndpoint(e.api.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		e.t.Fatalf("healthcare.NewService: %v", err)
+	}
+	m, err := svc.Projects.Locations.Datasets.Hl7V2Stores.Messages.Create(storeName, &healthcare.CreateMessageRequest{
+		Message: &healthcare.Message{Data: base64.StdEncoding.EncodeToString(msg)},
+	}).Do()
+	if err != nil {
+		e.t.Fatalf("Create: %v", err)
+	}
+	return m.Name
+}
+
+// notification returns the Pub/Sub message published for the message called
+// name.
+func (e *env) notification(name string) *pstest.Message {
+	e.t.Helper()
+	e.mu.Lock()
+	id, ok := e.notifications[name]
+	e.mu.Unlock()
+	if !ok {
+		e.t.Fatalf("No notification was published for %v", name)
+	}
+	return e.pubsub.Message(id)
+}
+
+// waitAcked waits until the notification of the message called name is
+// acknowledged and returns it.
+func (e *env) waitAcked(name string) *pstest.Message {
+	e.t.Helper()
+	var m *pstest.Message
+	waitFor(e.t, "notification of "+name+" to be acknowledged", func() bool {
+		m = e.notification(name)
+		return m.Acks > 0
+	})
+	return m
+}
+
+// stored returns the data of the messages ingested into the store.
+func (e *env) stored() [][]byte {
+	var data [][]byte
+	for _, m := range e.api.Messages(storeName) {
+		if !m.Created {
+			data = append(data, m.Data)
+		}
+	}
+	return data
+}
+
+// adapterOption configures an adapter like the flags of the binary.
+type adapterOption struct {
+	// queueDir is the directory of the receiver queue, if any.
+	queueDir string
+	// localNACK is the local NACK policy of the receiver.
+	localNACK string
+	// senderPoolSize is the number of connections kept open to the partner.
+	senderPoolSize int
+}
+
+// adapter is a running adapter, wired the way the binary wires its default
+// listener and the Pub/Sub listener.
+type adapter struct {
+	t *testing.T
+	// addr is the address of the MLLP receiver.
+	addr    string
+	metrics *testingutil.FakeMonitoringClient
+
+	receiver     *mllpreceiver.MLLPReceiver
+	receiverDone chan struct{}
+	sender       *mllpsender.MLLPSender
+	// cancel stops the Pub/Sub listener and the queue, which are tracked by
+	// background.
+	cancel     context.CancelFunc
+	background sync.WaitGroup
+	stopOnce   sync.Once
+}
+
+// startAdapter starts an adapter that stores inbound messages in the fake
+// store and sends the messages it is notified about to the partner. It is
+// stopped at the end of the test if stop is not called.
+func (e *env) startAdapter(opt adapterOption) *adapter {
+	t := e.t
+	t.Helper()
+	mon := testingutil.NewFakeMonitoringClient()
+	si := healthapiclient.StoreInfo{ProjectID: projectID, LocationID: locationID, DatasetID: datasetID, HL7V2StoreID: storeID}
+	api, err := healthapiclient.NewHL7V2Client(context.Background(), "", mon, si, healthapiclient.Option{
+		Endpoint: e.api.URL,
+		Insecure: true,
+		Retry:    healthapiclient.RetryPolicy{MaxAttempts: 3, BaseBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("NewHL7V2Client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &adapter{t: t, metrics: mon, cancel: cancel, receiverDone: make(chan struct{})}
+
+	var inbound router.Sender = api
+	var q *queue.Queue
+	if opt.queueDir != "" {
+		if q, err = queue.New(opt.queueDir, api, mon, queue.Option{MinBackoff: 10 * time.Millisecond, MaxBackoff: 100 * time.Millisecond}); err != nil {
+			t.Fatalf("queue.New: %v", err)
+		}
+		inbound = q
+	}
+	nack, err := hl7ack.ParsePolicy(opt.localNACK)
+	if err != nil {
+		t.Fatalf("ParsePolicy(%q): %v", opt.localNACK, err)
+	}
+	if a.receiver, err = mllpreceiver.NewReceiver("127.0.0.1", 0, inbound, mon, mllpreceiver.Option{NACK: nack}); err != nil {
+		t.Fatalf("NewReceiver: %v", err)
+	}
+	a.addr = a.receiver.Addr().String()
+	a.sender = mllpsender.NewSender(e.partner.addr, mon, mllpsender.Option{PoolSize: opt.senderPoolSize, ACKTimeout: waitTimeout})
+	h := handler.New(mon, api, a.sender, false)
+
+	// Everything is created before anything runs, as in the binary.
+	go func() {
+		defer close(a.receiverDone)
+		if err := a.receiver.Run(); err != mllpreceiver.ErrReceiverClosed {
+			t.Errorf("MLLP receiver stopped: %v", err)
+		}
+	}()
+	a.background.Add(1)
+	go func() {
+		defer a.background.Done()
+		if err := pubsub.Listen(ctx, "", h, projectID, subscriptionID); err != nil {
+			t.Errorf("pubsub.Listen: %v", err)
+		}
+	}()
+	if q != nil {
+		a.background.Add(1)
+		go func() {
+			defer a.background.Done()
+			q.Run(ctx)
+		}()
+	}
+	t.Cleanup(a.stop)
+	return a
+}
+
+// stop shuts the adapter down in the same order as the binary.
+func (a *adapter) stop() {
+	a.stopOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+		defer cancel()
+		if err := a.receiver.Shutdown(ctx); err != nil {
+			a.t.Errorf("Shutdown: %v", err)
+		}
+		<-a.receiverDone
+		a.cancel()
+		a.background.Wait()
+		a.sender.Close()
+	})
+}
+
+// send sends msg to the adapter as a partner would and returns the ACK.
+func (a *adapter) send(msg []byte) []byte {
+	a.t.Helper()
+	conn, err := net.DialTimeout("tcp", a.addr, waitTimeout)
+	if err != nil {
+		a.t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(waitTimeout))
+	if err := mllp.WriteMsg(conn, msg); err != nil {
+		a.t.Fatalf("WriteMsg: %v", err)
+	}
+	ack, err := mllp.ReadMsg(conn)
+	if err != nil {
+		a.t.Fatalf("Reading ACK: %v", err)
+	}
+	return ack
+}
+
+// reply is how the partner answers a message.
+type reply int
+
+const (
+	replyAA reply = iota
+	replyAE
+	// hangUp closes the connection without an answer.
+	hangUp
+)
+
+// partner is a scripted MLLP peer that receives the messages the adapter
+// sends. It answers with AA unless scripted otherwise, and can be stopped
+// and restarted on the same address.
+type partner struct {
+	t    *testing.T
+	addr string
+	// received gets every message read, before it is answered.
+	received chan []byte
+
+	// mu guards the fields below.
+	mu      sync.Mutex
+	ln      net.Listener
+	conns   map[net.Conn]bool
+	replies []reply
+}
+
+func newPartner(t *testing.T) *partner {
+	p := &partner{t: t, received: make(chan []byte, 100), conns: make(map[net.Conn]bool)}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	p.addr = ln.Addr().String()
+	p.serve(ln)
+	t.Cleanup(p.stop)
+	return p
+}
+
+// script sets the replies to the next messages.
+func (p *partner) script(replies ...reply) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.replies = append(p.replies, replies...)
+}
+
+// next waits for the next message from the adapter.
+func (p *partner) next() []byte {
+	p.t.Helper()
+	select {
+	case msg := <-p.received:
+		return msg
+	case <-time.After(waitTimeout):
+		p.t.Fatalf("Partner received no message within %v", waitTimeout)
+		return nil
+	}
+}
+
+// stop closes the listener and all connections, like a partner going down.
+func (p *partner) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ln != nil {
+		p.ln.Close()
+		p.ln = nil
+	}
+	for c := range p.conns {
+		c.Close()
+	}
+}
+
+// restart listens again on the address of the partner.
+func (p *partner) restart() {
+	p.t.Helper()
+	ln, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		p.t.Fatalf("Listen: %v", err)
+	}
+	p.serve(ln)
+}
+
+func (p *partner) serve(ln net.Listener) {
+	p.mu.Lock()
+	p.ln = ln
+	p.mu.Unlock()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			p.mu.Lock()
+			p.conns[conn] = true
+			p.mu.Unlock()
+			go p.handle(conn)
+		}
+	}()
+}
+
+func (p *partner) handle(conn net.Conn) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, conn)
+		p.mu.Unlock()
+		conn.Close()
+	}()
+	reader := mllp.NewMessageReader(conn)
+	for {
+		msg, err := reader.Next()
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		r := replyAA
+		if len(p.replies) > 0 {
+			r, p.replies = p.replies[0], p.replies[1:]
+		}
+		p.mu.Unlock()
+		p.received <- msg
+
+		code := hl7ack.ApplicationAccept
+		switch r {
+		case hangUp:
+			return
+		case replyAE:
+			code = hl7ack.ApplicationError
+		}
+		ack, err := hl7ack.Build(msg, code, "")
+		if err != nil {
+			p.t.Errorf("Building ACK: %v", err)
+			return
+		}
+		if err := mllp.WriteMsg(conn, ack); err != nil {
+			return
+		}
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after waitTimeout.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
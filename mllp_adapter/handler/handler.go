@@ -17,11 +17,15 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"time"
 
 	log "github.com/golang/glog"
+	"github.com/GoogleCloudPlatform/mllp/shared/healthapiclient"
 	"github.com/GoogleCloudPlatform/mllp/shared/monitoring"
 	"github.com/GoogleCloudPlatform/mllp/shared/pubsub"
+	"github.com/GoogleCloudPlatform/mllp/shared/tracing"
 )
 
 var (
@@ -34,12 +38,12 @@ var (
 
 // Fetcher fetches messages from HL7v2 stores.
 type Fetcher interface {
-	Get(string) ([]byte, error)
+	Get(context.Context, string) ([]byte, error)
 }
 
 // Sender sends messages back to partners.
 type Sender interface {
-	Send([]byte) ([]byte, error)
+	Send(context.Context, []byte) ([]byte, error)
 }
 
 // Handler represents a message handler.
@@ -66,10 +70,17 @@ func New(m monitoring.Client, f Fetcher, s Sender, checkPublishAttribute bool) *
 	}
 }
 
-// Handle fetches messages and sends them back to partners.
-func (h *Handler) Handle(m pubsub.Message) {
+// Handle fetches messages and sends them back to partners. Each notification
+// is traced as the pubsub.handle span. Notifications whose message cannot be
+// fetched or sent, including because ctx is done first, are nacked so that
+// they are delivered again, unless the message can never be fetched. Leaving
+// them unacknowledged instead would keep the listener from stopping until
+// their lease runs out.
+func (h *Handler) Handle(ctx context.Context, m pubsub.Message) {
 	start := time.Now()
-	defer h.metrics.AddLatency(handleLatencyMetric, float64(time.Since(start).Milliseconds()))
+	defer func() {
+		h.metrics.AddLatency(handleLatencyMetric, float64(time.Since(start).Milliseconds()))
+	}()
 	h.metrics.IncCounter(processedMetric)
 
 	if h.checkPublishAttribute {
@@ -81,17 +92,30 @@ func (h *Handler) Handle(m pubsub.Message) {
 	}
 
 	msgName := string(m.Data())
-	msg, err := h.f.Get(msgName)
+	ctx, span := tracing.StartSpan(ctx, "pubsub.handle", nil, tracing.MessageNameKey.String(msgName))
+	msg, err := h.f.Get(ctx, msgName)
 	if err != nil {
 		log.Warningf("Error fetching message %v: %v", msgName, err)
 		h.metrics.IncCounter(fetchErrorMetric)
+		tracing.End(span, err)
+		var pe *healthapiclient.PermanentError
+		if errors.As(err, &pe) {
+			log.Errorf("Dropping notification for %v, which cannot be fetched", msgName)
+			m.Ack()
+			return
+		}
+		m.Nack()
 		return
 	}
-	if _, err := h.s.Send(msg); err != nil {
+	span.SetAttributes(tracing.MessageAttributes(msg)...)
+	if _, err := h.s.Send(ctx, msg); err != nil {
 		log.Warningf("Error sending message %v: %v", msgName, err)
 		h.metrics.IncCounter(sendErrorMetric)
+		tracing.End(span, err)
+		m.Nack()
 		return
 	}
+	tracing.End(span, nil)
 
 	m.Ack()
 }
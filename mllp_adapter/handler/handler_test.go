@@ -16,14 +16,22 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"testing"
 
+	"github.com/GoogleCloudPlatform/mllp/shared/healthapiclient"
 	"github.com/GoogleCloudPlatform/mllp/shared/testingutil"
+	"github.com/GoogleCloudPlatform/mllp/shared/tracing"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	msgName = "projects/1/datasets/2/hl7/messagestore/messages/3"
+	// unavailableMsgName is a message that fails to be fetched for now.
+	unavailableMsgName = "projects/1/datasets/2/hl7/messagestore/messages/4"
 )
 
 var (
@@ -33,6 +41,7 @@ var (
 type fakeMessage struct {
 	name    string
 	acked   bool
+	nacked  bool
 	publish bool
 }
 
@@ -40,6 +49,10 @@ func (m *fakeMessage) Ack() {
 	m.acked = true
 }
 
+func (m *fakeMessage) Nack() {
+	m.nacked = true
+}
+
 func (m *fakeMessage) Data() []byte {
 	return []byte(m.name)
 }
@@ -55,10 +68,13 @@ type fakeFetcher struct {
 	msgs map[string][]byte
 }
 
-func (f *fakeFetcher) Get(name string) ([]byte, error) {
+func (f *fakeFetcher) Get(ctx context.Context, name string) ([]byte, error) {
+	if name == unavailableMsgName {
+		return nil, fmt.Errorf("unavailable")
+	}
 	msg, ok := f.msgs[name]
 	if !ok {
-		return nil, fmt.Errorf("not found")
+		return nil, &healthapiclient.PermanentError{Err: fmt.Errorf("not found")}
 	}
 	return msg, nil
 }
@@ -66,9 +82,12 @@ func (f *fakeFetcher) Get(name string) ([]byte, error) {
 type fakeSender struct {
 	error   bool
 	msgSent []byte
+	// span is the span in the context of the last Send call.
+	span trace.SpanContext
 }
 
-func (s *fakeSender) Send(msg []byte) ([]byte, error) {
+func (s *fakeSender) Send(ctx context.Context, msg []byte) ([]byte, error) {
+	s.span = trace.SpanContextFromContext(ctx)
 	if s.error {
 		return nil, fmt.Errorf("send error")
 	}
@@ -84,6 +103,7 @@ func TestHandle(t *testing.T) {
 		checkPublish    bool
 		sentMsgExpected []byte
 		ackExpected     bool
+		nackExpected    bool
 		expectedMetrics map[string]int64
 	}{
 		{
@@ -116,6 +136,15 @@ func TestHandle(t *testing.T) {
 			msg:             &fakeMessage{name: "invalid_name", publish: true},
 			sender:          &fakeSender{},
 			checkPublish:    true,
+			ackExpected:     true,
+			expectedMetrics: map[string]int64{processedMetric: 1, fetchErrorMetric: 1, sendErrorMetric: 0, ignoredMetric: 0},
+		},
+		{
+			name:            "fetch error",
+			msg:             &fakeMessage{name: unavailableMsgName, publish: true},
+			sender:          &fakeSender{},
+			checkPublish:    true,
+			nackExpected:    true,
 			expectedMetrics: map[string]int64{processedMetric: 1, fetchErrorMetric: 1, sendErrorMetric: 0, ignoredMetric: 0},
 		},
 		{
@@ -123,6 +152,7 @@ func TestHandle(t *testing.T) {
 			msg:             &fakeMessage{name: msgName, publish: true},
 			sender:          &fakeSender{error: true},
 			checkPublish:    true,
+			nackExpected:    true,
 			expectedMetrics: map[string]int64{processedMetric: 1, fetchErrorMetric: 0, sendErrorMetric: 1, ignoredMetric: 0},
 		},
 	}
@@ -131,7 +161,7 @@ func TestHandle(t *testing.T) {
 			fc := testingutil.NewFakeMonitoringClient()
 			fetcher := &fakeFetcher{msgs: map[string][]byte{msgName: msgBytes}}
 			handler := New(fc, fetcher, tc.sender, tc.checkPublish)
-			handler.Handle(tc.msg)
+			handler.Handle(context.Background(), tc.msg)
 
 			if !bytes.Equal(tc.sender.msgSent, tc.sentMsgExpected) {
 				t.Errorf("Expected sent message %v, got %v", tc.sentMsgExpected, tc.sender.msgSent)
@@ -139,7 +169,30 @@ func TestHandle(t *testing.T) {
 			if tc.msg.acked != tc.ackExpected {
 				t.Errorf("Expected ack status %v, got %v", tc.ackExpected, tc.msg.acked)
 			}
+			if tc.msg.nacked != tc.nackExpected {
+				t.Errorf("Expected nack status %v, got %v", tc.nackExpected, tc.msg.nacked)
+			}
 			testingutil.CheckMetrics(t, fc, tc.expectedMetrics)
 		})
 	}
 }
+
+func TestHandleTracing(t *testing.T) {
+	exp := testingutil.RecordSpans(t)
+	msg := []byte("MSH|^~\\&|APP|FAC|RECV|RECVFAC|20180101000000||ADT^A01|CTRL1|P|2.5\rPID|1\r")
+	fetcher := &fakeFetcher{msgs: map[string][]byte{msgName: msg}}
+	sender := &fakeSender{error: true}
+	handler := New(testingutil.NewFakeMonitoringClient(), fetcher, sender, false)
+	handler.Handle(context.Background(), &fakeMessage{name: msgName})
+
+	span, attrs := testingutil.FindSpan(t, exp, "pubsub.handle")
+	if !sender.span.Equal(span.SpanContext) {
+		t.Errorf("Sender got span %v, want %v", sender.span, span.SpanContext)
+	}
+	if attrs[tracing.MessageNameKey] != msgName || attrs[tracing.ControlIDKey] != "CTRL1" {
+		t.Errorf("Attributes = %v, want message name %v and control ID CTRL1", attrs, msgName)
+	}
+	if span.Status.Code != codes.Error {
+		t.Errorf("Status = %v, want %v", span.Status.Code, codes.Error)
+	}
+}
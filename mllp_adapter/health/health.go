@@ -0,0 +1,163 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package health serves liveness and readiness probes and a status page for
+// the adapter.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Check reports whether a dependency of the adapter is usable. It returns nil
+// if it is. Checks are called on every probe and must be fast.
+type Check func() error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker tracks the checks that make up the readiness of the adapter.
+type Checker struct {
+	start time.Time
+
+	// mu guards checks and draining.
+	mu       sync.Mutex
+	checks   []namedCheck
+	draining bool
+}
+
+// CheckStatus is the outcome of one check on the status page.
+type CheckStatus struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Status is the content of the status page.
+type Status struct {
+	Ready    bool          `json:"ready"`
+	Draining bool          `json:"draining"`
+	Uptime   string        `json:"uptime"`
+	Checks   []CheckStatus `json:"checks"`
+}
+
+// New creates a Checker without checks.
+func New() *Checker {
+	return &Checker{start: time.Now()}
+}
+
+// Add adds a check that must pass for the adapter to be ready.
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// SetDraining marks the adapter as shutting down, which makes it not ready.
+func (c *Checker) SetDraining() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.draining = true
+}
+
+// Status runs all checks.
+func (c *Checker) Status() Status {
+	c.mu.Lock()
+	checks := c.checks
+	s := Status{Ready: !c.draining, Draining: c.draining, Uptime: time.Since(c.start).Round(time.Second).String()}
+	c.mu.Unlock()
+	s.Checks = []CheckStatus{}
+	for _, nc := range checks {
+		cs := CheckStatus{Name: nc.name, OK: true}
+		if err := nc.check(); err != nil {
+			cs.OK = false
+			cs.Error = err.Error()
+			s.Ready = false
+		}
+		s.Checks = append(s.Checks, cs)
+	}
+	return s
+}
+
+// Register adds the handlers of /healthz, /readyz and /statusz to mux.
+// /healthz always succeeds while the process serves HTTP. /readyz fails with
+// 503 while a check fails or the adapter drains. /statusz returns the
+// outcome of every check as JSON.
+func (c *Checker) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", c.serveReady)
+	mux.HandleFunc("/statusz", c.serveStatus)
+}
+
+func (c *Checker) serveReady(w http.ResponseWriter, r *http.Request) {
+	s := c.Status()
+	if s.Ready {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	var reasons []string
+	if s.Draining {
+		reasons = append(reasons, "draining")
+	}
+	for _, cs := range s.Checks {
+		if !cs.OK {
+			reasons = append(reasons, fmt.Sprintf("%v: %v", cs.Name, cs.Error))
+		}
+	}
+	http.Error(w, strings.Join(reasons, "\n"), http.StatusServiceUnavailable)
+}
+
+func (c *Checker) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(c.Status())
+}
+
+// Running returns a check and the functions that mark a background task as
+// started and stopped. The check fails until the task starts and once it
+// stops.
+func Running() (check Check, started func(), stopped func(error)) {
+	var mu sync.Mutex
+	state := fmt.Errorf("not started")
+	check = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return state
+	}
+	started = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		state = nil
+	}
+	stopped = func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err == nil {
+			state = fmt.Errorf("stopped")
+			return
+		}
+		state = fmt.Errorf("stopped: %v", err)
+	}
+	return check, started, stopped
+}
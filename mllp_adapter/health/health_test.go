@@ -0,0 +1,79 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func get(t *testing.T, mux *http.ServeMux, path string) (int, string) {
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestChecker(t *testing.T) {
+	c := New()
+	mux := http.NewServeMux()
+	c.Register(mux)
+	var apiErr error
+	c.Add("api", func() error { return apiErr })
+	check, started, stopped := Running()
+	c.Add("listener", check)
+
+	if code, body := get(t, mux, "/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "listener: not started") {
+		t.Errorf("/readyz before start = %v %q, want 503 naming the listener", code, body)
+	}
+	started()
+	if code, _ := get(t, mux, "/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz = %v, want 200", code)
+	}
+
+	apiErr = fmt.Errorf("unavailable")
+	code, body := get(t, mux, "/statusz")
+	var s Status
+	if err := json.Unmarshal([]byte(body), &s); err != nil || code != http.StatusOK {
+		t.Fatalf("/statusz = %v %q: %v", code, body, err)
+	}
+	want := []CheckStatus{{Name: "api", Error: "unavailable"}, {Name: "listener", OK: true}}
+	if s.Ready || s.Draining || fmt.Sprint(s.Checks) != fmt.Sprint(want) {
+		t.Errorf("/statusz = %+v, want not ready with checks %+v", s, want)
+	}
+
+	apiErr = nil
+	stopped(fmt.Errorf("accept failed"))
+	if code, body := get(t, mux, "/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "accept failed") {
+		t.Errorf("/readyz after stop = %v %q, want 503", code, body)
+	}
+}
+
+func TestDraining(t *testing.T) {
+	c := New()
+	mux := http.NewServeMux()
+	c.Register(mux)
+	c.SetDraining()
+	if code, body := get(t, mux, "/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "draining") {
+		t.Errorf("/readyz = %v %q, want 503 while draining", code, body)
+	}
+	// The process is still alive.
+	if code, _ := get(t, mux, "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz = %v, want 200", code)
+	}
+}
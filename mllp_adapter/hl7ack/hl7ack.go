@@ -0,0 +1,242 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hl7ack builds HL7 ACK messages locally, for when the adapter has to
+// answer a partner without a response from the HL7v2 store.
+package hl7ack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"github.com/GoogleCloudPlatform/mllp/shared/hl7"
+)
+
+// Code is an HL7 acknowledgment code (MSA-1).
+type Code string
+
+const (
+	// ApplicationAccept means the message was processed.
+	ApplicationAccept Code = "AA"
+	// ApplicationError means the message could not be processed. Senders
+	// usually retry.
+	ApplicationError Code = "AE"
+	// ApplicationReject means the message was rejected. Senders usually do
+	// not retry.
+	ApplicationReject Code = "AR"
+	// CommitAccept means the message was stored but not yet processed.
+	CommitAccept Code = "CA"
+)
+
+// Accepted reports whether c means that the message was accepted, either
+// processed (AA) or committed (CA).
+func (c Code) Accepted() bool {
+	return c == ApplicationAccept || c == CommitAccept
+}
+
+// ParseCode returns the acknowledgment code (MSA-1) of ack.
+func ParseCode(ack []byte) (Code, error) {
+	parsed, err := hl7.Parse(ack)
+	if err != nil {
+		return "", err
+	}
+	code, _ := parsed.Value("MSA-1")
+	if code == "" {
+		return "", fmt.Errorf("ACK has no acknowledgment code (MSA-1)")
+	}
+	return Code(code), nil
+}
+
+// Class is a kind of failure to ingest a message.
+type Class string
+
+const (
+	// Unauthorized means the adapter's credentials were rejected.
+	Unauthorized Class = "unauthorized"
+	// Quota means the request was throttled.
+	Quota Class = "quota"
+	// Unavailable means the HL7v2 store could not be reached in time.
+	Unavailable Class = "unavailable"
+	// Invalid means the request was refused for another reason.
+	Invalid Class = "invalid"
+	// Other covers all remaining errors.
+	Other Class = "other"
+)
+
+// reasons are the texts sent to partners in the ERR segment. They must never
+// contain message contents.
+var reasons = map[Class]string{
+	Unauthorized: "Receiving application is not authorized to store the message",
+	Quota:        "Receiving application is over quota",
+	Unavailable:  "Receiving application is temporarily unavailable",
+	Invalid:      "Receiving application refused the message",
+	Other:        "Receiving application could not store the message",
+}
+
+const (
+	hl7Time = "20060102150405"
+	// internalError is code 207 "Application internal error" from HL7 table
+	// 0357.
+	internalError = "207"
+	errorTable    = "HL70357"
+)
+
+// Classify maps an error returned while storing a message to its Class.
+func Classify(err error) Class {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden:
+			return Unauthorized
+		case apiErr.Code == http.StatusTooManyRequests:
+			return Quota
+		case apiErr.Code == http.StatusRequestTimeout || apiErr.Code >= 500:
+			return Unavailable
+		}
+		return Invalid
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+		return Unavailable
+	}
+	return Other
+}
+
+// Reason returns the text sent to partners for a failure of class c.
+func Reason(c Class) string {
+	return reasons[c]
+}
+
+// Policy selects the acknowledgment code returned for each failure class.
+// Classes that are not in the policy are not acknowledged.
+type Policy map[Class]Code
+
+// ParsePolicy parses a comma separated list of class=code pairs, e.g.
+// "quota=AE,unavailable=AE,invalid=AR".
+func ParsePolicy(s string) (Policy, error) {
+	p := Policy{}
+	if s == "" {
+		return p, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid entry %q, want class=code", kv)
+		}
+		c, code := Class(parts[0]), Code(parts[1])
+		if _, ok := reasons[c]; !ok {
+			return nil, fmt.Errorf("unknown failure class %q", c)
+		}
+		if code != ApplicationError && code != ApplicationReject {
+			return nil, fmt.Errorf("invalid code %q for %v, want %v or %v", code, c, ApplicationError, ApplicationReject)
+		}
+		p[c] = code
+	}
+	return p, nil
+}
+
+// Build returns an ACK for msg with the given code, addressed back to the
+// sending application and echoing the message control ID. If reason is not
+// empty it is reported in an ERR segment. Build fails if msg does not start
+// with an MSH segment carrying a control ID.
+func Build(msg []byte, code Code, reason string) ([]byte, error) {
+	in, err := hl7.Parse(msg)
+	if err != nil {
+		return nil, err
+	}
+	if in.Segments[0].Name != "MSH" {
+		return nil, fmt.Errorf("message does not start with an MSH segment")
+	}
+	if id, _ := in.Get("MSH-10"); id == "" {
+		return nil, fmt.Errorf("message has no control ID (MSH-10)")
+	}
+	return BuildParsed(in, code, reason), nil
+}
+
+// BuildParsed returns an ACK for the already parsed in like Build, but does not
+// require a control ID. Without one MSA-2 is left empty, which is how the
+// HL7v2 API rejects such messages. in must start with an MSH segment.
+func BuildParsed(in *hl7.Message, code Code, reason string) []byte {
+	field := func(loc string) string {
+		v, _ := in.Get(loc)
+		return v
+	}
+	d := in.Delimiters
+	version, _ := in.Value("MSH-12.1")
+	reason = d.Encode(reason)
+
+	msh := &hl7.Segment{Name: "MSH", Fields: []hl7.Field{
+		in.Segments[0].Field(1), in.Segments[0].Field(2),
+		value(field("MSH-5")), value(field("MSH-6")), value(field("MSH-3")), value(field("MSH-4")),
+		value(time.Now().Format(hl7Time)), nil,
+		{{{"ACK"}, {field("MSH-9.2")}, {"ACK"}}},
+		value(hl7.NewControlID("ACK")),
+		value(field("MSH-11")), value(field("MSH-12")),
+	}}
+	msa := &hl7.Segment{Name: "MSA", Fields: []hl7.Field{value(string(code)), value(field("MSH-10"))}}
+	out := &hl7.Message{Delimiters: d, Segments: []*hl7.Segment{msh, msa}}
+	if reason != "" {
+		var errSeg *hl7.Segment
+		if before25(version) {
+			// Up to v2.4 the text goes in MSA-3 and the error in ERR-1.
+			msa.Fields = append(msa.Fields, value(reason))
+			errSeg = &hl7.Segment{Name: "ERR", Fields: []hl7.Field{
+				{{nil, nil, nil, {internalError, reason, errorTable}}},
+			}}
+		} else {
+			// From v2.5 ERR-3 holds the error, ERR-4 the severity and ERR-8
+			// the text for the user.
+			errSeg = &hl7.Segment{Name: "ERR", Fields: []hl7.Field{
+				nil, nil,
+				{{{internalError}, {"Application internal error"}, {errorTable}}},
+				value("E"), nil, nil, nil,
+				value(reason),
+			}}
+		}
+		out.Segments = append(out.Segments, errSeg)
+	}
+	for _, s := range out.Segments {
+		s.Terminator = "\r"
+	}
+	return out.Bytes()
+}
+
+// value returns a field holding the already escaped value v. Values copied
+// from the inbound message keep their delimiters, since both messages share
+// the same encoding characters.
+func value(v string) hl7.Field {
+	return hl7.Field{{{v}}}
+}
+
+// before25 reports whether an HL7 version ID (MSH-12) is older than 2.5. Empty
+// or unparsable versions are treated as older.
+func before25(version string) bool {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return true
+	}
+	major, err1 := strconv.Atoi(parts[0])
+	minor, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return true
+	}
+	return major < 2 || major == 2 && minor < 5
+}
@@ -0,0 +1,204 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hl7ack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+	"github.com/GoogleCloudPlatform/mllp/shared/hl7"
+)
+
+func segments(t *testing.T, ack []byte) [][]string {
+	t.Helper()
+	var segs [][]string
+	for _, s := range strings.Split(strings.TrimSuffix(string(ack), "\r"), "\r") {
+		segs = append(segs, strings.Split(s, "|"))
+	}
+	return segs
+}
+
+func TestBuild(t *testing.T) {
+	msg := []byte("MSH|^~\\&|SENDAPP|SENDFAC|RECVAPP|RECVFAC|20180101000000||ADT^A01^ADT_A01|CTRL1|P|2.5\rPID|||123\r")
+	ack, err := Build(msg, CommitAccept, "")
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	segs := segments(t, ack)
+	if len(segs) != 2 {
+		t.Fatalf("ACK has segments %q, want MSH and MSA", segs)
+	}
+	want := map[int]string{
+		1:  "^~\\&",
+		2:  "RECVAPP",
+		3:  "RECVFAC",
+		4:  "SENDAPP",
+		5:  "SENDFAC",
+		8:  "ACK^A01^ACK",
+		10: "P",
+		11: "2.5",
+	}
+	for i, w := range want {
+		if segs[0][i] != w {
+			t.Errorf("MSH-%d = %q, want %q", i+1, segs[0][i], w)
+		}
+	}
+	if want := []string{"MSA", "CA", "CTRL1"}; !reflect.DeepEqual(segs[1], want) {
+		t.Errorf("MSA = %q, want %q", segs[1], want)
+	}
+}
+
+func TestBuildControlID(t *testing.T) {
+	msg := []byte("MSH|^~\\&|A|B|C|D|20180101000000||ADT^A01|CTRL1|P|2.5\r")
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		ack, err := Build(msg, ApplicationAccept, "")
+		if err != nil {
+			t.Fatalf("Build: %v", err)
+		}
+		id := segments(t, ack)[0][9]
+		if len(id) > 20 {
+			t.Errorf("MSH-10 = %q, want at most 20 characters", id)
+		}
+		if seen[id] {
+			t.Errorf("MSH-10 %q was used twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestBuildParsedWithoutControlID(t *testing.T) {
+	in, err := hl7.Parse([]byte("MSH|^~\\&|A|B|C|D|20180101000000||ADT^A01||P|2.5\r"))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	segs := segments(t, BuildParsed(in, ApplicationReject, "MSH-10 is required"))
+	if want := []string{"MSA", "AR", ""}; !reflect.DeepEqual(segs[1], want) {
+		t.Errorf("MSA = %q, want %q", segs[1], want)
+	}
+}
+
+func TestBuildWithReason(t *testing.T) {
+	testCases := []struct {
+		version string
+		wantMSA []string
+		wantERR []string
+	}{
+		{
+			"2.5.1",
+			[]string{"MSA", "AE", "CTRL1"},
+			[]string{"ERR", "", "", "207^Application internal error^HL70357", "E", "", "", "", "unavailable"},
+		},
+		{
+			"2.3",
+			[]string{"MSA", "AE", "CTRL1", "unavailable"},
+			[]string{"ERR", "^^^207&unavailable&HL70357"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.version, func(t *testing.T) {
+			msg := []byte("MSH|^~\\&|A|B|C|D|20180101000000||ADT^A01|CTRL1|P|" + tc.version + "\r")
+			ack, err := Build(msg, ApplicationError, "unavailable")
+			if err != nil {
+				t.Fatalf("Build: %v", err)
+			}
+			segs := segments(t, ack)
+			if len(segs) != 3 {
+				t.Fatalf("ACK has segments %q, want MSH, MSA and ERR", segs)
+			}
+			if !reflect.DeepEqual(segs[1], tc.wantMSA) {
+				t.Errorf("MSA = %q, want %q", segs[1], tc.wantMSA)
+			}
+			if !reflect.DeepEqual(segs[2], tc.wantERR) {
+				t.Errorf("ERR = %q, want %q", segs[2], tc.wantERR)
+			}
+		})
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	for _, msg := range []string{
+		"",
+		"PID|||123\r",
+		"MSH|^~\\&|A|B|C|D|20180101000000||ADT^A01\r",
+	} {
+		if _, err := Build([]byte(msg), ApplicationError, ""); err == nil {
+			t.Errorf("Build(%q) succeeded, want error", msg)
+		}
+	}
+}
+
+func TestParseCode(t *testing.T) {
+	testCases := []struct {
+		ack          string
+		want         Code
+		wantErr      bool
+		wantAccepted bool
+	}{
+		{ack: "MSH|^~\\&|A|B|C|D|20180101000000||ACK|1|P|2.5\rMSA|AA|CTRL1\r", want: ApplicationAccept, wantAccepted: true},
+		{ack: "MSH|^~\\&|A|B|C|D|20180101000000||ACK|1|P|2.5\rMSA|CA|CTRL1\r", want: CommitAccept, wantAccepted: true},
+		{ack: "MSH|^~\\&|A|B|C|D|20180101000000||ACK|1|P|2.5\rMSA|AE|CTRL1\r", want: ApplicationError},
+		{ack: "MSH|^~\\&|A|B|C|D|20180101000000||ACK|1|P|2.5\r", wantErr: true},
+		{ack: "", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseCode([]byte(tc.ack))
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("ParseCode(%q) = %q, %v, want %q and error %v", tc.ack, got, err, tc.want, tc.wantErr)
+		}
+		if got.Accepted() != tc.wantAccepted {
+			t.Errorf("Code(%q).Accepted() = %v, want %v", got, got.Accepted(), tc.wantAccepted)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want Class
+	}{
+		{&googleapi.Error{Code: http.StatusForbidden}, Unauthorized},
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, Quota},
+		{&googleapi.Error{Code: http.StatusServiceUnavailable}, Unavailable},
+		{&googleapi.Error{Code: http.StatusBadRequest}, Invalid},
+		{fmt.Errorf("calling API: %w", context.DeadlineExceeded), Unavailable},
+		{fmt.Errorf("disk full"), Other},
+	}
+	for _, tc := range testCases {
+		if got := Classify(tc.err); got != tc.want {
+			t.Errorf("Classify(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy("quota=AE, invalid=AR")
+	if err != nil {
+		t.Fatalf("ParsePolicy: %v", err)
+	}
+	if want := (Policy{Quota: ApplicationError, Invalid: ApplicationReject}); !reflect.DeepEqual(p, want) {
+		t.Errorf("ParsePolicy() = %v, want %v", p, want)
+	}
+	for _, s := range []string{"quota", "bogus=AE", "quota=AA"} {
+		if _, err := ParsePolicy(s); err == nil {
+			t.Errorf("ParsePolicy(%q) succeeded, want error", s)
+		}
+	}
+}
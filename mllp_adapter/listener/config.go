@@ -0,0 +1,182 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package listener describes the MLLP listeners run by a single adapter
+// process, each feeding its own HL7v2 store.
+package listener
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/router"
+)
+
+// DefaultName is reserved for the listener configured by command line flags.
+const DefaultName = "default"
+
+// Config is a list of listeners, usually read from a JSON file such as:
+//
+//	{
+//	  "listeners": [{
+//	    "name": "lab",
+//	    "receiver_ip": "0.0.0.0",
+//	    "port": 2576,
+//	    "tls": {"cert": "/certs/lab.pem", "key": "/certs/lab.key", "client_ca": "/certs/lab-ca.pem"},
+//	    "store": {"project_id": "p", "location_id": "l", "dataset_id": "d", "hl7_v2_store_id": "lab"},
+//	    "fallback_encoding": "windows-1252"
+//	  }]
+//	}
+type Config struct {
+	Listeners []Listener `json:"listeners"`
+}
+
+// Listener describes an MLLP receiver and the HL7v2 store it writes to. The
+// fields mirror the adapter's receiver flags.
+type Listener struct {
+	// Name identifies the listener in logs and in the listener label of its
+	// metrics.
+	Name       string `json:"name"`
+	ReceiverIP string `json:"receiver_ip"`
+	Port       int    `json:"port"`
+	// MLLPRelease is 1 (the default) or 2.
+	MLLPRelease int          `json:"mllp_release"`
+	TLS         TLS          `json:"tls"`
+	Store       router.Store `json:"store"`
+
+	LogACK                  bool   `json:"log_ack"`
+	LogNACKedMessage        bool   `json:"log_nacked_msg"`
+	LogErrorMessage         bool   `json:"log_error_msg"`
+	LogInputMessageInBase64 bool   `json:"log_input_msg_in_base64"`
+	FallbackEncoding        string `json:"fallback_encoding"`
+
+	MaxMessageSize int      `json:"max_message_size"`
+	ReadTimeout    Duration `json:"read_timeout"`
+	IdleTimeout    Duration `json:"idle_timeout"`
+	// StartBlock and EndBlock replace the MLLP frame delimiters if not zero.
+	StartBlock        int  `json:"start_block"`
+	EndBlock          int  `json:"end_block"`
+	AlternateTrailers bool `json:"alternate_trailers"`
+	NormalizeSegments bool `json:"normalize_segments"`
+
+	// LocalNACK is a policy in the format of --receiver_local_nack.
+	LocalNACK        string `json:"local_nack"`
+	QueueDir         string `json:"queue_dir"`
+	QueueMaxAttempts int    `json:"queue_max_attempts"`
+	RoutesFile       string `json:"routes_file"`
+	// DedupWindow enables duplicate suppression, e.g. "10m".
+	DedupWindow Duration `json:"dedup_window"`
+	DedupDir    string   `json:"dedup_dir"`
+}
+
+// Duration is a time.Duration written in JSON as a string such as "1h30m".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations must be strings such as \"10m\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// TLS holds the server TLS settings of a listener. TLS is off unless Cert and
+// Key are set.
+type TLS struct {
+	Cert         string   `json:"cert"`
+	Key          string   `json:"key"`
+	ClientCA     string   `json:"client_ca"`
+	MinVersion   string   `json:"min_version"`
+	CipherSuites []string `json:"cipher_suites"`
+}
+
+// Enabled reports whether any TLS setting was given.
+func (t TLS) Enabled() bool {
+	return t.Cert != "" || t.Key != ""
+}
+
+// LoadConfig reads a list of listeners from a JSON file and checks that they
+// do not conflict with each other.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading listeners: %v", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	c := &Config{}
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("parsing listeners: %v", err)
+	}
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		if l.Name == DefaultName {
+			return nil, fmt.Errorf("listener name %q is reserved for the listener configured by flags", DefaultName)
+		}
+		if l.MLLPRelease == 0 {
+			l.MLLPRelease = 1
+		}
+	}
+	if err := Check(c.Listeners); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Check reports an error if listeners share a name, an address, a queue
+// directory or a dedup directory, or lack an address.
+func Check(listeners []Listener) error {
+	names := map[string]bool{}
+	addrs := map[string]bool{}
+	dirs := map[string]bool{}
+	for _, l := range listeners {
+		if l.Name == "" || names[l.Name] {
+			return fmt.Errorf("listener names must be unique and not empty, got %q", l.Name)
+		}
+		names[l.Name] = true
+		if l.ReceiverIP == "" {
+			return fmt.Errorf("listener %q: receiver_ip not provided", l.Name)
+		}
+		if l.Port <= 0 || l.Port > 65535 {
+			return fmt.Errorf("listener %q: invalid port %d", l.Name, l.Port)
+		}
+		if l.StartBlock < 0 || l.StartBlock > 255 || l.EndBlock < 0 || l.EndBlock > 255 {
+			return fmt.Errorf("listener %q: start and end blocks must be bytes, got %d and %d", l.Name, l.StartBlock, l.EndBlock)
+		}
+		addr := fmt.Sprintf("%v:%d", l.ReceiverIP, l.Port)
+		if addrs[addr] {
+			return fmt.Errorf("listener %q: address %v is used by another listener", l.Name, addr)
+		}
+		addrs[addr] = true
+		for _, dir := range []string{l.QueueDir, l.DedupDir} {
+			if dir == "" {
+				continue
+			}
+			if dirs[dir] {
+				return fmt.Errorf("listener %q: directory %v is used by another queue or dedup log", l.Name, dir)
+			}
+			dirs[dir] = true
+		}
+	}
+	return nil
+}
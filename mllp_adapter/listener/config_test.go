@@ -0,0 +1,104 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/router"
+	"github.com/GoogleCloudPlatform/mllp/shared/testingutil"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := testingutil.WriteFile(t, t.TempDir(), "listeners.json", []byte(`{
+  "listeners": [{
+    "name": "lab",
+    "receiver_ip": "0.0.0.0",
+    "port": 2576,
+    "tls": {"cert": "lab.pem", "key": "lab.key", "cipher_suites": ["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"]},
+    "store": {"project_id": "p", "location_id": "l", "dataset_id": "d", "hl7_v2_store_id": "lab"},
+    "log_nacked_msg": true,
+    "alternate_trailers": true,
+    "fallback_encoding": "windows-1252"
+  }, {
+    "name": "radiology",
+    "receiver_ip": "0.0.0.0",
+    "port": 2577,
+    "mllp_release": 2,
+    "store": {"project_id": "p", "location_id": "l", "dataset_id": "d", "hl7_v2_store_id": "radiology"},
+    "max_message_size": 1048576,
+    "idle_timeout": "10m",
+    "queue_dir": "/queue/radiology",
+    "dedup_window": "1h",
+    "dedup_dir": "/dedup/radiology"
+  }]
+}`))
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	want := &Config{Listeners: []Listener{{
+		Name:              "lab",
+		ReceiverIP:        "0.0.0.0",
+		Port:              2576,
+		MLLPRelease:       1,
+		TLS:               TLS{Cert: "lab.pem", Key: "lab.key", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+		Store:             router.Store{ProjectID: "p", LocationID: "l", DatasetID: "d", HL7V2StoreID: "lab"},
+		LogNACKedMessage:  true,
+		AlternateTrailers: true,
+		FallbackEncoding:  "windows-1252",
+	}, {
+		Name:           "radiology",
+		ReceiverIP:     "0.0.0.0",
+		Port:           2577,
+		MLLPRelease:    2,
+		Store:          router.Store{ProjectID: "p", LocationID: "l", DatasetID: "d", HL7V2StoreID: "radiology"},
+		MaxMessageSize: 1048576,
+		IdleTimeout:    Duration(10 * time.Minute),
+		QueueDir:       "/queue/radiology",
+		DedupWindow:    Duration(time.Hour),
+		DedupDir:       "/dedup/radiology",
+	}}}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("LoadConfig() = %+v, want %+v", c, want)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"syntax.json":   `{"listeners": [`,
+		"unknown.json":  `{"listeners": [{"name": "a", "ip": "0.0.0.0", "port": 1}]}`,
+		"noname.json":   `{"listeners": [{"receiver_ip": "0.0.0.0", "port": 1}]}`,
+		"default.json":  `{"listeners": [{"name": "default", "receiver_ip": "0.0.0.0", "port": 1}]}`,
+		"dupname.json":  `{"listeners": [{"name": "a", "receiver_ip": "0.0.0.0", "port": 1}, {"name": "a", "receiver_ip": "0.0.0.0", "port": 2}]}`,
+		"noip.json":     `{"listeners": [{"name": "a", "port": 1}]}`,
+		"port.json":     `{"listeners": [{"name": "a", "receiver_ip": "0.0.0.0", "port": 70000}]}`,
+		"dupaddr.json":  `{"listeners": [{"name": "a", "receiver_ip": "0.0.0.0", "port": 1}, {"name": "b", "receiver_ip": "0.0.0.0", "port": 1}]}`,
+		"dupqueue.json": `{"listeners": [{"name": "a", "receiver_ip": "0.0.0.0", "port": 1, "queue_dir": "/q"}, {"name": "b", "receiver_ip": "0.0.0.0", "port": 2, "queue_dir": "/q"}]}`,
+		"block.json":    `{"listeners": [{"name": "a", "receiver_ip": "0.0.0.0", "port": 1, "start_block": 256}]}`,
+		"dupdir.json":   `{"listeners": [{"name": "a", "receiver_ip": "0.0.0.0", "port": 1, "queue_dir": "/q", "dedup_dir": "/q"}]}`,
+		"window.json":   `{"listeners": [{"name": "a", "receiver_ip": "0.0.0.0", "port": 1, "dedup_window": 10}]}`,
+	} {
+		if _, err := LoadConfig(testingutil.WriteFile(t, dir, name, []byte(content))); err == nil {
+			t.Errorf("LoadConfig(%v) succeeded, want error", name)
+		}
+	}
+	if _, err := LoadConfig(dir + "/missing.json"); err == nil {
+		t.Errorf("LoadConfig() of a missing file succeeded, want error")
+	}
+}
@@ -19,74 +19,511 @@ package mllp
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-
-	log "github.com/golang/glog"
+	"sync"
+	"time"
 )
 
 const (
 	startBlock = '\x0b'
 	endBlock   = '\x1c'
 	cr         = '\x0d'
+
+	// commitACK and commitNAK are the payloads of MLLP Release 2 commit
+	// acknowledgements.
+	commitACK = '\x06'
+	commitNAK = '\x15'
+)
+
+// Release is a version of the MLLP transport specification.
+type Release int
+
+const (
+	// Release1 is the original MLLP framing. Only the HL7 application ACK is
+	// returned for each message.
+	Release1 Release = 1
+	// Release2 adds reliable delivery: the receiver answers each frame with a
+	// commit ACK or NAK before, and independent of, the HL7 application ACK.
+	Release2 Release = 2
 )
 
+// ParseRelease converts a release number to a Release.
+func ParseRelease(r int) (Release, error) {
+	switch Release(r) {
+	case Release1, Release2:
+		return Release(r), nil
+	}
+	return 0, fmt.Errorf("unsupported MLLP release %d, want 1 or 2", r)
+}
+
+// ErrCommitNAK is returned by NextCommit when the peer rejects a message with
+// an MLLP Release 2 negative commit acknowledgement.
+var ErrCommitNAK = errors.New("received MLLP commit NAK")
+
+// ErrFrameTooLarge is returned by Next when a message is longer than the
+// reader's MaxFrameSize. The rest of the frame is discarded, so the following
+// call to Next reads the next message.
+var ErrFrameTooLarge = errors.New("MLLP frame exceeds maximum size")
+
+// ErrTruncatedFrame is returned by Next when the stream ends in the middle of
+// a frame.
+var ErrTruncatedFrame = errors.New("MLLP frame truncated")
+
+// TrailerError is returned by Next when the end block of a frame is not
+// followed by a carriage return. The reader is left before the unexpected
+// byte, so the following call to Next resumes at the next start block.
+type TrailerError struct {
+	// Got is the byte found instead of the carriage return.
+	Got byte
+}
+
+func (e *TrailerError) Error() string {
+	return fmt.Sprintf("message ends with %q, want %q", e.Got, cr)
+}
+
+// DroppedBytesError is returned by Next when bytes were found before the
+// start block of a frame and discarded. It is only a warning: the following
+// call to Next reads the frame.
+type DroppedBytesError struct {
+	// Count is the number of bytes discarded.
+	Count int
+}
+
+func (e *DroppedBytesError) Error() string {
+	return fmt.Sprintf("dropped %d bytes before start of message", e.Count)
+}
+
+// maxPooledBuffer is the capacity above which buffers are not returned to
+// their pool, so that one very large message does not pin its memory.
+const maxPooledBuffer = 1 << 20
+
+// writePool holds buffers for WriteMsg.
+var writePool = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// appendFrame appends msg wrapped in the given start block, end block, and a
+// carriage return to buf.
+func appendFrame(buf, msg []byte, start, end byte) []byte {
+	buf = append(buf, start)
+	buf = append(buf, msg...)
+	return append(buf, end, cr)
+}
+
 // WriteMsg wraps an HL7 message in the start block, end block, and carriage return bytes
-// required for MLLP transmission and then writes the wrapped message to writer.
+// required for MLLP transmission and then writes the wrapped message to writer
+// with a single call to Write.
 func WriteMsg(writer io.Writer, msg []byte) error {
-	if _, err := writer.Write([]byte{startBlock}); err != nil {
-		return fmt.Errorf("writing message: %v", err)
+	buf := writePool.Get().(*[]byte)
+	*buf = appendFrame((*buf)[:0], msg, startBlock, endBlock)
+	_, err := writer.Write(*buf)
+	if cap(*buf) <= maxPooledBuffer {
+		writePool.Put(buf)
 	}
-	if _, err := writer.Write(msg); err != nil {
+	if err != nil {
 		return fmt.Errorf("writing message: %v", err)
 	}
-	if _, err := writer.Write([]byte{endBlock, cr}); err != nil {
+	return nil
+}
+
+// WriteCommitACK writes an MLLP Release 2 commit acknowledgement, telling the
+// peer that the last message was received and safely stored.
+func WriteCommitACK(writer io.Writer) error {
+	return WriteMsg(writer, []byte{commitACK})
+}
+
+// WriteCommitNAK writes an MLLP Release 2 negative commit acknowledgement,
+// asking the peer to retransmit the last message.
+func WriteCommitNAK(writer io.Writer) error {
+	return WriteMsg(writer, []byte{commitNAK})
+}
+
+// MessageWriter writes MLLP frames to a stream, each with a single call to
+// Write, reusing its buffer from one message to the next. It is meant for a
+// long-lived connection and is not safe for concurrent use.
+type MessageWriter struct {
+	w          io.Writer
+	buf        []byte
+	startBlock byte
+	endBlock   byte
+}
+
+// WriterOption contains optional settings for a MessageWriter.
+type WriterOption struct {
+	// StartBlock and EndBlock replace the start block (0x0B) and end block
+	// (0x1C) bytes if not zero, so that partners whose frames are read with
+	// the same Leniency can read the replies.
+	StartBlock byte
+	EndBlock   byte
+}
+
+// NewMessageWriter returns a MessageWriter that writes to w.
+func NewMessageWriter(w io.Writer) *MessageWriter {
+	return NewMessageWriterWithOption(w, WriterOption{})
+}
+
+// NewMessageWriterWithOption returns a MessageWriter that writes to w with the
+// given framing.
+func NewMessageWriterWithOption(w io.Writer, opt WriterOption) *MessageWriter {
+	mw := &MessageWriter{w: w, startBlock: startBlock, endBlock: endBlock}
+	if opt.StartBlock != 0 {
+		mw.startBlock = opt.StartBlock
+	}
+	if opt.EndBlock != 0 {
+		mw.endBlock = opt.EndBlock
+	}
+	return mw
+}
+
+// WriteMsg wraps msg in an MLLP frame and writes it.
+func (mw *MessageWriter) WriteMsg(msg []byte) error {
+	mw.buf = appendFrame(mw.buf[:0], msg, mw.startBlock, mw.endBlock)
+	_, err := mw.w.Write(mw.buf)
+	if cap(mw.buf) > maxPooledBuffer {
+		mw.buf = nil
+	}
+	if err != nil {
 		return fmt.Errorf("writing message: %v", err)
 	}
 	return nil
 }
 
+// WriteCommitACK writes an MLLP Release 2 commit acknowledgement.
+func (mw *MessageWriter) WriteCommitACK() error {
+	return mw.WriteMsg([]byte{commitACK})
+}
+
+// WriteCommitNAK writes an MLLP Release 2 negative commit acknowledgement.
+func (mw *MessageWriter) WriteCommitNAK() error {
+	return mw.WriteMsg([]byte{commitNAK})
+}
+
+// IsCommit returns whether msg is an MLLP Release 2 commit ACK or NAK rather
+// than an HL7 message.
+func IsCommit(msg []byte) bool {
+	return len(msg) == 1 && (msg[0] == commitACK || msg[0] == commitNAK)
+}
+
 // MessageReader consumes MLLP messages from a stream.
 type MessageReader struct {
-	r *bufio.Reader
+	r            *bufio.Reader
+	deadliner    deadliner
+	maxFrameSize int
+	frameTimeout time.Duration
+	lenient      Leniency
+	startBlock   byte
+	endBlock     byte
+	corrected    func(Correction)
+	started      func()
+	// trailerPending is set when a lenient frame ended before its trailer
+	// arrived. The trailer is checked at the start of the following frame.
+	trailerPending bool
+}
+
+// deadliner is implemented by streams with read deadlines, such as net.Conn.
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// Leniency contains opt-in settings for reading frames from partners that do
+// not follow the MLLP specification.
+type Leniency struct {
+	// StartBlock and EndBlock replace the start block (0x0B) and end block
+	// (0x1C) bytes if not zero.
+	StartBlock byte
+	EndBlock   byte
+	// AlternateTrailers accepts an end block followed by LF instead of CR, or
+	// by nothing at all.
+	AlternateTrailers bool
+	// NormalizeSegments replaces LF and CRLF segment terminators within
+	// messages by CR.
+	NormalizeSegments bool
+}
+
+// Correction is a kind of deviation from the specification that a lenient
+// reader accepted.
+type Correction string
+
+const (
+	// LFTrailer is an end block followed by LF instead of CR.
+	LFTrailer Correction = "lf-trailer"
+	// MissingTrailer is an end block followed by neither CR nor LF.
+	MissingTrailer Correction = "missing-trailer"
+	// SegmentTerminators is a message with LF or CRLF segment terminators.
+	SegmentTerminators Correction = "segment-terminators"
+)
+
+// ReaderOption contains optional settings for a MessageReader.
+type ReaderOption struct {
+	// MaxFrameSize is the maximum length of a message in bytes. Longer
+	// messages are discarded and reported with ErrFrameTooLarge. If zero,
+	// messages of any length are read.
+	MaxFrameSize int
+	// FrameTimeout limits the time taken to read a message once its start
+	// block has arrived. It only applies to streams with a SetReadDeadline
+	// method, whose read deadline is cleared after every message. If zero,
+	// there is no limit.
+	FrameTimeout time.Duration
+	// Lenient selects the deviations from the specification that are
+	// accepted.
+	Lenient Leniency
+	// Corrected, if set, is called every time a deviation allowed by Lenient
+	// is accepted.
+	Corrected func(Correction)
+	// Started, if set, is called when the start block of a frame has been
+	// read, before FrameTimeout is applied.
+	Started func()
 }
 
 // NewMessageReader to unwrap MLLP messages the provided stream.
 func NewMessageReader(r io.Reader) *MessageReader {
-	return &MessageReader{r: bufio.NewReader(r)}
+	return NewMessageReaderWithOption(r, ReaderOption{})
+}
+
+// NewMessageReaderWithOption returns a MessageReader for r with the given
+// limits and leniency.
+func NewMessageReaderWithOption(r io.Reader, opt ReaderOption) *MessageReader {
+	mr := &MessageReader{
+		r:            bufio.NewReader(r),
+		maxFrameSize: opt.MaxFrameSize,
+		frameTimeout: opt.FrameTimeout,
+		lenient:      opt.Lenient,
+		startBlock:   startBlock,
+		endBlock:     endBlock,
+		corrected:    opt.Corrected,
+		started:      opt.Started,
+	}
+	if opt.Lenient.StartBlock != 0 {
+		mr.startBlock = opt.Lenient.StartBlock
+	}
+	if opt.Lenient.EndBlock != 0 {
+		mr.endBlock = opt.Lenient.EndBlock
+	}
+	if mr.corrected == nil {
+		mr.corrected = func(Correction) {}
+	}
+	if d, ok := r.(deadliner); ok && opt.FrameTimeout > 0 {
+		mr.deadliner = d
+	}
+	return mr
 }
 
 // Next message in the reader. Unwraps the inner message by removing the start
-// block, end block, and carriage return bytes.
+// block, end block, and carriage return bytes. Besides errors from the
+// stream, Next returns:
+//   - a *DroppedBytesError without a message if bytes preceded the start
+//     block;
+//   - the first MaxFrameSize bytes of a longer message with ErrFrameTooLarge;
+//   - the message with a *TrailerError if the end block is not followed by a
+//     carriage return;
+//   - ErrTruncatedFrame if the stream ends within a frame.
+//
+// After any of these, except stream errors and ErrTruncatedFrame, Next can be
+// called again to read the following frame.
 func (mr *MessageReader) Next() ([]byte, error) {
-	data, err := mr.r.ReadBytes(startBlock)
+	if mr.trailerPending {
+		mr.trailerPending = false
+		if err := mr.lenientTrailer(); err != nil {
+			return nil, err
+		}
+	}
+	dropped, err := mr.skipToStart()
 	if err != nil {
 		return nil, err
 	}
-	if len(data) > 1 {
-		log.Infof("dropped %d bytes before start of message", len(data)-1)
+	if dropped > 0 {
+		return nil, &DroppedBytesError{Count: dropped}
+	}
+	if mr.started != nil {
+		mr.started()
+	}
+	if mr.deadliner != nil {
+		if err := mr.deadliner.SetReadDeadline(time.Now().Add(mr.frameTimeout)); err != nil {
+			return nil, err
+		}
+		defer mr.deadliner.SetReadDeadline(time.Time{})
 	}
-	// Read everything up to the endBlock byte.
-	rawMsg, err := mr.r.ReadBytes(endBlock)
+	rawMsg, tooLarge, err := mr.readFrame()
 	if err != nil {
-		return nil, err
+		return nil, truncated(err)
+	}
+	if mr.lenient.NormalizeSegments && bytes.IndexByte(rawMsg, '\n') >= 0 {
+		rawMsg = bytes.ReplaceAll(bytes.ReplaceAll(rawMsg, []byte("\r\n"), []byte("\r")), []byte("\n"), []byte("\r"))
+		mr.corrected(SegmentTerminators)
+	}
+	if mr.lenient.AlternateTrailers {
+		// A partner that sends no trailer waits for the ACK, so the trailer
+		// is only checked now if it has already arrived.
+		if mr.r.Buffered() > 0 {
+			if err := mr.lenientTrailer(); err != nil {
+				return nil, err
+			}
+		} else {
+			mr.trailerPending = true
+		}
+	} else {
+		// Read one more byte for the carriage return.
+		lastByte, err := mr.r.ReadByte()
+		if err != nil {
+			return nil, truncated(err)
+		}
+		if lastByte != cr {
+			if err := mr.r.UnreadByte(); err != nil {
+				return nil, err
+			}
+			return rawMsg, &TrailerError{Got: lastByte}
+		}
+	}
+	if tooLarge {
+		return rawMsg, ErrFrameTooLarge
 	}
-	// Read one more byte for the carriage return.
-	lastByte, err := mr.r.ReadByte()
+	return rawMsg, nil
+}
+
+// lenientTrailer consumes a CR or LF trailer, and leaves any other byte for
+// the following frame.
+func (mr *MessageReader) lenientTrailer() error {
+	b, err := mr.r.ReadByte()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if lastByte != cr {
-		if err := mr.r.UnreadByte(); err != nil {
-			return nil, err
+	switch b {
+	case cr:
+	case '\n':
+		mr.corrected(LFTrailer)
+	default:
+		mr.corrected(MissingTrailer)
+		return mr.r.UnreadByte()
+	}
+	return nil
+}
+
+// truncated replaces the end of the stream within a frame by
+// ErrTruncatedFrame.
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncatedFrame
+	}
+	return err
+}
+
+// skipToStart consumes the stream up to the next start block and returns the
+// number of bytes skipped before it. The start block itself is only consumed
+// if no bytes were skipped. With lenient trailers, CR and LF between frames
+// are skipped without being counted.
+func (mr *MessageReader) skipToStart() (int, error) {
+	dropped := 0
+	for {
+		chunk, err := mr.r.ReadSlice(mr.startBlock)
+		if err == bufio.ErrBufferFull {
+			dropped += mr.junk(chunk)
+			continue
+		}
+		if err == io.EOF && dropped+mr.junk(chunk) > 0 {
+			return dropped + mr.junk(chunk), nil
+		}
+		if err != nil {
+			return dropped, err
+		}
+		dropped += mr.junk(chunk[:len(chunk)-1])
+		if dropped > 0 {
+			// Leave the start block for the following call.
+			return dropped, mr.r.UnreadByte()
+		}
+		return 0, nil
+	}
+}
+
+// junk returns the number of bytes in b that are not allowed between frames.
+func (mr *MessageReader) junk(b []byte) int {
+	if !mr.lenient.AlternateTrailers {
+		return len(b)
+	}
+	n := 0
+	for _, c := range b {
+		if c != cr && c != '\n' {
+			n++
+		}
+	}
+	return n
+}
+
+// framePool holds buffers for assembling frames that span several reads.
+var framePool = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// readFrame reads up to and including the next end block and returns the
+// bytes before it. Only the first maxFrameSize bytes are kept, and tooLarge
+// reports whether any were dropped. The frame is assembled in a pooled buffer
+// if needed, so that only the returned message is allocated.
+func (mr *MessageReader) readFrame() (frame []byte, tooLarge bool, err error) {
+	var scratch *[]byte
+	defer func() {
+		if scratch != nil && cap(*scratch) <= maxPooledBuffer {
+			framePool.Put(scratch)
+		}
+	}()
+	var buf []byte
+	for {
+		chunk, err := mr.r.ReadSlice(mr.endBlock)
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, false, err
+		}
+		complete := err == nil
+		if complete {
+			chunk = chunk[:len(chunk)-1]
+		}
+		if !tooLarge {
+			if complete && scratch == nil {
+				// The whole frame is in the read buffer.
+				buf = chunk
+			} else {
+				if scratch == nil {
+					scratch = framePool.Get().(*[]byte)
+					*scratch = (*scratch)[:0]
+				}
+				*scratch = append(*scratch, chunk...)
+				buf = *scratch
+			}
+			if mr.maxFrameSize > 0 && len(buf) > mr.maxFrameSize {
+				buf = buf[:mr.maxFrameSize]
+				tooLarge = true
+			}
+		}
+		if complete {
+			frame = make([]byte, len(buf))
+			copy(frame, buf)
+			return frame, tooLarge, nil
 		}
-		return nil, fmt.Errorf("message ends with %c, want %c", lastByte, cr)
 	}
-	return rawMsg[:len(rawMsg)-1], nil
+}
+
+// NextCommit reads an MLLP Release 2 commit acknowledgement. Returns nil for
+// a commit ACK, ErrCommitNAK for a commit NAK, and an error if the next frame
+// is not a commit acknowledgement. Errors from Next are returned unchanged.
+func (mr *MessageReader) NextCommit() error {
+	msg, err := mr.Next()
+	if err != nil {
+		return err
+	}
+	if !IsCommit(msg) {
+		return fmt.Errorf("expected commit acknowledgement, got %d byte message", len(msg))
+	}
+	if msg[0] == commitNAK {
+		return ErrCommitNAK
+	}
+	return nil
 }
 
 // ReadMsg from reader and removes the start block, end block, and carriage return bytes.
 // The reader must return a single message, any trailing bytes may be consumed.
+// Bytes before the start block are ignored.
 func ReadMsg(r io.Reader) ([]byte, error) {
-	return NewMessageReader(r).Next()
+	mr := NewMessageReader(r)
+	for {
+		msg, err := mr.Next()
+		if _, ok := err.(*DroppedBytesError); !ok {
+			return msg, err
+		}
+	}
 }
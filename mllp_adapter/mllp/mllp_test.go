@@ -15,8 +15,14 @@
 package mllp
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestOK(t *testing.T) {
@@ -89,6 +95,27 @@ func TestRead_MultipleMessages(t *testing.T) {
 	}
 }
 
+func TestStarted(t *testing.T) {
+	data := []byte("junk\x0bmsg1\x1c\x0d\x0bmsg2\x1c\x0d")
+	started := 0
+	reader := NewMessageReaderWithOption(bytes.NewReader(data), ReaderOption{Started: func() { started++ }})
+	// Bytes before the start block do not start a frame.
+	if _, err := reader.Next(); err == nil || started != 0 {
+		t.Fatalf("Next() of junk = %v with %d frames started, want an error and none", err, started)
+	}
+	for i := 1; i <= 2; i++ {
+		if _, err := reader.Next(); err != nil {
+			t.Fatalf("Next(): %v", err)
+		}
+		if started != i {
+			t.Errorf("Started called %d times after %d messages", started, i)
+		}
+	}
+	if _, err := reader.Next(); err == nil || started != 2 {
+		t.Errorf("Next() at the end = %v with %d frames started, want an error and 2", err, started)
+	}
+}
+
 func TestError(t *testing.T) {
 	testCases := []struct {
 		name string
@@ -109,3 +136,447 @@ func TestError(t *testing.T) {
 		})
 	}
 }
+
+func TestMaxFrameSize(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 10000)
+	data := bytes.Join([][]byte{
+		// Garbage before the start block longer than the read buffer.
+		bytes.Repeat([]byte("-"), 5000),
+		[]byte{startBlock}, large, []byte{endBlock, cr},
+		[]byte{startBlock}, []byte("msg"), []byte{endBlock, cr},
+	}, nil)
+	reader := NewMessageReaderWithOption(bytes.NewReader(data), ReaderOption{MaxFrameSize: 100})
+
+	if _, err := reader.Next(); err == nil {
+		t.Errorf("Next() succeeded, want a DroppedBytesError")
+	}
+	msg, err := reader.Next()
+	if err != ErrFrameTooLarge {
+		t.Errorf("Next() returned %v, want %v", err, ErrFrameTooLarge)
+	}
+	if !bytes.Equal(msg, large[:100]) {
+		t.Errorf("Next() returned %d bytes, want the first 100 bytes of the message", len(msg))
+	}
+	msg, err = reader.Next()
+	if err != nil || string(msg) != "msg" {
+		t.Errorf("Next() after an oversized message = %q, %v, want \"msg\", nil", msg, err)
+	}
+
+	// A message of exactly the maximum size is accepted.
+	data = bytes.Join([][]byte{[]byte{startBlock}, large[:100], []byte{endBlock, cr}}, nil)
+	reader = NewMessageReaderWithOption(bytes.NewReader(data), ReaderOption{MaxFrameSize: 100})
+	if msg, err := reader.Next(); err != nil || len(msg) != 100 {
+		t.Errorf("Next() = %d bytes, %v, want 100 bytes, nil", len(msg), err)
+	}
+}
+
+func TestFrameTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	reader := NewMessageReaderWithOption(server, ReaderOption{FrameTimeout: 50 * time.Millisecond})
+
+	go func() {
+		// Waiting for the start block is not limited by the frame timeout.
+		time.Sleep(100 * time.Millisecond)
+		WriteMsg(client, []byte("msg"))
+		// Start a message but never finish it.
+		client.Write([]byte{startBlock, 'x'})
+	}()
+	if msg, err := reader.Next(); err != nil || string(msg) != "msg" {
+		t.Fatalf("Next() = %q, %v, want \"msg\", nil", msg, err)
+	}
+	_, err := reader.Next()
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("Next() of an unfinished message returned %v, want a timeout", err)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	data := bytes.Join([][]byte{
+		[]byte("junk"),
+		[]byte{startBlock}, []byte("msg1"), []byte{endBlock, 'x'},
+		[]byte{startBlock}, []byte("msg2"), []byte{endBlock, cr},
+		[]byte{startBlock}, []byte("msg3"),
+	}, nil)
+	reader := NewMessageReader(bytes.NewReader(data))
+
+	_, err := reader.Next()
+	if dropped, ok := err.(*DroppedBytesError); !ok || dropped.Count != 4 {
+		t.Errorf("Next() returned %v, want a DroppedBytesError for 4 bytes", err)
+	}
+	msg, err := reader.Next()
+	if trailer, ok := err.(*TrailerError); !ok || trailer.Got != 'x' || string(msg) != "msg1" {
+		t.Errorf("Next() = %q, %v, want \"msg1\" and a TrailerError for 'x'", msg, err)
+	}
+	// The reader resyncs on the next start block, dropping the bad trailer.
+	if _, err := reader.Next(); err == nil {
+		t.Errorf("Next() succeeded, want a DroppedBytesError for the bad trailer")
+	}
+	if msg, err := reader.Next(); err != nil || string(msg) != "msg2" {
+		t.Errorf("Next() = %q, %v, want \"msg2\", nil", msg, err)
+	}
+	if _, err := reader.Next(); err != ErrTruncatedFrame {
+		t.Errorf("Next() returned %v, want %v", err, ErrTruncatedFrame)
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Next() at the end returned %v, want %v", err, io.EOF)
+	}
+}
+
+func TestReadMsg_DroppedBytes(t *testing.T) {
+	msg, err := ReadMsg(bytes.NewReader([]byte("junk\x0bmsg\x1c\x0d")))
+	if err != nil || string(msg) != "msg" {
+		t.Errorf("ReadMsg() = %q, %v, want \"msg\", nil", msg, err)
+	}
+}
+
+func TestLenient(t *testing.T) {
+	testCases := []struct {
+		name    string
+		lenient Leniency
+		data    string
+		want    []string
+		// corrections are the corrections reported while reading data.
+		corrections []Correction
+	}{
+		{
+			name:        "LF trailer",
+			lenient:     Leniency{AlternateTrailers: true},
+			data:        "\x0bmsg1\x1c\n\x0bmsg2\x1c\r",
+			want:        []string{"msg1", "msg2"},
+			corrections: []Correction{LFTrailer},
+		},
+		{
+			name:        "CRLF trailer",
+			lenient:     Leniency{AlternateTrailers: true},
+			data:        "\x0bmsg1\x1c\r\n\x0bmsg2\x1c\r",
+			want:        []string{"msg1", "msg2"},
+			corrections: nil,
+		},
+		{
+			name:        "missing trailer",
+			lenient:     Leniency{AlternateTrailers: true},
+			data:        "\x0bmsg1\x1c\x0bmsg2\x1c",
+			want:        []string{"msg1", "msg2"},
+			corrections: []Correction{MissingTrailer},
+		},
+		{
+			name:    "custom blocks",
+			lenient: Leniency{StartBlock: 0x02, EndBlock: 0x03},
+			data:    "\x02msg1\x03\r\x02msg2\x03\r",
+			want:    []string{"msg1", "msg2"},
+		},
+		{
+			name:        "segment terminators",
+			lenient:     Leniency{NormalizeSegments: true},
+			data:        "\x0bMSH|1\r\nPID|2\nPV1|3\r\x1c\r\x0bMSH|1\rPID|2\x1c\r",
+			want:        []string{"MSH|1\rPID|2\rPV1|3\r", "MSH|1\rPID|2"},
+			corrections: []Correction{SegmentTerminators},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var corrections []Correction
+			reader := NewMessageReaderWithOption(bytes.NewReader([]byte(tc.data)), ReaderOption{
+				Lenient:   tc.lenient,
+				Corrected: func(c Correction) { corrections = append(corrections, c) },
+			})
+			for _, want := range tc.want {
+				msg, err := reader.Next()
+				if err != nil || string(msg) != want {
+					t.Errorf("Next() = %q, %v, want %q, nil", msg, err, want)
+				}
+			}
+			if _, err := reader.Next(); err != io.EOF {
+				t.Errorf("Next() at the end returned %v, want %v", err, io.EOF)
+			}
+			if !reflect.DeepEqual(corrections, tc.corrections) {
+				t.Errorf("Got corrections %v, want %v", corrections, tc.corrections)
+			}
+		})
+	}
+}
+
+func TestLenient_TrailerNotYetSent(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	var corrections []Correction
+	reader := NewMessageReaderWithOption(server, ReaderOption{
+		Lenient:   Leniency{AlternateTrailers: true},
+		Corrected: func(c Correction) { corrections = append(corrections, c) },
+	})
+	go func() {
+		// The partner waits for the ACK before sending anything else.
+		client.Write([]byte("\x0bmsg\x1c"))
+		client.Write([]byte("\x0bmsg2\x1c\r"))
+		client.Close()
+	}()
+	for _, want := range []string{"msg", "msg2"} {
+		if msg, err := reader.Next(); err != nil || string(msg) != want {
+			t.Fatalf("Next() = %q, %v, want %q, nil", msg, err, want)
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Next() at the end returned %v, want %v", err, io.EOF)
+	}
+	if want := []Correction{MissingTrailer}; !reflect.DeepEqual(corrections, want) {
+		t.Errorf("Got corrections %v, want %v", corrections, want)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	testCases := []struct {
+		name    string
+		write   func(w io.Writer) error
+		wantErr error
+	}{
+		{"ACK", WriteCommitACK, nil},
+		{"NAK", WriteCommitNAK, ErrCommitNAK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			enc := &bytes.Buffer{}
+			if err := tc.write(enc); err != nil {
+				t.Fatalf("Unexpected error writing commit: %v", err)
+			}
+			if !IsCommit(enc.Bytes()[1 : enc.Len()-2]) {
+				t.Errorf("IsCommit(%v) = false, want true", enc.Bytes())
+			}
+			if err := NewMessageReader(enc).NextCommit(); err != tc.wantErr {
+				t.Errorf("NextCommit() returned %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestNextCommit_NotACommit(t *testing.T) {
+	enc := &bytes.Buffer{}
+	if err := WriteMsg(enc, []byte("MSH|^~\\&|")); err != nil {
+		t.Fatalf("Unexpected error writing message: %v", err)
+	}
+	if err := NewMessageReader(enc).NextCommit(); err == nil {
+		t.Errorf("NextCommit() expected error for HL7 message")
+	}
+}
+
+func TestParseRelease(t *testing.T) {
+	for _, r := range []int{1, 2} {
+		if got, err := ParseRelease(r); err != nil || int(got) != r {
+			t.Errorf("ParseRelease(%d) = %v, %v, want %d, nil", r, got, err, r)
+		}
+	}
+	for _, r := range []int{0, 3} {
+		if _, err := ParseRelease(r); err == nil {
+			t.Errorf("ParseRelease(%d) expected error", r)
+		}
+	}
+}
+
+// countingWriter records the number of Write calls.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestMessageWriter(t *testing.T) {
+	w := &countingWriter{}
+	mw := NewMessageWriter(w)
+	for _, msg := range []string{"first", "second message", ""} {
+		if err := mw.WriteMsg([]byte(msg)); err != nil {
+			t.Fatalf("WriteMsg: %v", err)
+		}
+	}
+	if err := mw.WriteCommitACK(); err != nil {
+		t.Fatalf("WriteCommitACK: %v", err)
+	}
+	if err := WriteMsg(w, []byte("last")); err != nil {
+		t.Fatalf("WriteMsg: %v", err)
+	}
+	if w.writes != 5 {
+		t.Errorf("got %d writes, want one per message", w.writes)
+	}
+	want := "\x0bfirst\x1c\r\x0bsecond message\x1c\r\x0b\x1c\r\x0b\x06\x1c\r\x0blast\x1c\r"
+	if got := w.String(); got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
+
+func TestMessageWriterCustomBlocks(t *testing.T) {
+	var buf bytes.Buffer
+	mw := NewMessageWriterWithOption(&buf, WriterOption{StartBlock: 0x02, EndBlock: 0x03})
+	if err := mw.WriteMsg([]byte("msg1")); err != nil {
+		t.Fatalf("WriteMsg: %v", err)
+	}
+	if err := mw.WriteCommitACK(); err != nil {
+		t.Fatalf("WriteCommitACK: %v", err)
+	}
+	if want := "\x02msg1\x03\r\x02\x06\x03\r"; buf.String() != want {
+		t.Errorf("wrote %q, want %q", buf.String(), want)
+	}
+	reader := NewMessageReaderWithOption(&buf, ReaderOption{Lenient: Leniency{StartBlock: 0x02, EndBlock: 0x03}})
+	if msg, err := reader.Next(); err != nil || string(msg) != "msg1" {
+		t.Errorf("Next() = %q, %v, want %q, nil", msg, err, "msg1")
+	}
+	if err := reader.NextCommit(); err != nil {
+		t.Errorf("NextCommit() = %v, want nil", err)
+	}
+}
+
+func TestRead_LargeMessages(t *testing.T) {
+	// Frames larger than the read buffer are assembled across reads.
+	var in bytes.Buffer
+	var msgs [][]byte
+	for _, size := range []int{100 << 10, 10, 300 << 10} {
+		msg := bytes.Repeat([]byte{'a' + byte(len(msgs))}, size)
+		msgs = append(msgs, msg)
+		if err := WriteMsg(&in, msg); err != nil {
+			t.Fatalf("WriteMsg: %v", err)
+		}
+	}
+	r := NewMessageReader(&in)
+	var got [][]byte
+	for range msgs {
+		msg, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		got = append(got, msg)
+	}
+	for i := range msgs {
+		if !bytes.Equal(got[i], msgs[i]) {
+			t.Errorf("message %d has %d bytes, want %d bytes of %q", i, len(got[i]), len(msgs[i]), msgs[i][0])
+		}
+	}
+}
+
+// writeMsgUnbuffered frames msg with three writes, as WriteMsg used to.
+func writeMsgUnbuffered(w io.Writer, msg []byte) error {
+	if _, err := w.Write([]byte{startBlock}); err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte{endBlock, cr})
+	return err
+}
+
+// loopback returns the client side of a TCP connection whose server side
+// discards everything it reads.
+func loopback(b *testing.B) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatalf("Dial: %v", err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		b.Fatalf("Accept: %v", err)
+	}
+	go func() {
+		io.Copy(io.Discard, server)
+		server.Close()
+	}()
+	b.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func BenchmarkWrite(b *testing.B) {
+	msg := bytes.Repeat([]byte("OBX|1|TX|||text\r"), 64)
+	for _, bc := range []struct {
+		name  string
+		write func(net.Conn) func([]byte) error
+	}{
+		{"ThreeWrites", func(c net.Conn) func([]byte) error {
+			return func(m []byte) error { return writeMsgUnbuffered(c, m) }
+		}},
+		{"WriteMsg", func(c net.Conn) func([]byte) error {
+			return func(m []byte) error { return WriteMsg(c, m) }
+		}},
+		{"MessageWriter", func(c net.Conn) func([]byte) error {
+			return NewMessageWriter(c).WriteMsg
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			write := bc.write(loopback(b))
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := write(msg); err != nil {
+					b.Fatalf("write: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// readMsgAppending reads the next frame by appending each chunk of it to a
+// new slice, as MessageReader used to.
+func readMsgAppending(r *bufio.Reader) ([]byte, error) {
+	if _, err := r.ReadByte(); err != nil {
+		return nil, err
+	}
+	var msg []byte
+	for {
+		chunk, err := r.ReadSlice(endBlock)
+		if err == nil {
+			msg = append(msg, chunk[:len(chunk)-1]...)
+			_, err = r.ReadByte()
+			return msg, err
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		msg = append(msg, chunk...)
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10} {
+		var frames bytes.Buffer
+		for i := 0; i < 64; i++ {
+			WriteMsg(&frames, bytes.Repeat([]byte{'x'}, size))
+		}
+		for _, bc := range []struct {
+			name string
+			read func(io.Reader) func() ([]byte, error)
+		}{
+			{"Append", func(in io.Reader) func() ([]byte, error) {
+				r := bufio.NewReader(in)
+				return func() ([]byte, error) { return readMsgAppending(r) }
+			}},
+			{"MessageReader", func(in io.Reader) func() ([]byte, error) {
+				return NewMessageReader(in).Next
+			}},
+		} {
+			b.Run(fmt.Sprintf("%v/%dKB", bc.name, size>>10), func(b *testing.B) {
+				in := bytes.NewReader(frames.Bytes())
+				next := bc.read(in)
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := next(); err == io.EOF {
+						in.Reset(frames.Bytes())
+						next = bc.read(in)
+						i--
+					} else if err != nil {
+						b.Fatalf("read: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
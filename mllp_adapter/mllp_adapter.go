@@ -19,24 +19,40 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"flag"
 	
 	log "github.com/golang/glog"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/dedup"
 	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/handler"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/health"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/hl7ack"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/listener"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/mllp"
 	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/mllpreceiver"
 	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/mllpsender"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/queue"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/router"
 	"github.com/GoogleCloudPlatform/mllp/shared/healthapiclient"
 	"github.com/GoogleCloudPlatform/mllp/shared/monitoring"
 	"github.com/GoogleCloudPlatform/mllp/shared/pubsub"
+	"github.com/GoogleCloudPlatform/mllp/shared/tlsconfig"
+	"github.com/GoogleCloudPlatform/mllp/shared/tracing"
 )
 
 var (
 	// 2575 is the default port for HL7 over TCP
 	// https://www.iana.org/assignments/service-names-port-numbers/service-names-port-numbers.xhtml?search=2575
 	port                    = flag.Int("port", 2575, "Port on which to listen for incoming MLLP connections")
-	apiAddrPrefix           = flag.String("api_addr_prefix", "", "[Deprecated] Prefix of the Cloud Healthcare API, including scheme and version")
+	apiAddrPrefix           = flag.String("api_addr_prefix", "", "[Optional] Address of the Cloud Healthcare API including scheme, e.g. a regional or Private Service Connect endpoint like https://healthcare.example.p.googleapis.com, or a local emulator. A trailing /v1 is accepted. Defaults to https://healthcare.googleapis.com.")
+	apiInsecure             = flag.Bool("api_insecure", false, "[Optional] Whether to call the Cloud Healthcare API without credentials, which also allows a plain http --api_addr_prefix. Only for local fakes and emulators.")
 	mllpAddr                = flag.String("mllp_addr", "", "Target address for outgoing MLLP connections")
 	receiverIP              = flag.String("receiver_ip", "", "IP address for incoming MLLP connections")
 	pubsubProjectID         = flag.String("pubsub_project_id", "", "Project ID that owns the pubsub topic")
@@ -51,9 +67,52 @@ var (
 	fallbackEncoding        = flag.String("fallback_encoding", "", "[Optional] Whether to use a given encoding as a fallback when data cannot be parsed as UTF-8. By default, UTF-8 is used with no fallback.")
 	logErrorMsg             = flag.Bool("log_error_msg", false, "[Optional] Whether to log the error message when NACK is received from the API. These error logs will contain sensitive data.")
 	exportStats             = flag.Bool("export_stats", true, "[Optional] Whether to export stackdriver stats")
+	healthAddr              = flag.String("health_addr", "", "[Optional] Address, e.g. \":8080\", on which /healthz, /readyz and /statusz are served. May be the same as --prometheus_addr.")
+	prometheusAddr          = flag.String("prometheus_addr", "", "[Optional] Address, e.g. \":9090\", on which metrics are served at /metrics in Prometheus format. Can be combined with --export_stats, or used instead of it with --export_stats=false outside of Google Cloud.")
+	otlpEndpoint            = flag.String("otlp_endpoint", "", "[Optional] Address, e.g. \"localhost:4318\", of an OTLP/HTTP collector to which traces of the stages each message goes through are exported. Tracing is disabled if empty.")
+	otlpInsecure            = flag.Bool("otlp_insecure", false, "[Optional] Whether to export traces to --otlp_endpoint over plain HTTP instead of HTTPS.")
+	traceSampleRatio        = flag.Float64("trace_sample_ratio", 1, "[Optional] Fraction (greater than 0, up to 1) of messages that are traced when --otlp_endpoint is set.")
 	credentials             = flag.String("credentials", "", "[Optional] Path to the credentials file (in JSON format). The default service account will be used if not provided.")
 	checkPublishAttribute   = flag.Bool("legacy_publish_attribute", false,
 		"[Optional] Whether to check for the publish attribute when reading pubsub subscriptions. This attribute appears only in the notifications from messages.create method, and will be removed in a future release.")
+	receiverMLLPRelease     = flag.Int("receiver_mllp_release", 1, "[Optional] MLLP release (1 or 2) spoken by partners connecting to the receiver. Release 2 answers each message with a commit ACK/NAK.")
+	senderMLLPRelease       = flag.Int("sender_mllp_release", 1, "[Optional] MLLP release (1 or 2) spoken by the partner at mllp_addr.")
+	senderCommitTimeout     = flag.Duration("sender_commit_timeout", 30*time.Second, "[Optional] How long to wait for an MLLP Release 2 commit acknowledgement from mllp_addr before retransmitting.")
+	senderMaxRetransmits    = flag.Int("sender_max_retransmits", 3, "[Optional] Number of times a message is resent to mllp_addr after an MLLP Release 2 commit NAK or commit timeout.")
+	receiverTLSCert         = flag.String("receiver_tls_cert", "", "[Optional] Path to the PEM certificate chain presented to partners. Enables TLS on the receiver together with --receiver_tls_key. The file is reloaded when it changes.")
+	receiverTLSKey          = flag.String("receiver_tls_key", "", "[Optional] Path to the PEM private key for --receiver_tls_cert. The file is reloaded when it changes.")
+	receiverTLSClientCA     = flag.String("receiver_tls_client_ca", "", "[Optional] Path to a PEM CA bundle. If set, partners must present a client certificate signed by one of these CAs (mutual TLS).")
+	receiverTLSMinVersion   = flag.String("receiver_tls_min_version", "1.2", "[Optional] Minimum TLS version accepted by the receiver: 1.0, 1.1, 1.2 or 1.3.")
+	senderPoolSize          = flag.Int("sender_pool_size", 0, "[Optional] Number of long-lived connections kept open to mllp_addr. Each connection carries one message at a time. If 0, a new connection is opened for every message.")
+	senderACKTimeout        = flag.Duration("sender_ack_timeout", 0, "[Optional] How long to wait for the ACK from mllp_addr before treating the connection as broken, e.g. 1m. 0 waits forever.")
+	senderTLS               = flag.Bool("sender_tls", false, "[Optional] Whether to use TLS for outgoing connections to mllp_addr.")
+	senderTLSCert           = flag.String("sender_tls_cert", "", "[Optional] Path to a PEM client certificate chain presented to mllp_addr, for partners that require mutual TLS. The file is reloaded when it changes.")
+	senderTLSKey            = flag.String("sender_tls_key", "", "[Optional] Path to the PEM private key for --sender_tls_cert.")
+	senderTLSCA             = flag.String("sender_tls_ca", "", "[Optional] Path to a PEM CA bundle used to verify the certificate of mllp_addr. The system roots are used if empty.")
+	senderTLSServerName     = flag.String("sender_tls_server_name", "", "[Optional] Name used for SNI and to verify the certificate of mllp_addr. Defaults to the host in --mllp_addr.")
+	senderTLSPinnedCerts    = flag.String("sender_tls_pinned_certs", "", "[Optional] Comma separated SHA-256 fingerprints (hex) of the certificates mllp_addr may present.")
+	receiverTLSCipherSuites = flag.String("receiver_tls_cipher_suites", "", "[Optional] Comma separated list of TLS 1.0-1.2 cipher suites accepted by the receiver, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Go's defaults are used if empty.")
+	receiverQueueDir        = flag.String("receiver_queue_dir", "", "[Optional] Directory of a durable queue for inbound messages. If set, messages are written to disk and ACKed locally, then forwarded to the HL7v2 store in the background with retries. Use a persistent volume so queued messages survive restarts.")
+	receiverQueueAttempts   = flag.Int("receiver_queue_max_attempts", 0, "[Optional] Number of times a queued message is sent to the HL7v2 store before it is moved to the failed subdirectory of --receiver_queue_dir. If 0, messages are retried until they succeed.")
+	apiMaxAttempts          = flag.Int("api_max_attempts", 1, "[Optional] Number of attempts made for a Cloud Healthcare API call that fails with a transient error (HTTP 408, 429, 5xx or a network error). 1 disables retries. Ingesting a message is not idempotent: a retry after a failure whose response was lost can store the message twice.")
+	apiBaseBackoff          = flag.Duration("api_base_backoff", 500*time.Millisecond, "[Optional] Wait before the first retry of a Cloud Healthcare API call, doubled for every following retry.")
+	apiMaxBackoff           = flag.Duration("api_max_backoff", 10*time.Second, "[Optional] Maximum wait between retries of a Cloud Healthcare API call.")
+	apiBackoffJitter        = flag.Float64("api_backoff_jitter", 0.2, "[Optional] Fraction (0 to 1) of each retry backoff that is randomized.")
+	apiRetryDeadline        = flag.Duration("api_retry_deadline", 0, "[Optional] Overall time limit for a Cloud Healthcare API call including its retries. 0 means no limit.")
+	apiAttemptTimeout       = flag.Duration("api_attempt_timeout", 0, "[Optional] Time limit for a single attempt of a Cloud Healthcare API call. An attempt that exceeds it is retried while --api_retry_deadline allows. 0 means no limit.")
+	receiverLocalNACK       = flag.String("receiver_local_nack", "", "[Optional] Comma separated class=code pairs selecting the locally generated NACK (AE or AR) returned when a message cannot be stored and the API returned no NACK. Classes are unauthorized, quota, unavailable, invalid and other, e.g. \"quota=AE,unavailable=AE,invalid=AR\". For classes not listed the connection is closed without a reply.")
+	routesFile              = flag.String("routes_file", "", "[Optional] Path to a JSON routing table that sends inbound messages to different HL7v2 stores based on their MSH segment. Unmatched messages go to the store given by the --hl7_v2_* flags unless the table says otherwise.")
+	receiverMaxMessageSize  = flag.Int("receiver_max_message_size", 0, "[Optional] Maximum size in bytes of an inbound message. Longer messages are answered with an AR NACK and not stored. If 0, messages of any size are accepted.")
+	receiverReadTimeout     = flag.Duration("receiver_read_timeout", 0, "[Optional] How long a partner may take to send a message once it has started. The connection is closed when it is exceeded. 0 means no limit.")
+	receiverIdleTimeout     = flag.Duration("receiver_idle_timeout", 0, "[Optional] How long a partner connection may stay open without sending a message before it is closed. 0 means no limit.")
+	receiverStartBlock      = flag.Int("receiver_start_block", 0, "[Optional] Byte that starts MLLP frames from and to partners, e.g. 0x02, for partners that do not use the standard 0x0B.")
+	receiverEndBlock        = flag.Int("receiver_end_block", 0, "[Optional] Byte that ends MLLP frames from and to partners, e.g. 0x03, for partners that do not use the standard 0x1C.")
+	alternateTrailers       = flag.Bool("receiver_alternate_trailers", false, "[Optional] Whether to accept frames from partners whose end block is followed by LF instead of CR, or by nothing.")
+	normalizeSegments       = flag.Bool("receiver_normalize_segments", false, "[Optional] Whether to replace LF and CRLF segment terminators in messages from partners by CR before they are stored.")
+	receiverDedupWindow     = flag.Duration("receiver_dedup_window", 0, "[Optional] How long the sending facility (MSH-4) and control ID (MSH-10) of ingested messages are remembered. A message seen again within this window is answered with the original ACK instead of being stored again. 0 disables duplicate suppression.")
+	receiverDedupDir        = flag.String("receiver_dedup_dir", "", "[Optional] Directory in which the messages remembered for --receiver_dedup_window are recorded, so that duplicates are still recognized after a restart.")
+	listenersFile           = flag.String("listeners_file", "", "[Optional] Path to a JSON list of additional MLLP listeners, each with its own address, TLS settings, HL7v2 store and logging options. Their metrics carry the listener name in a listener label.")
+	shutdownTimeout         = flag.Duration("shutdown_timeout", 25*time.Second, "[Optional] How long open MLLP connections are given to finish their current message after SIGTERM or SIGINT before they are closed.")
 )
 
 func main() {
@@ -68,59 +127,424 @@ func main() {
 func run() error {
 	ctx := context.Background()
 
-	var mon *monitoring.ExportingClient
+	var clients []monitoring.Client
 	if *exportStats {
-		mon = monitoring.NewExportingClient()
-		if err := mon.StartExport(ctx, *credentials); err != nil {
+		exporter := monitoring.NewExportingClient()
+		if err := exporter.StartExport(ctx, *credentials); err != nil {
 			return fmt.Errorf("failed to configure monitoring: %v", err)
 		}
 
-		defer mon.EndExport(ctx)
+		defer exporter.EndExport(ctx)
+		clients = append(clients, exporter)
+	}
+	var prom *monitoring.PrometheusClient
+	if *prometheusAddr != "" {
+		prom = monitoring.NewPrometheusClient()
+		clients = append(clients, prom)
+	}
+	mon := monitoring.Multi(clients...)
+	checker := health.New()
+
+	if *otlpEndpoint != "" {
+		if *traceSampleRatio <= 0 || *traceSampleRatio > 1 {
+			return fmt.Errorf("invalid --trace_sample_ratio %v, must be greater than 0 and at most 1", *traceSampleRatio)
+		}
+		stopTracing, err := tracing.Start(ctx, tracing.Option{
+			Endpoint:    *otlpEndpoint,
+			Insecure:    *otlpInsecure,
+			SampleRatio: *traceSampleRatio,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to configure tracing: %v", err)
+		}
+		defer func() {
+			// Flush the spans of the last messages.
+			flushCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			if err := stopTracing(flushCtx); err != nil {
+				log.Warningf("MLLP Adapter: failed to flush traces: %v", err)
+			}
+		}()
 	}
 
 	if *apiAddrPrefix != "" {
-		log.Warningf("Flag --api_addr_prefix deprecated, API calls will be made to healthcare.googleapis.com/v1.")
+		if _, err := healthapiclient.ParseEndpoint(*apiAddrPrefix, *apiInsecure); err != nil {
+			return fmt.Errorf("invalid --api_addr_prefix: %v", err)
+		}
+	} else if *apiInsecure {
+		return fmt.Errorf("--api_insecure requires --api_addr_prefix")
 	}
-	si := healthapiclient.StoreInfo{*hl7V2ProjectID, *hl7V2LocationID, *hl7V2DatasetID, *hl7V2StoreID}
-	opt := healthapiclient.Option{
+	def := listener.Listener{
+		Name:        listener.DefaultName,
+		ReceiverIP:  *receiverIP,
+		Port:        *port,
+		MLLPRelease: *receiverMLLPRelease,
+		TLS: listener.TLS{
+			Cert:       *receiverTLSCert,
+			Key:        *receiverTLSKey,
+			ClientCA:   *receiverTLSClientCA,
+			MinVersion: *receiverTLSMinVersion,
+		},
+		Store: router.Store{
+			ProjectID:    *hl7V2ProjectID,
+			LocationID:   *hl7V2LocationID,
+			DatasetID:    *hl7V2DatasetID,
+			HL7V2StoreID: *hl7V2StoreID,
+		},
+		LogACK:                  *logACK,
 		LogNACKedMessage:        *logNACKedMsg,
 		LogErrorMessage:         *logErrorMsg,
-		LogACK:                  *logACK,
 		LogInputMessageInBase64: *logInputMessageInBase64,
 		FallbackEncoding:        *fallbackEncoding,
+		MaxMessageSize:          *receiverMaxMessageSize,
+		ReadTimeout:             listener.Duration(*receiverReadTimeout),
+		IdleTimeout:             listener.Duration(*receiverIdleTimeout),
+		StartBlock:              *receiverStartBlock,
+		EndBlock:                *receiverEndBlock,
+		AlternateTrailers:       *alternateTrailers,
+		NormalizeSegments:       *normalizeSegments,
+		LocalNACK:               *receiverLocalNACK,
+		QueueDir:                *receiverQueueDir,
+		QueueMaxAttempts:        *receiverQueueAttempts,
+		RoutesFile:              *routesFile,
+		DedupWindow:             listener.Duration(*receiverDedupWindow),
+		DedupDir:                *receiverDedupDir,
 	}
-	apiClient, err := healthapiclient.NewHL7V2Client(ctx, *credentials, mon, si, opt)
-	if err != nil {
-		return fmt.Errorf("failed to connect to HL7v2 API: %v", err)
+	if *receiverTLSCipherSuites != "" {
+		def.TLS.CipherSuites = strings.Split(*receiverTLSCipherSuites, ",")
+	}
+	var listeners []listener.Listener
+	if *receiverIP != "" {
+		listeners = append(listeners, def)
+	}
+	if *listenersFile != "" {
+		cfg, err := listener.LoadConfig(*listenersFile)
+		if err != nil {
+			return fmt.Errorf("failed to load --listeners_file: %v", err)
+		}
+		listeners = append(listeners, cfg.Listeners...)
+	}
+	if len(listeners) == 0 {
+		return fmt.Errorf("required flag value --receiver_ip or --listeners_file not provided")
+	}
+	if err := listener.Check(listeners); err != nil {
+		return fmt.Errorf("invalid listener configuration: %v", err)
 	}
 
-	if *pubsubProjectID == "" || *pubsubSubscription == "" {
+	// The store given by the --hl7_v2_* flags is only needed by the default
+	// listener and the PubSub listener.
+	pubsubEnabled := *pubsubProjectID != "" && *pubsubSubscription != ""
+	var apiClient *healthapiclient.HL7V2Client
+	if *receiverIP != "" || pubsubEnabled {
+		var err error
+		apiClient, err = healthapiclient.NewHL7V2Client(ctx, *credentials, mon, storeInfo(def.Store), apiOption(def))
+		if err != nil {
+			return fmt.Errorf("failed to connect to HL7v2 API: %v", err)
+		}
+		checker.Add("hl7v2-api", apiClient.Health)
+	}
+
+	// errs receives the error of a receiver, the pubsub listener or an HTTP
+	// server if any stops on its own.
+	errs := make(chan error, len(listeners)+3)
+	listenCtx, stopListening := context.WithCancel(ctx)
+	defer stopListening()
+	var listenDone chan struct{}
+	var sender *mllpsender.MLLPSender
+
+	if !pubsubEnabled {
 		log.Infof("Either --pubsub_project_id or --pubsub_subscription is not provided, notifications of the new messages are not read and no outgoing messages will be sent to the target MLLP address.")
 	} else {
-		sender := mllpsender.NewSender(*mllpAddr, mon)
+		release, err := mllp.ParseRelease(*senderMLLPRelease)
+		if err != nil {
+			return fmt.Errorf("invalid --sender_mllp_release: %v", err)
+		}
+		senderOpt := mllpsender.Option{
+			Release:        release,
+			CommitTimeout:  *senderCommitTimeout,
+			MaxRetransmits: *senderMaxRetransmits,
+			PoolSize:       *senderPoolSize,
+			ACKTimeout:     *senderACKTimeout,
+		}
+		if *senderTLS {
+			tlsOpt := tlsconfig.ClientOption{
+				CertFile:   *senderTLSCert,
+				KeyFile:    *senderTLSKey,
+				CAFile:     *senderTLSCA,
+				ServerName: *senderTLSServerName,
+			}
+			if *senderTLSPinnedCerts != "" {
+				tlsOpt.PinnedCerts = strings.Split(*senderTLSPinnedCerts, ",")
+			}
+			if senderOpt.TLS, err = tlsconfig.Client(tlsOpt); err != nil {
+				return fmt.Errorf("failed to configure sender TLS: %v", err)
+			}
+		}
+		sender = mllpsender.NewSender(*mllpAddr, mon, senderOpt)
 		handler := handler.New(mon, apiClient, sender, *checkPublishAttribute)
+		listenDone = make(chan struct{})
+		check, started, stopped := health.Running()
+		checker.Add("pubsub", check)
 		go func() {
-			err := pubsub.Listen(ctx, *credentials, handler, *pubsubProjectID, *pubsubSubscription)
-			log.Errorf("MLLP Adapter: failed to connect to PubSub channel: %v", err)
-			os.Exit(1)
+			defer close(listenDone)
+			started()
+			err := pubsub.Listen(listenCtx, *credentials, handler, *pubsubProjectID, *pubsubSubscription)
+			stopped(err)
+			if err != nil || listenCtx.Err() == nil {
+				errs <- fmt.Errorf("failed to connect to PubSub channel: %v", err)
+			}
 		}()
 	}
 
-	if *receiverIP == "" {
-		return fmt.Errorf("required flag value --receiver_ip not provided")
+	queueCtx, stopQueue := context.WithCancel(ctx)
+	defer stopQueue()
+	var running []*runningListener
+	for _, l := range listeners {
+		store := apiClient
+		if l.Name != listener.DefaultName {
+			var err error
+			if store, err = healthapiclient.NewHL7V2Client(ctx, *credentials, mon, storeInfo(l.Store), apiOption(l)); err != nil {
+				return fmt.Errorf("failed to connect to HL7v2 API for listener %q: %v", l.Name, err)
+			}
+			checker.Add("hl7v2-api/"+l.Name, store.Health)
+		}
+		r, err := startListener(ctx, queueCtx, l, store, mon)
+		if err != nil {
+			return fmt.Errorf("listener %q: %v", l.Name, err)
+		}
+		running = append(running, r)
+	}
+	for _, r := range running {
+		check, started, stopped := health.Running()
+		checker.Add("listener/"+r.name, check)
+		go func(r *runningListener) {
+			started()
+			err := r.receiver.Run()
+			stopped(err)
+			if err != mllpreceiver.ErrReceiverClosed {
+				errs <- fmt.Errorf("failed to start MLLP receiver %q: %v", r.name, err)
+			}
+		}(r)
 	}
 
-	receiver, err := mllpreceiver.NewReceiver(*receiverIP, *port, apiClient, mon)
-	if err != nil {
-		return fmt.Errorf("failed to create MLLP receiver: %v", err)
+	// Metrics and health endpoints share a server if their addresses match.
+	muxes := map[string]*http.ServeMux{}
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+	if prom != nil {
+		mux(*prometheusAddr).Handle("/metrics", prom)
+	}
+	if *healthAddr != "" {
+		checker.Register(mux(*healthAddr))
+	}
+	var servers []*http.Server
+	for addr, m := range muxes {
+		srv := &http.Server{Addr: addr, Handler: m}
+		servers = append(servers, srv)
+		go func(srv *http.Server) {
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				errs <- fmt.Errorf("failed to serve HTTP on %v: %v", srv.Addr, err)
+			}
+		}(srv)
 	}
 
-	go func() {
-		if err := receiver.Run(); err != nil {
-			log.Errorf("MLLP Adapter: failed to start MLLP receiver: %v", err)
-			os.Exit(1)
+	sigCtx, stopSignals := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stopSignals()
+	var runErr error
+	select {
+	case <-sigCtx.Done():
+		log.Infof("MLLP Adapter: shutting down")
+	case runErr = <-errs:
+	}
+	checker.SetDraining()
+
+	// Stop taking new work first, then let the messages in flight finish.
+	shutdownCtx, cancel := context.WithTimeout(ctx, *shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, r := range running {
+		wg.Add(1)
+		go func(r *runningListener) {
+			defer wg.Done()
+			if err := r.receiver.Shutdown(shutdownCtx); err != nil {
+				log.Warningf("MLLP Adapter: MLLP receiver %q did not drain: %v", r.name, err)
+			}
+		}(r)
+	}
+	wg.Wait()
+	// Messages still queued are forwarded after the next start.
+	stopQueue()
+	for _, r := range running {
+		if r.queueDone == nil {
+			continue
 		}
-	}()
+		select {
+		case <-r.queueDone:
+		case <-shutdownCtx.Done():
+			log.Warningf("MLLP Adapter: receiver queue of %q did not stop in time", r.name)
+		}
+	}
+	for _, r := range running {
+		if r.dedup != nil {
+			r.dedup.Close()
+		}
+	}
+	stopListening()
+	if listenDone != nil {
+		select {
+		case <-listenDone:
+		case <-shutdownCtx.Done():
+			log.Warningf("MLLP Adapter: PubSub listener did not stop in time")
+		}
+	}
+	if sender != nil {
+		sender.Close()
+	}
+	// Metrics and probes stay available while the adapter drains.
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Warningf("MLLP Adapter: HTTP server on %v did not stop in time: %v", srv.Addr, err)
+		}
+	}
+	return runErr
+}
+
+// runningListener is a started MLLP receiver and the duplicate filter and queue
+// behind it, if any.
+type runningListener struct {
+	name      string
+	receiver  *mllpreceiver.MLLPReceiver
+	dedup     *dedup.Filter
+	queueDone chan struct{}
+}
+
+// startListener creates the receiver of l, which writes to store. If l has a
+// queue, it is run until queueCtx is done.
+func startListener(ctx, queueCtx context.Context, l listener.Listener, store *healthapiclient.HL7V2Client, mon monitoring.Client) (*runningListener, error) {
+	release, err := mllp.ParseRelease(l.MLLPRelease)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MLLP release: %v", err)
+	}
+	nackPolicy, err := hl7ack.ParsePolicy(l.LocalNACK)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local NACK policy: %v", err)
+	}
+	receiverOpt := mllpreceiver.Option{
+		Release:        release,
+		NACK:           nackPolicy,
+		MaxMessageSize: l.MaxMessageSize,
+		ReadTimeout:    time.Duration(l.ReadTimeout),
+		IdleTimeout:    time.Duration(l.IdleTimeout),
+		Lenient: mllp.Leniency{
+			StartBlock:        byte(l.StartBlock),
+			EndBlock:          byte(l.EndBlock),
+			AlternateTrailers: l.AlternateTrailers,
+			NormalizeSegments: l.NormalizeSegments,
+		},
+	}
+	if l.TLS.Enabled() {
+		tlsOpt := tlsconfig.ServerOption{
+			CertFile:     l.TLS.Cert,
+			KeyFile:      l.TLS.Key,
+			ClientCAFile: l.TLS.ClientCA,
+			MinVersion:   l.TLS.MinVersion,
+			CipherSuites: l.TLS.CipherSuites,
+		}
+		if receiverOpt.TLS, err = tlsconfig.Server(tlsOpt); err != nil {
+			return nil, fmt.Errorf("failed to configure receiver TLS: %v", err)
+		}
+	}
+	// Store clients are told apart by their store label, the rest of the
+	// pipeline by the name of the listener.
+	lmon := monitoring.WithLabels(mon, monitoring.Listener(l.Name))
+	var inbound router.Sender = store
+	if l.RoutesFile != "" {
+		if inbound, err = newRouter(ctx, l.RoutesFile, mon, lmon, store, apiOption(l)); err != nil {
+			return nil, err
+		}
+	}
+	r := &runningListener{name: l.Name}
+	if l.QueueDir != "" {
+		q, err := queue.New(l.QueueDir, inbound, lmon, queue.Option{Release: release, MaxAttempts: l.QueueMaxAttempts})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open receiver queue: %v", err)
+		}
+		r.queueDone = make(chan struct{})
+		go func() {
+			defer close(r.queueDone)
+			q.Run(queueCtx)
+		}()
+		inbound = q
+	}
+	if l.DedupWindow > 0 {
+		if r.dedup, err = dedup.New(inbound, lmon, dedup.Option{Window: time.Duration(l.DedupWindow), Dir: l.DedupDir}); err != nil {
+			return nil, fmt.Errorf("failed to open dedup log: %v", err)
+		}
+		inbound = r.dedup
+	}
+	if r.receiver, err = mllpreceiver.NewReceiver(l.ReceiverIP, l.Port, inbound, lmon, receiverOpt); err != nil {
+		return nil, fmt.Errorf("failed to create MLLP receiver: %v", err)
+	}
+	return r, nil
+}
 
-	select {}
+// apiOption returns the HL7v2 client options of l.
+func apiOption(l listener.Listener) healthapiclient.Option {
+	return healthapiclient.Option{
+		LogNACKedMessage:        l.LogNACKedMessage,
+		LogErrorMessage:         l.LogErrorMessage,
+		LogACK:                  l.LogACK,
+		LogInputMessageInBase64: l.LogInputMessageInBase64,
+		FallbackEncoding:        l.FallbackEncoding,
+		Retry: healthapiclient.RetryPolicy{
+			MaxAttempts:    *apiMaxAttempts,
+			BaseBackoff:    *apiBaseBackoff,
+			MaxBackoff:     *apiMaxBackoff,
+			Jitter:         *apiBackoffJitter,
+			Deadline:       *apiRetryDeadline,
+			AttemptTimeout: *apiAttemptTimeout,
+		},
+		Endpoint: *apiAddrPrefix,
+		Insecure: *apiInsecure,
+	}
+}
+
+func storeInfo(s router.Store) healthapiclient.StoreInfo {
+	return healthapiclient.StoreInfo{
+		ProjectID:    s.ProjectID,
+		LocationID:   s.LocationID,
+		DatasetID:    s.DatasetID,
+		HL7V2StoreID: s.HL7V2StoreID,
+	}
+}
+
+// newRouter creates a router from the routing table in path, with a client for
+// the store of every route. def receives unmatched messages unless the table
+// asks for them to be NACKed. The store clients report through mon and the
+// router through rmon.
+func newRouter(ctx context.Context, path string, mon, rmon monitoring.Client, def router.Sender, opt healthapiclient.Option) (*router.Router, error) {
+	cfg, err := router.LoadConfig(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load routes file %v: %v", path, err)
+	}
+	var routes []router.Route
+	for _, rc := range cfg.Routes {
+		c, err := healthapiclient.NewHL7V2Client(ctx, *credentials, mon, storeInfo(rc.Store), opt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to HL7v2 API for route %q: %v", rc.Name, err)
+		}
+		routes = append(routes, router.Route{Name: rc.Name, Match: rc.Match, Sender: c})
+	}
+	if cfg.Unmatched == router.UnmatchedNACK {
+		def = nil
+	}
+	r, err := router.New(routes, def, rmon)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routes file %v: %v", path, err)
+	}
+	return r, nil
 }
@@ -16,20 +16,30 @@
 package mllpreceiver
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	log "github.com/golang/glog"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/hl7ack"
 	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/mllp"
+	"github.com/GoogleCloudPlatform/mllp/shared/hl7"
+	"github.com/GoogleCloudPlatform/mllp/shared/hl7batch"
 	"github.com/GoogleCloudPlatform/mllp/shared/monitoring"
+	"github.com/GoogleCloudPlatform/mllp/shared/tracing"
 )
 
 // The sender interface represents the destination to which HL7 messages are sent, one at a time.
+// The context passed to Send is cancelled if the connection is closed before
+// the message is handled.
 type sender interface {
-	Send([]byte) ([]byte, error)
+	Send(context.Context, []byte) ([]byte, error)
 }
 
 // MLLPReceiver represents an MLLP receiver.
@@ -38,6 +48,24 @@ type MLLPReceiver struct {
 	sender   sender
 	port     int
 	metrics  monitoring.Client
+	release  mllp.Release
+	tls      *tls.Config
+	nack     hl7ack.Policy
+	// readerOpt limits the messages read from each connection.
+	readerOpt   mllp.ReaderOption
+	idleTimeout time.Duration
+
+	// mu guards conns and closing. conns tells whether each connection is
+	// idle, i.e. waiting for the start of its next message.
+	mu      sync.Mutex
+	conns   map[*net.TCPConn]bool
+	closing bool
+	// active counts the connections being handled.
+	active sync.WaitGroup
+	// ctx is the parent of the contexts of all connections. cancel is called
+	// when Shutdown gives up on draining them.
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	// If non-nil, connClosed will receive a message every time a connection
 	// is closed.  This is primarily useful for synchronizing tests.
@@ -50,11 +78,61 @@ const (
 	handleMessagesMetric  = "receiver-handle-messages"
 	writesMetric          = "receiver-writes"
 	receiverLatencyMetric = "receiver-latency"
+	commitNAKsMetric      = "receiver-commit-naks"
+	tlsHandshakesMetric   = "receiver-tls-handshakes"
+	tlsErrorsMetric       = "receiver-tls-handshake-errors"
+	localNACKsMetric      = "receiver-local-nacks"
+	oversizedMetric       = "receiver-oversized-messages"
+	timeoutsMetric        = "receiver-read-timeouts"
+	droppedBytesMetric    = "receiver-dropped-bytes"
+	badTrailersMetric     = "receiver-bad-trailers"
+	truncatedMetric       = "receiver-truncated-frames"
+	batchesMetric         = "receiver-batches"
+	batchMessagesMetric   = "receiver-batch-messages"
+	invalidBatchesMetric  = "receiver-invalid-batches"
+	// lenientMetricPrefix is followed by the mllp.Correction.
+	lenientMetricPrefix = "receiver-lenient-"
+
+	tlsHandshakeTimeout = 30 * time.Second
+
+	oversizedReason = "Message exceeds the maximum size accepted by the receiving application"
 )
 
+// ErrReceiverClosed is returned by Run after Shutdown is called.
+var ErrReceiverClosed = errors.New("mllpreceiver: receiver closed")
+
+// Option contains optional settings for the MLLPReceiver.
+type Option struct {
+	// Release is the MLLP release spoken by partners connecting to this
+	// receiver. In Release 2 mode each message is answered with a commit ACK
+	// once it is stored, or a commit NAK if it could not be stored. Release 1
+	// is used if unset.
+	Release mllp.Release
+	// TLS, if set, is used to terminate TLS on every accepted connection.
+	TLS *tls.Config
+	// NACK selects, per failure class, the code of a locally built ACK that
+	// is returned when a message cannot be stored and the sender did not
+	// return a NACK. For failure classes not in NACK the connection is closed
+	// (Release 1) or a commit NAK is sent (Release 2).
+	NACK hl7ack.Policy
+	// MaxMessageSize is the maximum length of a message in bytes. Longer
+	// messages are answered with an AR NACK without being stored. If zero,
+	// messages of any length are accepted.
+	MaxMessageSize int
+	// ReadTimeout limits the time taken to receive a message once it has
+	// started. IdleTimeout limits the time a connection may wait for the next
+	// message. Connections are closed when either is exceeded. If zero, there
+	// is no limit.
+	ReadTimeout time.Duration
+	IdleTimeout time.Duration
+	// Lenient selects the deviations from the MLLP specification accepted
+	// from partners. Every accepted deviation is counted.
+	Lenient mllp.Leniency
+}
+
 // NewReceiver creates a new MLLP receiver.  If port is 0, an available port is
 // chosen at random.
-func NewReceiver(ip string, port int, sender sender, mt monitoring.Client) (*MLLPReceiver, error) {
+func NewReceiver(ip string, port int, sender sender, mt monitoring.Client, opt Option) (*MLLPReceiver, error) {
 	localhost := net.JoinHostPort(ip, strconv.Itoa(port))
 	l, err := net.Listen("tcp", localhost)
 	if err != nil {
@@ -66,17 +144,60 @@ func NewReceiver(ip string, port int, sender sender, mt monitoring.Client) (*MLL
 		return nil, fmt.Errorf("casting %v to TCPAddr: %v", l.Addr(), err)
 	}
 	mt.NewCounter(reconnectsMetric, "Number of times the receiver reconnects")
-	mt.NewCounter(readsMetric, "Number of HL7 messages read from receiver_ip")
-	mt.NewCounter(handleMessagesMetric, "Number of errors when handling HL7 message received from receiver_ip")
-	mt.NewCounter(writesMetric, "Number of HL7 messages written to HL7 store")
-	mt.NewLatency(receiverLatencyMetric, "The latency between \"HL7 message received\" to \"HL7 message written to HL7v2 store\"")
+	mt.NewCounter(readsMetric, "Number of HL7 messages read from receiver_ip", monitoring.PeerKey, monitoring.MessageTypeKey)
+	mt.NewCounter(handleMessagesMetric, "Number of errors when handling HL7 message received from receiver_ip", monitoring.PeerKey)
+	mt.NewCounter(writesMetric, "Number of HL7 messages written to HL7 store", monitoring.PeerKey, monitoring.MessageTypeKey, monitoring.AckCodeKey)
+	mt.NewLatency(receiverLatencyMetric, "The latency between \"HL7 message received\" to \"HL7 message written to HL7v2 store\"", monitoring.MessageTypeKey)
+	mt.NewCounter(commitNAKsMetric, "Number of MLLP Release 2 commit NAKs sent to receiver_ip", monitoring.PeerKey)
+	mt.NewCounter(tlsHandshakesMetric, "Number of successful TLS handshakes with receiver_ip", monitoring.PeerKey)
+	mt.NewCounter(tlsErrorsMetric, "Number of failed TLS handshakes with receiver_ip", monitoring.PeerKey)
+	mt.NewCounter(localNACKsMetric, "Number of locally generated NACKs sent to receiver_ip", monitoring.PeerKey)
+	mt.NewCounter(oversizedMetric, "Number of HL7 messages from receiver_ip rejected for exceeding the maximum size", monitoring.PeerKey)
+	mt.NewCounter(timeoutsMetric, "Number of connections from receiver_ip closed after a read timeout", monitoring.PeerKey)
+	mt.NewCounter(droppedBytesMetric, "Number of times bytes before the start of a message from receiver_ip were discarded", monitoring.PeerKey)
+	mt.NewCounter(badTrailersMetric, "Number of messages from receiver_ip discarded because the end block was not followed by a carriage return", monitoring.PeerKey)
+	mt.NewCounter(truncatedMetric, "Number of connections from receiver_ip that ended in the middle of a message", monitoring.PeerKey)
+	mt.NewCounter(batchesMetric, "Number of HL7 batches received from receiver_ip", monitoring.PeerKey)
+	mt.NewCounter(batchMessagesMetric, "Number of HL7 messages split out of batches received from receiver_ip", monitoring.PeerKey)
+	mt.NewCounter(invalidBatchesMetric, "Number of HL7 batches from receiver_ip that could not be split", monitoring.PeerKey)
+	for _, c := range []mllp.Correction{mllp.LFTrailer, mllp.MissingTrailer, mllp.SegmentTerminators} {
+		mt.NewCounter(lenientMetricPrefix+string(c), fmt.Sprintf("Number of HL7 messages from receiver_ip accepted despite a %v", c), monitoring.PeerKey)
+	}
 
-	return &MLLPReceiver{listener: l, sender: sender, metrics: mt, port: tcpAddr.Port}, nil
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MLLPReceiver{
+		ctx:      ctx,
+		cancel:   cancel,
+		listener: l,
+		sender:   sender,
+		metrics:  mt,
+		port:     tcpAddr.Port,
+		release:  opt.Release,
+		tls:      opt.TLS,
+		nack:     opt.NACK,
+		readerOpt: mllp.ReaderOption{
+			MaxFrameSize: opt.MaxMessageSize,
+			FrameTimeout: opt.ReadTimeout,
+			Lenient:      opt.Lenient,
+		},
+		idleTimeout: opt.IdleTimeout,
+		conns:       make(map[*net.TCPConn]bool),
+	}, nil
 }
 
-// Run starts listening for incoming TCP connections. Only returns in case of an error.
+// Addr returns the address the receiver listens on, which tells the port that
+// was chosen if NewReceiver was given port 0.
+func (m *MLLPReceiver) Addr() net.Addr {
+	return m.listener.Addr()
+}
+
+// Run starts listening for incoming TCP connections. Only returns in case of
+// an error, or with ErrReceiverClosed once Shutdown is called.
 func (m *MLLPReceiver) Run() error {
 	defer func() {
+		if m.isClosing() {
+			return
+		}
 		if err := m.listener.Close(); err != nil {
 			log.Errorf("MLLP Receiver: closing listener: %v", err)
 		}
@@ -84,23 +205,143 @@ func (m *MLLPReceiver) Run() error {
 	for {
 		conn, err := m.listener.(*net.TCPListener).AcceptTCP()
 		if err != nil {
+			if m.isClosing() {
+				return ErrReceiverClosed
+			}
 			return fmt.Errorf("acceptTCP: %v", err)
 		}
 		m.metrics.IncCounter(reconnectsMetric)
+		if !m.track(conn) {
+			conn.Close()
+			continue
+		}
 		go m.handleConnection(conn)
 	}
 }
 
+// Shutdown stops accepting connections and drains the open ones: messages
+// that are already being handled are forwarded and ACKed, then every
+// connection is closed. If ctx expires first the messages in flight are
+// cancelled, the remaining connections are closed immediately and ctx.Err()
+// is returned.
+func (m *MLLPReceiver) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.closing = true
+	if err := m.listener.Close(); err != nil {
+		log.Errorf("MLLP Receiver: closing listener: %v", err)
+	}
+	// Wake up connections waiting for their next message. Connections that
+	// are reading or handling a message are left to finish it and notice
+	// closing once its ACK is written.
+	for c, idle := range m.conns {
+		if idle {
+			c.SetReadDeadline(time.Now())
+		}
+	}
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		m.mu.Lock()
+		log.Warningf("MLLP Receiver: closing %d connections that did not drain in time", len(m.conns))
+		m.cancel()
+		for c := range m.conns {
+			c.Close()
+		}
+		m.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (m *MLLPReceiver) isClosing() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closing
+}
+
+// track registers a new connection, unless the receiver is shutting down.
+func (m *MLLPReceiver) track(conn *net.TCPConn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closing {
+		return false
+	}
+	m.conns[conn] = false
+	m.active.Add(1)
+	return true
+}
+
+// waitForMessage starts the idle timeout of conn before it reads its next
+// message. It returns false if the receiver is shutting down. Both happen
+// under mu, so that the idle timeout cannot replace the deadline set by a
+// concurrent Shutdown to wake the connection up.
+func (m *MLLPReceiver) waitForMessage(conn *net.TCPConn) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closing {
+		return false, nil
+	}
+	if m.idleTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(m.idleTimeout)); err != nil {
+			return false, err
+		}
+	}
+	m.conns[conn] = true
+	return true, nil
+}
+
+// startMessage marks conn as busy once the start of a message has arrived, so
+// that Shutdown lets the message finish. It clears the idle timeout, or the
+// deadline with which Shutdown woke the connection up, so that the rest of the
+// message is only bounded by the read timeout.
+func (m *MLLPReceiver) startMessage(conn *net.TCPConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conns[conn] = false
+	if m.idleTimeout <= 0 && !m.closing {
+		return
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		log.Errorf("MLLP Receiver: failed to set read deadline: %v", err)
+	}
+}
+
+// wokenUp reports whether conn was idle when Shutdown started.
+func (m *MLLPReceiver) wokenUp(conn *net.TCPConn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closing && m.conns[conn]
+}
+
+func (m *MLLPReceiver) untrack(conn *net.TCPConn) {
+	m.mu.Lock()
+	delete(m.conns, conn)
+	m.mu.Unlock()
+	m.active.Done()
+}
+
 // handleConnection handles a single TCP connection.
-func (m *MLLPReceiver) handleConnection(conn *net.TCPConn) {
+func (m *MLLPReceiver) handleConnection(tcpConn *net.TCPConn) {
 
 	// Cloud VPC resets connections that are idle for 10 minutes (see
 	// https://cloud.google.com/compute/docs/networks-and-firewalls), so we
 	// send a keep alive message every 3 minutes to keep that from
 	// happening.
-	conn.SetKeepAlive(true)
-	conn.SetKeepAlivePeriod(3 * time.Minute)
+	tcpConn.SetKeepAlive(true)
+	tcpConn.SetKeepAlivePeriod(3 * time.Minute)
 
+	defer m.untrack(tcpConn)
+	ctx, cancel := context.WithCancel(m.ctx)
+	defer cancel()
+	peer := monitoring.Peer(tcpConn.RemoteAddr())
+	var conn net.Conn = tcpConn
 	defer func() {
 		if err := conn.Close(); err != nil {
 			log.Errorf("MLLP Receiver: failed to clean up connection: %v", err)
@@ -110,36 +351,275 @@ func (m *MLLPReceiver) handleConnection(conn *net.TCPConn) {
 		}
 	}()
 
-	reader := mllp.NewMessageReader(conn)
+	if m.tls != nil {
+		tlsConn, err := m.handshake(tcpConn)
+		conn = tlsConn
+		if err != nil {
+			log.Errorf("MLLP Receiver: TLS handshake with %v failed: %v", tcpConn.RemoteAddr(), err)
+			m.metrics.IncCounter(tlsErrorsMetric, peer)
+			return
+		}
+		m.metrics.IncCounter(tlsHandshakesMetric, peer)
+	}
+
+	readerOpt := m.readerOpt
+	readerOpt.Started = func() { m.startMessage(tcpConn) }
+	readerOpt.Corrected = func(c mllp.Correction) {
+		m.metrics.IncCounter(lenientMetricPrefix+string(c), peer)
+	}
+	reader := mllp.NewMessageReaderWithOption(conn, readerOpt)
+	w := mllp.NewMessageWriterWithOption(conn, mllp.WriterOption{
+		StartBlock: m.readerOpt.Lenient.StartBlock,
+		EndBlock:   m.readerOpt.Lenient.EndBlock,
+	})
 	for {
+		if ok, err := m.waitForMessage(tcpConn); !ok {
+			if err != nil {
+				log.Errorf("MLLP Receiver: failed to set read deadline: %v", err)
+			}
+			return
+		}
 		msg, err := reader.Next()
+		var dropped *mllp.DroppedBytesError
+		var trailer *mllp.TrailerError
+		switch {
+		case errors.As(err, &dropped):
+			m.metrics.IncCounter(droppedBytesMetric, peer)
+			log.Warningf("MLLP Receiver: %v from %v", err, conn.RemoteAddr())
+			continue
+		case errors.As(err, &trailer):
+			if !m.rejectBadTrailer(conn, w, peer, msg, err) {
+				return
+			}
+			continue
+		case err == mllp.ErrFrameTooLarge:
+			if !m.rejectOversized(conn, w, peer, msg) {
+				return
+			}
+			continue
+		case err == mllp.ErrTruncatedFrame:
+			m.metrics.IncCounter(truncatedMetric, peer)
+			log.Errorf("MLLP Receiver: connection from %v closed in the middle of a message", conn.RemoteAddr())
+			return
+		}
 		if err != nil {
-			if err != io.EOF {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if m.wokenUp(tcpConn) {
+					return
+				}
+				m.metrics.IncCounter(timeoutsMetric, peer)
+				log.Warningf("MLLP Receiver: closing connection from %v after read timeout", conn.RemoteAddr())
+				return
+			}
+			if err != io.EOF && !m.isClosing() {
 				log.Errorf("MLLP Receiver: failed to read message: %v", err)
 			}
 			return
 		}
+		if m.release == mllp.Release2 && mllp.IsCommit(msg) {
+			// The partner is committing an ACK we sent earlier, there is
+			// nothing to forward.
+			continue
+		}
 		readTime := time.Now()
-		m.metrics.IncCounter(readsMetric)
-		ack, err := m.handleMessage(msg)
+		msgType := monitoring.MessageType(msg)
+		m.metrics.IncCounter(readsMetric, peer, msgType)
+		ack, err := m.handleMessage(ctx, msg, peer)
 		if err != nil {
-			log.Errorf("MLLP Receiver: failed to handle message: %v", err.Error())
-			return
+			log.Errorf("MLLP Receiver: failed to handle %v: %v", describe(msg), err.Error())
+			if nack := m.localNACK(msg, err); nack != nil {
+				if m.release == mllp.Release2 {
+					if err := w.WriteCommitACK(); err != nil {
+						log.Errorf("MLLP Receiver: failed to write commit ACK: %v", err)
+						return
+					}
+				}
+				if err := w.WriteMsg(nack); err != nil {
+					log.Errorf("MLLP Receiver: failed to write NACK: %v", err)
+					return
+				}
+				m.metrics.IncCounter(localNACKsMetric, peer)
+				continue
+			}
+			if m.release != mllp.Release2 {
+				return
+			}
+			// Ask the partner to retransmit instead of dropping the connection.
+			m.metrics.IncCounter(commitNAKsMetric, peer)
+			if err := w.WriteCommitNAK(); err != nil {
+				log.Errorf("MLLP Receiver: failed to write commit NAK: %v", err)
+				return
+			}
+			continue
 		}
-		m.metrics.IncCounter(handleMessagesMetric)
-		if err := mllp.WriteMsg(conn, ack); err != nil {
-			log.Errorf("MLLP Receiver: failed to write ACK: %v", err)
-			return
+		m.metrics.IncCounter(handleMessagesMetric, peer)
+		if m.release == mllp.Release2 {
+			if err := w.WriteCommitACK(); err != nil {
+				log.Errorf("MLLP Receiver: failed to write commit ACK: %v", err)
+				return
+			}
+		}
+		// A sender may return no ACK in Release 2 mode, leaving the commit
+		// ACK as the only response.
+		if ack != nil || m.release != mllp.Release2 {
+			if err := w.WriteMsg(ack); err != nil {
+				log.Errorf("MLLP Receiver: failed to write ACK: %v", err)
+				return
+			}
 		}
-		m.metrics.IncCounter(writesMetric)
-		m.metrics.AddLatency(receiverLatencyMetric, float64(time.Since(readTime).Milliseconds()))
+		m.metrics.IncCounter(writesMetric, peer, msgType, monitoring.AckCode(ack))
+		m.metrics.AddLatency(receiverLatencyMetric, float64(time.Since(readTime).Milliseconds()), msgType)
+	}
+}
+
+// rejectOversized answers a message that exceeded the maximum size, of which
+// only the start is in msg, with an AR NACK. It returns false if the
+// connection should be closed instead.
+func (m *MLLPReceiver) rejectOversized(conn net.Conn, w *mllp.MessageWriter, peer monitoring.Label, msg []byte) bool {
+	m.metrics.IncCounter(oversizedMetric, peer)
+	log.Errorf("MLLP Receiver: %v from %v exceeds %d bytes", describe(msg), conn.RemoteAddr(), m.readerOpt.MaxFrameSize)
+	nack, err := hl7ack.Build(msg, hl7ack.ApplicationReject, oversizedReason)
+	if err != nil {
+		log.Warningf("MLLP Receiver: cannot build NACK: %v", err)
+		return false
+	}
+	if m.release == mllp.Release2 {
+		// A commit NAK would only make the partner retransmit the message.
+		if err := w.WriteCommitACK(); err != nil {
+			log.Errorf("MLLP Receiver: failed to write commit ACK: %v", err)
+			return false
+		}
+	}
+	if err := w.WriteMsg(nack); err != nil {
+		log.Errorf("MLLP Receiver: failed to write NACK: %v", err)
+		return false
+	}
+	return true
+}
+
+// rejectBadTrailer discards a message whose frame did not end correctly, since
+// it may be incomplete, and asks for a retransmission in Release 2 mode. In
+// Release 1 mode the partner resends it after its ACK timeout. It returns
+// false if the connection should be closed.
+func (m *MLLPReceiver) rejectBadTrailer(conn net.Conn, w *mllp.MessageWriter, peer monitoring.Label, msg []byte, err error) bool {
+	m.metrics.IncCounter(badTrailersMetric, peer)
+	log.Errorf("MLLP Receiver: discarding %v from %v: %v", describe(msg), conn.RemoteAddr(), err)
+	if m.release != mllp.Release2 {
+		return true
+	}
+	m.metrics.IncCounter(commitNAKsMetric, peer)
+	if err := w.WriteCommitNAK(); err != nil {
+		log.Errorf("MLLP Receiver: failed to write commit NAK: %v", err)
+		return false
+	}
+	return true
+}
+
+// handshake performs the server side TLS handshake on conn and logs the
+// outcome.
+func (m *MLLPReceiver) handshake(conn *net.TCPConn) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, m.tls)
+	if err := conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return tlsConn, err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return tlsConn, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return tlsConn, err
 	}
+	subject := "none"
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		subject = certs[0].Subject.String()
+	}
+	log.Infof("MLLP Receiver: TLS handshake with %v succeeded, peer certificate subject: %v", conn.RemoteAddr(), subject)
+	return tlsConn, nil
 }
 
-func (m *MLLPReceiver) handleMessage(msg []byte) ([]byte, error) {
-	ack, err := m.sender.Send(msg)
+// localNACK builds the NACK configured for the class of err, or returns nil if
+// there is none.
+func (m *MLLPReceiver) localNACK(msg []byte, err error) []byte {
+	class := hl7ack.Classify(err)
+	code, ok := m.nack[class]
+	if !ok {
+		return nil
+	}
+	nack, err := hl7ack.Build(msg, code, hl7ack.Reason(class))
 	if err != nil {
+		log.Warningf("MLLP Receiver: cannot build NACK: %v", err)
+		return nil
+	}
+	return nack
+}
+
+// describe identifies msg in logs by its type and control ID, which unlike the
+// rest of the message carry no patient data.
+func describe(msg []byte) string {
+	parsed, err := hl7.Parse(msg)
+	if err != nil {
+		return "message without MSH segment"
+	}
+	msgType, _ := parsed.Get("MSH-9")
+	controlID, _ := parsed.Value("MSH-10")
+	return fmt.Sprintf("%v message %q", msgType, controlID)
+}
+
+// handleMessage forwards msg, or the messages of a batch, and returns the ACK
+// to send back. It is traced as the mllp.receive span.
+func (m *MLLPReceiver) handleMessage(ctx context.Context, msg []byte, peer monitoring.Label) ([]byte, error) {
+	ctx, span := tracing.StartSpan(ctx, "mllp.receive", msg, tracing.PeerKey.String(peer.Value))
+	var ack []byte
+	var err error
+	if hl7batch.IsBatch(msg) {
+		span.SetAttributes(tracing.BatchKey.Bool(true))
+		ack, err = m.handleBatch(ctx, msg, peer)
+	} else {
+		ack, err = m.sender.Send(ctx, msg)
+	}
+	if err != nil {
+		tracing.End(span, err)
 		return nil, err
 	}
+	span.SetAttributes(tracing.AckAttributes(ack)...)
+	tracing.End(span, nil)
 	return ack, nil
 }
+
+// handleBatch sends the messages of a batch one by one and returns a batch
+// acknowledgement holding their ACKs. A message that cannot be stored gets the
+// NACK configured for its failure class; if there is none the whole batch
+// fails, so that the partner resends it.
+func (m *MLLPReceiver) handleBatch(ctx context.Context, data []byte, peer monitoring.Label) ([]byte, error) {
+	b, err := hl7batch.Split(data)
+	if err != nil {
+		m.metrics.IncCounter(invalidBatchesMetric, peer)
+		return nil, fmt.Errorf("splitting batch: %v", err)
+	}
+	m.metrics.IncCounter(batchesMetric, peer)
+	acks := make([][]byte, 0, len(b.Messages))
+	for _, msg := range b.Messages {
+		m.metrics.IncCounter(batchMessagesMetric, peer)
+		ack, err := m.sender.Send(ctx, msg)
+		switch {
+		case err != nil:
+			log.Errorf("MLLP Receiver: failed to handle %v in batch: %v", describe(msg), err)
+			if ctx.Err() != nil {
+				// The connection is being closed, so the batch cannot be
+				// answered.
+				return nil, err
+			}
+			if ack = m.localNACK(msg, err); ack == nil {
+				return nil, err
+			}
+			m.metrics.IncCounter(localNACKsMetric, peer)
+		case ack == nil:
+			// The sender relies on the commit ACK, which cannot be sent for
+			// each message of a batch.
+			if ack, err = hl7ack.Build(msg, hl7ack.CommitAccept, ""); err != nil {
+				return nil, err
+			}
+		}
+		acks = append(acks, ack)
+	}
+	return b.Ack(acks), nil
+}
@@ -16,14 +16,24 @@ package mllpreceiver
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"net"
 	"reflect"
+	"regexp"
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/hl7ack"
 	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/mllp"
+	"github.com/GoogleCloudPlatform/mllp/shared/monitoring"
 	"github.com/GoogleCloudPlatform/mllp/shared/testingutil"
+	"github.com/GoogleCloudPlatform/mllp/shared/tlsconfig"
+	"github.com/GoogleCloudPlatform/mllp/shared/tracing"
 )
 
 var (
@@ -35,25 +45,53 @@ var (
 type fakeSender struct {
 	msgs [][]byte
 	mu   sync.Mutex
+	// failures is the number of upcoming Send calls that return an error.
+	failures int
+	// If non-nil, Send signals started and then waits for release before
+	// returning, or fails once ctx is done.
+	started chan struct{}
+	release chan struct{}
 }
 
-func (s *fakeSender) Send(msg []byte) ([]byte, error) {
+func (s *fakeSender) Send(ctx context.Context, msg []byte) ([]byte, error) {
+	if s.started != nil {
+		s.started <- struct{}{}
+		select {
+		case <-s.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return nil, fmt.Errorf("send error")
+	}
 	s.msgs = append(s.msgs, msg)
-	s.mu.Unlock()
 	return cannedAck, nil
 }
 
 func setUp(t *testing.T) (*fakeSender, *MLLPReceiver) {
+	return setUpWithOption(t, Option{})
+}
+
+func setUpWithOption(t *testing.T, opt Option) (*fakeSender, *MLLPReceiver) {
+	s, r := newReceiver(t, opt)
+	go r.Run()
+	return s, r
+}
+
+// newReceiver creates a receiver without starting it.
+func newReceiver(t *testing.T, opt Option) (*fakeSender, *MLLPReceiver) {
 	s := &fakeSender{}
 	mt := testingutil.NewFakeMonitoringClient()
-	r, err := NewReceiver("0.0.0.0", 0, s, mt)
-	// We want to be notified of closed connections.
-	r.connClosed = make(chan struct{})
+	r, err := NewReceiver("0.0.0.0", 0, s, mt, opt)
 	if err != nil {
 		t.Fatalf("NewReceiver: %v", err)
 	}
-	go r.Run()
+	// We want to be notified of closed connections.
+	r.connClosed = make(chan struct{})
 	return s, r
 }
 
@@ -225,6 +263,542 @@ func TestMessageStats(t *testing.T) {
 	}
 }
 
+func TestMessageLabels(t *testing.T) {
+	exp := testingutil.RecordSpans(t)
+	_, r := setUp(t)
+	c := dial(t, r.port)
+	msg := []byte("MSH|^~\\&|APP|FAC|RECV|RECVFAC|20180101000000||ADT^A01|CTRL1|P|2.5\rPID|1\r")
+	if err := mllp.WriteMsg(c, msg); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if _, err := mllp.ReadMsg(c); err != nil {
+		t.Fatalf("Failed to read ack: %v", err)
+	}
+	peer := monitoring.Peer(c.LocalAddr())
+	if err := c.Close(); err != nil {
+		t.Fatalf("Failure closing connection: %v", err)
+	}
+	waitForConnections(r, 1)
+
+	msgType := monitoring.Label{Key: monitoring.MessageTypeKey, Value: "ADT^A01"}
+	// The canned ACK has no MSA segment.
+	ackCode := monitoring.Label{Key: monitoring.AckCodeKey, Value: monitoring.OtherValue}
+	metrics := r.metrics.(*testingutil.FakeMonitoringClient)
+	if got := metrics.LabeledCounterValue(readsMetric, peer, msgType); got != 1 {
+		t.Errorf("%v{%v, %v} = %v, want 1", readsMetric, peer, msgType, got)
+	}
+	if got := metrics.LabeledCounterValue(writesMetric, peer, msgType, ackCode); got != 1 {
+		t.Errorf("%v{%v, %v, %v} = %v, want 1", writesMetric, peer, msgType, ackCode, got)
+	}
+	_, attrs := testingutil.FindSpan(t, exp, "mllp.receive")
+	if attrs[tracing.ControlIDKey] != "CTRL1" || attrs[tracing.PeerKey] != peer.Value {
+		t.Errorf("mllp.receive attributes = %v, want control ID CTRL1 and peer %v", attrs, peer.Value)
+	}
+}
+
+func TestRelease2(t *testing.T) {
+	s, r := setUpWithOption(t, Option{Release: mllp.Release2})
+	s.failures = 1
+	c := dial(t, r.port)
+	reader := mllp.NewMessageReader(c)
+
+	// The first attempt fails and is answered with a commit NAK.
+	if err := mllp.WriteMsg(c, cannedMsg); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if err := reader.NextCommit(); err != mllp.ErrCommitNAK {
+		t.Fatalf("NextCommit() returned %v, want %v", err, mllp.ErrCommitNAK)
+	}
+
+	// The retransmission is committed and then acknowledged.
+	if err := mllp.WriteMsg(c, cannedMsg); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if err := reader.NextCommit(); err != nil {
+		t.Fatalf("NextCommit() returned %v, want nil", err)
+	}
+	if ack := receiveAck(t, reader); !bytes.Equal(ack, cannedAck) {
+		t.Errorf("Got ack %v, want %v", ack, cannedAck)
+	}
+
+	// Our commit of the ACK must not be forwarded as a message.
+	if err := mllp.WriteCommitACK(c); err != nil {
+		t.Fatalf("Failed to write commit ACK: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Failure closing connection: %v", err)
+	}
+
+	waitForConnections(r, 1)
+	expected := [][]byte{cannedMsg}
+	if !reflect.DeepEqual(expected, s.msgs) {
+		t.Fatalf("Messages differ: expected %v but got %v", expected, s.msgs)
+	}
+	testingutil.CheckMetrics(t, r.metrics.(*testingutil.FakeMonitoringClient), map[string]int64{readsMetric: 2, commitNAKsMetric: 1, writesMetric: 1})
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := testingutil.NewCertificateAuthority(t)
+	serverCert, serverKey := ca.Issue(t, "receiver")
+	serverTLS, err := tlsconfig.Server(tlsconfig.ServerOption{
+		CertFile:     testingutil.WriteFile(t, dir, "cert.pem", serverCert),
+		KeyFile:      testingutil.WriteFile(t, dir, "key.pem", serverKey),
+		ClientCAFile: testingutil.WriteFile(t, dir, "ca.pem", ca.PEM),
+	})
+	if err != nil {
+		t.Fatalf("tlsconfig.Server: %v", err)
+	}
+	s, r := setUpWithOption(t, Option{TLS: serverTLS})
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.PEM)
+	clientCert, clientKey := ca.Issue(t, "partner")
+	keyPair, err := tls.X509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatalf("X509KeyPair: %v", err)
+	}
+
+	// A client with a certificate signed by the CA is accepted.
+	c, err := tls.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(r.port)), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{keyPair}})
+	if err != nil {
+		t.Fatalf("tls.Dial: %v", err)
+	}
+	if err := mllp.WriteMsg(c, cannedMsg); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if ack := receiveAck(t, mllp.NewMessageReader(c)); !bytes.Equal(ack, cannedAck) {
+		t.Errorf("Got ack %v, want %v", ack, cannedAck)
+	}
+	c.Close()
+	waitForConnections(r, 1)
+
+	// A client without a certificate is rejected.
+	c, err = tls.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(r.port)), &tls.Config{RootCAs: roots})
+	if err == nil {
+		// With TLS 1.3 the client learns about the rejection on first read.
+		mllp.WriteMsg(c, cannedMsg)
+		if _, err := mllp.ReadMsg(c); err == nil {
+			t.Errorf("Expected connection without client certificate to fail")
+		}
+		c.Close()
+	}
+	waitForConnections(r, 1)
+
+	expected := [][]byte{cannedMsg}
+	if !reflect.DeepEqual(expected, s.msgs) {
+		t.Errorf("Messages differ: expected %v but got %v", expected, s.msgs)
+	}
+	testingutil.CheckMetrics(t, r.metrics.(*testingutil.FakeMonitoringClient), map[string]int64{tlsHandshakesMetric: 1, tlsErrorsMetric: 1})
+}
+
+func TestLocalNACK(t *testing.T) {
+	hl7Msg := []byte("MSH|^~\\&|A|B|C|D|20180101000000||ADT^A01|CTRL1|P|2.5\r")
+	s, r := setUpWithOption(t, Option{NACK: hl7ack.Policy{hl7ack.Other: hl7ack.ApplicationError}})
+	s.failures = 2
+	c := dial(t, r.port)
+	reader := mllp.NewMessageReader(c)
+
+	// The connection stays open after a NACK.
+	if err := mllp.WriteMsg(c, hl7Msg); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if nack := receiveAck(t, reader); !bytes.Contains(nack, []byte("MSA|AE|CTRL1")) {
+		t.Errorf("Got %q, want a NACK with MSA|AE|CTRL1", nack)
+	}
+	if err := mllp.WriteMsg(c, hl7Msg); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if nack := receiveAck(t, reader); !bytes.Contains(nack, []byte("MSA|AE|CTRL1")) {
+		t.Errorf("Got %q, want a NACK with MSA|AE|CTRL1", nack)
+	}
+	if err := mllp.WriteMsg(c, hl7Msg); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if ack := receiveAck(t, reader); !bytes.Equal(ack, cannedAck) {
+		t.Errorf("Got ack %v, want %v", ack, cannedAck)
+	}
+
+	// Without an MSH segment no NACK can be built and the connection is
+	// closed as before.
+	s.mu.Lock()
+	s.failures = 1
+	s.mu.Unlock()
+	if err := mllp.WriteMsg(c, cannedMsg); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if _, err := reader.Next(); err == nil {
+		t.Errorf("Expected connection to be closed")
+	}
+	c.Close()
+	waitForConnections(r, 1)
+	testingutil.CheckMetrics(t, r.metrics.(*testingutil.FakeMonitoringClient), map[string]int64{localNACKsMetric: 2, writesMetric: 1})
+}
+
+func TestBatch(t *testing.T) {
+	batch := []byte("BHS|^~\\&|A|B|C|D|20180101000000||||BATCH1\r" +
+		"MSH|^~\\&|A|B|C|D|20180101000000||ADT^A01|CTRL1|P|2.5\rPID|1\r" +
+		"MSH|^~\\&|A|B|C|D|20180101000000||ADT^A01|CTRL2|P|2.5\rPID|2\r" +
+		"BTS|2\r")
+	s, r := setUpWithOption(t, Option{NACK: hl7ack.Policy{hl7ack.Other: hl7ack.ApplicationError}})
+	s.failures = 1
+	c := dial(t, r.port)
+	reader := mllp.NewMessageReader(c)
+
+	// Each message is sent on its own and gets its own ACK.
+	if err := mllp.WriteMsg(c, batch); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	ack := receiveAck(t, reader)
+	want := regexp.MustCompile(`^BHS\|\^~\\&\|C\|D\|A\|B\|[^\r]*\|BATCH1\rMSH\|[^\r]*\rMSA\|AE\|CTRL1\r[^\r]*\rack\rBTS\|2\r$`)
+	if !want.Match(ack) {
+		t.Errorf("Got %q, want match for %v", ack, want)
+	}
+	if len(s.msgs) != 1 || !bytes.Contains(s.msgs[0], []byte("CTRL2")) || bytes.Contains(s.msgs[0], []byte("BHS")) {
+		t.Errorf("Sent %q, want only the second message", s.msgs)
+	}
+
+	// A batch that cannot be split is not ACKed.
+	miscounted := bytes.Replace(batch, []byte("BTS|2"), []byte("BTS|3"), 1)
+	if err := mllp.WriteMsg(c, miscounted); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	if _, err := reader.Next(); err == nil {
+		t.Errorf("Expected connection to be closed")
+	}
+	c.Close()
+	waitForConnections(r, 1)
+	testingutil.CheckMetrics(t, r.metrics.(*testingutil.FakeMonitoringClient), map[string]int64{
+		batchesMetric:        1,
+		batchMessagesMetric:  2,
+		invalidBatchesMetric: 1,
+		localNACKsMetric:     1,
+	})
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	hl7Msg := []byte("MSH|^~\\&|A|B|C|D|20180101000000||ADT^A01|CTRL1|P|2.5\r")
+	large := append(append([]byte{}, hl7Msg...), bytes.Repeat([]byte("x"), 1000)...)
+	s, r := setUpWithOption(t, Option{MaxMessageSize: 200})
+	c := dial(t, r.port)
+	reader := mllp.NewMessageReader(c)
+
+	// An oversized message is rejected and the connection stays open.
+	if err := mllp.WriteMsg(c, large); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if nack := receiveAck(t, reader); !bytes.Contains(nack, []byte("MSA|AR|CTRL1")) {
+		t.Errorf("Got %q, want a NACK with MSA|AR|CTRL1", nack)
+	}
+	if err := mllp.WriteMsg(c, hl7Msg); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if ack := receiveAck(t, reader); !bytes.Equal(ack, cannedAck) {
+		t.Errorf("Got ack %v, want %v", ack, cannedAck)
+	}
+	c.Close()
+	waitForConnections(r, 1)
+	if !reflect.DeepEqual(s.msgs, [][]byte{hl7Msg}) {
+		t.Errorf("Sender got %q, want only the message within the limit", s.msgs)
+	}
+	testingutil.CheckMetrics(t, r.metrics.(*testingutil.FakeMonitoringClient), map[string]int64{oversizedMetric: 1, writesMetric: 1})
+}
+
+func TestFramingErrors(t *testing.T) {
+	s, r := setUp(t)
+	c := dial(t, r.port)
+	reader := mllp.NewMessageReader(c)
+	// Garbage before a message is skipped, a message with a bad trailer is
+	// discarded and the connection stays open.
+	if _, err := c.Write([]byte("junk\x0babcd\x1c\x0d\x0bbad\x1cx")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if ack := receiveAck(t, reader); !bytes.Equal(ack, cannedAck) {
+		t.Errorf("Got ack %v, want %v", ack, cannedAck)
+	}
+	if err := mllp.WriteMsg(c, cannedMsg); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if ack := receiveAck(t, reader); !bytes.Equal(ack, cannedAck) {
+		t.Errorf("Got ack %v, want %v", ack, cannedAck)
+	}
+	// A connection closed in the middle of a message is counted.
+	if _, err := c.Write([]byte("\x0bab")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	c.Close()
+	waitForConnections(r, 1)
+	if !reflect.DeepEqual(s.msgs, [][]byte{cannedMsg, cannedMsg}) {
+		t.Errorf("Sender got %q, want two copies of %q", s.msgs, cannedMsg)
+	}
+	testingutil.CheckMetrics(t, r.metrics.(*testingutil.FakeMonitoringClient), map[string]int64{
+		droppedBytesMetric: 2,
+		badTrailersMetric:  1,
+		truncatedMetric:    1,
+		writesMetric:       2,
+	})
+}
+
+func TestRelease2BadTrailer(t *testing.T) {
+	_, r := setUpWithOption(t, Option{Release: mllp.Release2})
+	c := dial(t, r.port)
+	defer c.Close()
+	if _, err := c.Write([]byte("\x0babcd\x1cx")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := mllp.NewMessageReader(c).NextCommit(); err != mllp.ErrCommitNAK {
+		t.Errorf("NextCommit() returned %v, want %v", err, mllp.ErrCommitNAK)
+	}
+}
+
+func TestLenient(t *testing.T) {
+	s, r := setUpWithOption(t, Option{Lenient: mllp.Leniency{AlternateTrailers: true, NormalizeSegments: true}})
+	c := dial(t, r.port)
+	reader := mllp.NewMessageReader(c)
+	if _, err := c.Write([]byte("\x0bMSH|1\nPID|2\x1c\n")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if ack := receiveAck(t, reader); !bytes.Equal(ack, cannedAck) {
+		t.Errorf("Got ack %v, want %v", ack, cannedAck)
+	}
+	c.Close()
+	waitForConnections(r, 1)
+	if want := [][]byte{[]byte("MSH|1\rPID|2")}; !reflect.DeepEqual(s.msgs, want) {
+		t.Errorf("Sender got %q, want %q", s.msgs, want)
+	}
+	testingutil.CheckMetrics(t, r.metrics.(*testingutil.FakeMonitoringClient), map[string]int64{
+		lenientMetricPrefix + string(mllp.LFTrailer):          1,
+		lenientMetricPrefix + string(mllp.SegmentTerminators): 1,
+		lenientMetricPrefix + string(mllp.MissingTrailer):     0,
+	})
+	peer := monitoring.Peer(c.LocalAddr())
+	if got := r.metrics.(*testingutil.FakeMonitoringClient).LabeledCounterValue(lenientMetricPrefix+string(mllp.LFTrailer), peer); got != 1 {
+		t.Errorf("%v%v for %v = %v, want 1", lenientMetricPrefix, mllp.LFTrailer, peer.Value, got)
+	}
+}
+
+func TestLenientBlocks(t *testing.T) {
+	lenient := mllp.Leniency{StartBlock: 0x02, EndBlock: 0x03}
+	s, r := setUpWithOption(t, Option{Lenient: lenient})
+	c := dial(t, r.port)
+	if _, err := c.Write([]byte("\x02MSH|1\x03\r")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	// The ACK is framed the way the partner frames its messages.
+	reader := mllp.NewMessageReaderWithOption(c, mllp.ReaderOption{Lenient: lenient})
+	if ack := receiveAck(t, reader); !bytes.Equal(ack, cannedAck) {
+		t.Errorf("Got ack %v, want %v", ack, cannedAck)
+	}
+	c.Close()
+	waitForConnections(r, 1)
+	if want := [][]byte{[]byte("MSH|1")}; !reflect.DeepEqual(s.msgs, want) {
+		t.Errorf("Sender got %q, want %q", s.msgs, want)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	testCases := []struct {
+		name  string
+		opt   Option
+		write []byte
+	}{
+		{"idle", Option{IdleTimeout: 50 * time.Millisecond}, nil},
+		{"unfinished message", Option{ReadTimeout: 50 * time.Millisecond}, []byte("\x0bab")},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, r := setUpWithOption(t, tc.opt)
+			c := dial(t, r.port)
+			defer c.Close()
+			if _, err := c.Write(tc.write); err != nil {
+				t.Fatalf("Failed to write: %v", err)
+			}
+			select {
+			case <-r.connClosed:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Connection was not closed")
+			}
+			testingutil.CheckMetrics(t, r.metrics.(*testingutil.FakeMonitoringClient), map[string]int64{timeoutsMetric: 1})
+		})
+	}
+}
+
+func TestShutdownDrainsConnections(t *testing.T) {
+	s, r := newReceiver(t, Option{})
+	s.started = make(chan struct{})
+	s.release = make(chan struct{})
+	runErr := make(chan error)
+	go func() { runErr <- r.Run() }()
+
+	busy := dial(t, r.port)
+	idle := dial(t, r.port)
+	if err := mllp.WriteMsg(busy, cannedMsg); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	<-s.started
+
+	shutdownErr := make(chan error)
+	go func() { shutdownErr <- r.Shutdown(context.Background()) }()
+	// The idle connection is closed without waiting for the busy one.
+	waitForConnections(r, 1)
+	if _, err := mllp.ReadMsg(idle); err == nil {
+		t.Errorf("Expected idle connection to be closed")
+	}
+
+	// The message in flight is still forwarded and ACKed.
+	close(s.release)
+	if ack, err := mllp.ReadMsg(busy); err != nil || !bytes.Equal(ack, cannedAck) {
+		t.Errorf("Got ACK %v, %v, want %v", ack, err, cannedAck)
+	}
+	waitForConnections(r, 1)
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Shutdown() returned %v", err)
+	}
+	if err := <-runErr; err != ErrReceiverClosed {
+		t.Errorf("Run() returned %v, want %v", err, ErrReceiverClosed)
+	}
+	if _, err := net.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(r.port))); err == nil {
+		t.Errorf("Expected new connections to be refused")
+	}
+	expected := [][]byte{cannedMsg}
+	if !reflect.DeepEqual(expected, s.msgs) {
+		t.Errorf("Messages differ: expected %v but got %v", expected, s.msgs)
+	}
+}
+
+func TestShutdownWithIdleTimeout(t *testing.T) {
+	_, r := setUpWithOption(t, Option{IdleTimeout: time.Hour})
+	c := dial(t, r.port)
+	defer c.Close()
+	// The connection is waiting for its second message when Shutdown starts.
+	if err := mllp.WriteMsg(c, cannedMsg); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if _, err := mllp.ReadMsg(c); err != nil {
+		t.Fatalf("Failed to read ACK: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdownErr := make(chan error)
+	go func() { shutdownErr <- r.Shutdown(ctx) }()
+	// The idle connection is woken up instead of waiting for its idle timeout
+	// or the end of ctx.
+	select {
+	case <-r.connClosed:
+	case <-ctx.Done():
+		t.Fatalf("Idle connection was not closed by Shutdown")
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Shutdown() returned %v", err)
+	}
+	// Being woken up is not a read timeout.
+	testingutil.CheckMetrics(t, r.metrics.(*testingutil.FakeMonitoringClient), map[string]int64{timeoutsMetric: 0})
+}
+
+func TestShutdownFinishesMessageBeingRead(t *testing.T) {
+	s, r := setUp(t)
+	c := dial(t, r.port)
+	defer c.Close()
+	if err := mllp.WriteMsg(c, cannedMsg); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if _, err := mllp.ReadMsg(c); err != nil {
+		t.Fatalf("Failed to read ACK: %v", err)
+	}
+	waitForIdle(t, r, true)
+	// Shutdown starts while the second message is arriving.
+	if _, err := c.Write(wrappedMsg[:3]); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	waitForIdle(t, r, false)
+	shutdownErr := make(chan error)
+	go func() { shutdownErr <- r.Shutdown(context.Background()) }()
+	if _, err := c.Write(wrappedMsg[3:]); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	if ack, err := mllp.ReadMsg(c); err != nil || !bytes.Equal(ack, cannedAck) {
+		t.Errorf("Got ACK %v, %v, want %v", ack, err, cannedAck)
+	}
+	waitForConnections(r, 1)
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Shutdown() returned %v", err)
+	}
+	if expected := [][]byte{cannedMsg, cannedMsg}; !reflect.DeepEqual(expected, s.msgs) {
+		t.Errorf("Messages differ: expected %v but got %v", expected, s.msgs)
+	}
+	testingutil.CheckMetrics(t, r.metrics.(*testingutil.FakeMonitoringClient), map[string]int64{timeoutsMetric: 0})
+}
+
+func TestSlowMessageWithIdleTimeout(t *testing.T) {
+	s, r := setUpWithOption(t, Option{IdleTimeout: 100 * time.Millisecond})
+	c := dial(t, r.port)
+	// The message takes longer than the idle timeout to arrive.
+	if _, err := c.Write(wrappedMsg[:3]); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, err := c.Write(wrappedMsg[3:]); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if ack, err := mllp.ReadMsg(c); err != nil || !bytes.Equal(ack, cannedAck) {
+		t.Errorf("Got ACK %v, %v, want %v", ack, err, cannedAck)
+	}
+	c.Close()
+	waitForConnections(r, 1)
+	if expected := [][]byte{cannedMsg}; !reflect.DeepEqual(expected, s.msgs) {
+		t.Errorf("Messages differ: expected %v but got %v", expected, s.msgs)
+	}
+	testingutil.CheckMetrics(t, r.metrics.(*testingutil.FakeMonitoringClient), map[string]int64{timeoutsMetric: 0})
+}
+
+// waitForIdle waits until the only connection of r is idle, or busy if idle
+// is false.
+func waitForIdle(t *testing.T, r *MLLPReceiver, idle bool) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		r.mu.Lock()
+		done := false
+		for _, v := range r.conns {
+			done = v == idle
+		}
+		r.mu.Unlock()
+		if done {
+			return
+		}
+	}
+	t.Fatalf("Connection did not become idle = %v", idle)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s, r := setUp(t)
+	s.started = make(chan struct{})
+	s.release = make(chan struct{})
+
+	c := dial(t, r.port)
+	if err := mllp.WriteMsg(c, cannedMsg); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	<-s.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	// The stuck connection has been closed under the partner.
+	if _, err := mllp.ReadMsg(c); err == nil {
+		t.Errorf("Expected connection to be closed")
+	}
+	// The message in flight is cancelled, which lets its handler finish.
+	select {
+	case <-r.connClosed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("The message in flight was not cancelled")
+	}
+}
+
 func dial(t *testing.T, port int) net.Conn {
 	c, err := net.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
 	if err != nil {
@@ -233,8 +807,8 @@ func dial(t *testing.T, port int) net.Conn {
 	return c
 }
 
-func receiveAck(t *testing.T, c net.Conn) []byte {
-	ack, err := mllp.ReadMsg(c)
+func receiveAck(t *testing.T, r *mllp.MessageReader) []byte {
+	ack, err := r.Next()
 	if err != nil {
 		t.Fatalf("Reading ack: %v", err)
 	}
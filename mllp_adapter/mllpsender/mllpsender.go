@@ -16,59 +16,282 @@
 package mllpsender
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	log "github.com/golang/glog"
 	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/mllp"
 	"github.com/GoogleCloudPlatform/mllp/shared/monitoring"
+	"github.com/GoogleCloudPlatform/mllp/shared/tracing"
 )
 
 const (
-	sentMetric      = "mllpsender-messages-sent"
-	ackErrorMetric  = "mllpsender-messages-ack-error"
-	sendErrorMetric = "mllpsender-messages-send-error"
-	dialErrorMetric = "mllpsender-connections-dial-error"
+	sentMetric          = "mllpsender-messages-sent"
+	ackErrorMetric      = "mllpsender-messages-ack-error"
+	sendErrorMetric     = "mllpsender-messages-send-error"
+	dialErrorMetric     = "mllpsender-connections-dial-error"
+	tlsErrorMetric      = "mllpsender-connections-dial-error-tls"
+	commitNAKMetric     = "mllpsender-messages-commit-nak"
+	commitTimeoutMetric = "mllpsender-messages-commit-timeout"
+	retransmitMetric    = "mllpsender-messages-retransmitted"
+	openedMetric        = "mllpsender-connections-opened"
+	staleMetric         = "mllpsender-connections-stale"
+	droppedBytesMetric  = "mllpsender-dropped-bytes"
+	badTrailerMetric    = "mllpsender-bad-trailers"
+	truncatedMetric     = "mllpsender-truncated-frames"
+
+	defaultCommitTimeout = 30 * time.Second
+	tlsHandshakeTimeout  = 30 * time.Second
 )
 
+// errCommitTimeout is returned when no commit acknowledgement arrives within
+// the commit timeout.
+var errCommitTimeout = errors.New("timed out waiting for commit acknowledgement")
+
+// Option contains optional settings for the MLLPSender.
+type Option struct {
+	// Release is the MLLP release spoken by the destination. Release 1 is used
+	// if unset.
+	Release mllp.Release
+	// CommitTimeout is how long to wait for a Release 2 commit acknowledgement
+	// before retransmitting. Defaults to 30 seconds.
+	CommitTimeout time.Duration
+	// MaxRetransmits is the number of times a message is resent after a
+	// Release 2 commit NAK or commit timeout.
+	MaxRetransmits int
+	// TLS, if set, is used to encrypt connections to the destination. If its
+	// ServerName is empty, the host from addr is used.
+	TLS *tls.Config
+	// PoolSize is the number of long-lived connections kept open to the
+	// destination. Each connection carries one message at a time so ACKs line
+	// up with their messages. If zero, a new connection is dialed for every
+	// message and closed once the ACK is read.
+	PoolSize int
+	// ACKTimeout bounds the wait for the HL7 ACK after a message is written,
+	// so that a half-open connection does not block forever. No timeout is
+	// applied if zero.
+	ACKTimeout time.Duration
+}
+
 // MLLPSender represents an MLLP sender.
 type MLLPSender struct {
-	addr    string
-	metrics monitoring.Client
+	addr           string
+	metrics        monitoring.Client
+	release        mllp.Release
+	commitTimeout  time.Duration
+	maxRetransmits int
+	tls            *tls.Config
+	ackTimeout     time.Duration
+	// slots holds the pooled connections, nil if pooling is disabled.
+	slots chan *slot
 }
 
 // NewSender creates a new MLLPSender.
-func NewSender(addr string, metrics monitoring.Client) *MLLPSender {
-	metrics.NewCounter(sentMetric, "Number of HL7 messages sent to mllp_addr")
+func NewSender(addr string, metrics monitoring.Client, opt Option) *MLLPSender {
+	metrics.NewCounter(sentMetric, "Number of HL7 messages sent to mllp_addr", monitoring.MessageTypeKey, monitoring.AckCodeKey)
 	metrics.NewCounter(ackErrorMetric, "Number of errors when receiving ACK from mllp_addr")
 	metrics.NewCounter(sendErrorMetric, "Number of errors when sending HL7 message to mllp_addr")
 	metrics.NewCounter(dialErrorMetric, "Number of errors when dialing to mllp_addr")
-	return &MLLPSender{addr: addr, metrics: metrics}
+	metrics.NewCounter(commitNAKMetric, "Number of MLLP Release 2 commit NAKs received from mllp_addr")
+	metrics.NewCounter(commitTimeoutMetric, "Number of MLLP Release 2 commit acknowledgements not received from mllp_addr in time")
+	metrics.NewCounter(retransmitMetric, "Number of HL7 messages retransmitted to mllp_addr")
+	metrics.NewCounter(tlsErrorMetric, "Number of failed TLS handshakes with mllp_addr")
+	metrics.NewCounter(openedMetric, "Number of connections opened to mllp_addr")
+	metrics.NewCounter(staleMetric, "Number of pooled connections to mllp_addr found closed or half-open")
+	metrics.NewCounter(droppedBytesMetric, "Number of times bytes before the start of a frame from mllp_addr were discarded")
+	metrics.NewCounter(badTrailerMetric, "Number of frames from mllp_addr whose end block was not followed by a carriage return")
+	metrics.NewCounter(truncatedMetric, "Number of connections to mllp_addr that ended in the middle of a frame")
+	commitTimeout := opt.CommitTimeout
+	if commitTimeout <= 0 {
+		commitTimeout = defaultCommitTimeout
+	}
+	tlsConfig := opt.TLS
+	if tlsConfig != nil && tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			tlsConfig.ServerName = host
+		}
+	}
+	m := &MLLPSender{
+		addr:           addr,
+		metrics:        metrics,
+		release:        opt.Release,
+		commitTimeout:  commitTimeout,
+		maxRetransmits: opt.MaxRetransmits,
+		tls:            tlsConfig,
+		ackTimeout:     opt.ACKTimeout,
+	}
+	if opt.PoolSize > 0 {
+		m.slots = make(chan *slot, opt.PoolSize)
+		for i := 0; i < opt.PoolSize; i++ {
+			m.slots <- &slot{}
+		}
+	}
+	return m
 }
 
-// Send sends an HL7 messages via MLLP.
-func (m *MLLPSender) Send(msg []byte) ([]byte, error) {
-	m.metrics.IncCounter(sentMetric)
+// Send sends an HL7 messages via MLLP. In Release 2 mode the message is
+// retransmitted if the destination answers with a commit NAK or does not
+// commit it in time. Sent messages are counted by message type and the code
+// of their ACK, which is "none" if there was no ACK. Each call is traced as
+// the mllp.send span. If ctx is done before the ACK arrives, the connection is
+// closed and ctx.Err() is returned.
+func (m *MLLPSender) Send(ctx context.Context, msg []byte) ([]byte, error) {
+	ctx, span := tracing.StartSpan(ctx, "mllp.send", msg, tracing.PeerKey.String(m.addr))
+	ack, err := m.send(ctx, msg)
+	for i := 0; i < m.maxRetransmits && (errors.Is(err, mllp.ErrCommitNAK) || errors.Is(err, errCommitTimeout)); i++ {
+		log.Warningf("MLLP Sender: retransmitting message: %v", err)
+		m.metrics.IncCounter(retransmitMetric)
+		span.AddEvent("retransmit")
+		ack, err = m.send(ctx, msg)
+	}
+	span.SetAttributes(tracing.AckAttributes(ack)...)
+	tracing.End(span, err)
+	m.metrics.IncCounter(sentMetric, monitoring.MessageType(msg), monitoring.AckCode(ack))
+	return ack, err
+}
 
-	conn, err := net.Dial("tcp", m.addr)
+// send makes a single attempt at delivering msg, either over a pooled
+// connection or over a new one that is closed afterwards.
+func (m *MLLPSender) send(ctx context.Context, msg []byte) ([]byte, error) {
+	if m.slots != nil {
+		return m.sendPooled(ctx, msg)
+	}
+	conn, err := m.dial(ctx)
 	if err != nil {
-		m.metrics.IncCounter(dialErrorMetric)
-		return nil, fmt.Errorf("dialing: %v", err)
+		return nil, err
 	}
 	defer func() {
 		if err := conn.Close(); err != nil {
 			log.Errorf("MLLP Sender: failed to clean up connection: %v", err)
 		}
 	}()
+	return m.exchange(ctx, conn, mllp.NewMessageReader(conn), msg)
+}
 
+// dial connects to the destination, performing the TLS handshake if enabled.
+func (m *MLLPSender) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		m.metrics.IncCounter(dialErrorMetric)
+		return nil, fmt.Errorf("dialing: %v", err)
+	}
+	m.metrics.IncCounter(openedMetric)
+	if m.tls == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, m.tls)
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		m.metrics.IncCounter(dialErrorMetric)
+		m.metrics.IncCounter(tlsErrorMetric)
+		return nil, fmt.Errorf("TLS handshake: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// exchange writes msg to conn and reads back its ACK. conn is closed if ctx is
+// done first.
+func (m *MLLPSender) exchange(ctx context.Context, conn net.Conn, reader *mllp.MessageReader, msg []byte) (ack []byte, err error) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer func() {
+		if !stop() && err != nil {
+			err = ctx.Err()
+		}
+	}()
 	if err := mllp.WriteMsg(conn, msg); err != nil {
 		m.metrics.IncCounter(sendErrorMetric)
 		return nil, fmt.Errorf("writing message: %v", err)
 	}
-	ack, err := mllp.ReadMsg(conn)
+	if m.release == mllp.Release2 {
+		if err := m.readCommit(conn, reader); err != nil {
+			return nil, err
+		}
+	}
+	deadline := time.Time{}
+	if m.ackTimeout > 0 {
+		deadline = time.Now().Add(m.ackTimeout)
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("setting ACK deadline: %v", err)
+	}
+	ack, err = m.next(reader)
 	if err != nil {
 		m.metrics.IncCounter(ackErrorMetric)
 		return nil, fmt.Errorf("reading ACK: %v", err)
 	}
+	if m.release == mllp.Release2 {
+		// The ACK is itself an HL7 message that we have to commit.
+		if err := mllp.WriteCommitACK(conn); err != nil {
+			log.Warningf("MLLP Sender: failed to commit ACK: %v", err)
+		}
+	}
 	return ack, nil
 }
+
+// readCommit waits up to the commit timeout for the destination to commit the
+// message just written to conn.
+func (m *MLLPSender) readCommit(conn net.Conn, reader *mllp.MessageReader) error {
+	if err := conn.SetReadDeadline(time.Now().Add(m.commitTimeout)); err != nil {
+		return fmt.Errorf("setting commit deadline: %v", err)
+	}
+	err := reader.NextCommit()
+	for m.skip(err) {
+		err = reader.NextCommit()
+	}
+	if err == mllp.ErrCommitNAK {
+		m.metrics.IncCounter(commitNAKMetric)
+		return fmt.Errorf("reading commit: %w", err)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		m.metrics.IncCounter(commitTimeoutMetric)
+		return errCommitTimeout
+	}
+	if err != nil {
+		m.metrics.IncCounter(ackErrorMetric)
+		return fmt.Errorf("reading commit: %v", err)
+	}
+	return nil
+}
+
+// next reads the next frame from reader. An ACK whose end block is not
+// followed by a carriage return is accepted, since it is complete.
+func (m *MLLPSender) next(reader *mllp.MessageReader) ([]byte, error) {
+	for {
+		msg, err := reader.Next()
+		if m.skip(err) {
+			continue
+		}
+		var trailer *mllp.TrailerError
+		if errors.As(err, &trailer) {
+			log.Warningf("MLLP Sender: accepting ACK from %v: %v", m.addr, err)
+			return msg, nil
+		}
+		return msg, err
+	}
+}
+
+// skip counts the framing errors of the mllp reader and reports whether err
+// only warns of bytes dropped before a frame, so that reading can go on.
+func (m *MLLPSender) skip(err error) bool {
+	var dropped *mllp.DroppedBytesError
+	var trailer *mllp.TrailerError
+	switch {
+	case errors.As(err, &dropped):
+		m.metrics.IncCounter(droppedBytesMetric)
+		log.Warningf("MLLP Sender: %v from %v", err, m.addr)
+		return true
+	case errors.As(err, &trailer):
+		m.metrics.IncCounter(badTrailerMetric)
+	case err == mllp.ErrTruncatedFrame:
+		m.metrics.IncCounter(truncatedMetric)
+	}
+	return false
+}
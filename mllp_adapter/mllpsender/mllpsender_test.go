@@ -16,12 +16,17 @@ package mllpsender
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"net"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/mllp"
+	"github.com/GoogleCloudPlatform/mllp/shared/monitoring"
 	"github.com/GoogleCloudPlatform/mllp/shared/testingutil"
+	"github.com/GoogleCloudPlatform/mllp/shared/tlsconfig"
 )
 
 var (
@@ -30,9 +35,13 @@ var (
 )
 
 func setUp() (*net.TCPListener, *MLLPSender, *testingutil.FakeMonitoringClient) {
+	return setUpWithOption(Option{})
+}
+
+func setUpWithOption(opt Option) (*net.TCPListener, *MLLPSender, *testingutil.FakeMonitoringClient) {
 	l, _ := net.Listen("tcp", "0.0.0.0:0")
 	metrics := testingutil.NewFakeMonitoringClient()
-	sender := NewSender(net.JoinHostPort("localhost", strconv.Itoa(l.Addr().(*net.TCPAddr).Port)), metrics)
+	sender := NewSender(net.JoinHostPort("localhost", strconv.Itoa(l.Addr().(*net.TCPAddr).Port)), metrics, opt)
 	return l.(*net.TCPListener), sender, metrics
 }
 
@@ -54,7 +63,7 @@ func TestOK(t *testing.T) {
 		received <- msg
 		conn.Close()
 	}()
-	ack, err := sender.Send(cannedMsg)
+	ack, err := sender.Send(context.Background(), cannedMsg)
 	if err != nil {
 		t.Errorf("Unexpected send error: %v", err)
 	}
@@ -72,7 +81,7 @@ func TestOK(t *testing.T) {
 func TestDialError(t *testing.T) {
 	listener, sender, metrics := setUp()
 	listener.Close()
-	if _, err := sender.Send(cannedMsg); err == nil {
+	if _, err := sender.Send(context.Background(), cannedMsg); err == nil {
 		t.Errorf("Expected send error")
 	}
 	testingutil.CheckMetrics(t, metrics, map[string]int64{sentMetric: 1, ackErrorMetric: 0, dialErrorMetric: 1})
@@ -85,10 +94,37 @@ func TestSendError(t *testing.T) {
 		mllp.ReadMsg(conn)
 		conn.Close()
 	}()
-	if _, err := sender.Send(cannedMsg); err == nil {
+	if _, err := sender.Send(context.Background(), cannedMsg); err == nil {
 		t.Errorf("Expected send error")
 	}
 	testingutil.CheckMetrics(t, metrics, map[string]int64{sentMetric: 1, ackErrorMetric: 1, dialErrorMetric: 0})
+	none := monitoring.Label{Key: monitoring.AckCodeKey, Value: monitoring.NoneValue}
+	if got := metrics.LabeledCounterValue(sentMetric, monitoring.MessageType(cannedMsg), none); got != 1 {
+		t.Errorf("%v{%v} = %v, want 1", sentMetric, none, got)
+	}
+}
+
+func TestSendCancelled(t *testing.T) {
+	listener, sender, _ := setUp()
+	closed := make(chan struct{})
+	go func() {
+		conn := accept(t, listener)
+		mllp.ReadMsg(conn)
+		// Never ACK, and wait for the sender to give up.
+		conn.Read(make([]byte, 1))
+		conn.Close()
+		close(closed)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := sender.Send(ctx, cannedMsg); err != context.DeadlineExceeded {
+		t.Errorf("Send() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Connection was not closed")
+	}
 }
 
 func TestRecoverAfterSendError(t *testing.T) {
@@ -102,15 +138,38 @@ func TestRecoverAfterSendError(t *testing.T) {
 		mllp.WriteMsg(conn, cannedAck)
 		conn.Close()
 	}()
-	if _, err := sender.Send(cannedMsg); err == nil {
+	if _, err := sender.Send(context.Background(), cannedMsg); err == nil {
 		t.Errorf("Expected send error")
 	}
-	if _, err := sender.Send(cannedMsg); err != nil {
+	if _, err := sender.Send(context.Background(), cannedMsg); err != nil {
 		t.Errorf("Unexpected send error: %v", err)
 	}
 	testingutil.CheckMetrics(t, metrics, map[string]int64{sentMetric: 2, ackErrorMetric: 1, dialErrorMetric: 0})
 }
 
+func TestFramingErrors(t *testing.T) {
+	listener, sender, metrics := setUp()
+	go func() {
+		conn := accept(t, listener)
+		mllp.ReadMsg(conn)
+		// Garbage, then an ACK with a bad trailer.
+		conn.Write([]byte("junk\x0back\x1cx"))
+		conn.Close()
+		conn = accept(t, listener)
+		mllp.ReadMsg(conn)
+		conn.Write([]byte("\x0bac"))
+		conn.Close()
+	}()
+	ack, err := sender.Send(context.Background(), cannedMsg)
+	if err != nil || !bytes.Equal(ack, cannedAck) {
+		t.Errorf("Send() = %q, %v, want %q, nil", ack, err, cannedAck)
+	}
+	if _, err := sender.Send(context.Background(), cannedMsg); err == nil {
+		t.Errorf("Send() with a truncated ACK succeeded, want error")
+	}
+	testingutil.CheckMetrics(t, metrics, map[string]int64{droppedBytesMetric: 1, badTrailerMetric: 1, truncatedMetric: 1, ackErrorMetric: 1})
+}
+
 func TestTwoMessages(t *testing.T) {
 	listener, sender, metrics := setUp()
 	go func() {
@@ -123,11 +182,139 @@ func TestTwoMessages(t *testing.T) {
 		mllp.WriteMsg(conn, cannedAck)
 		conn.Close()
 	}()
-	if _, err := sender.Send(cannedMsg); err != nil {
+	if _, err := sender.Send(context.Background(), cannedMsg); err != nil {
 		t.Errorf("Unexpected send error: %v", err)
 	}
-	if _, err := sender.Send(cannedMsg); err != nil {
+	if _, err := sender.Send(context.Background(), cannedMsg); err != nil {
 		t.Errorf("Unexpected send error: %v", err)
 	}
 	testingutil.CheckMetrics(t, metrics, map[string]int64{sentMetric: 2, ackErrorMetric: 0, dialErrorMetric: 0})
 }
+
+func TestRelease2RetransmitAfterNAK(t *testing.T) {
+	exp := testingutil.RecordSpans(t)
+	listener, sender, metrics := setUpWithOption(Option{Release: mllp.Release2, MaxRetransmits: 1})
+	committed := make(chan error)
+	go func() {
+		conn := accept(t, listener)
+		mllp.ReadMsg(conn)
+		mllp.WriteCommitNAK(conn)
+		conn.Close()
+		conn = accept(t, listener)
+		reader := mllp.NewMessageReader(conn)
+		reader.Next()
+		mllp.WriteCommitACK(conn)
+		mllp.WriteMsg(conn, cannedAck)
+		committed <- reader.NextCommit()
+		conn.Close()
+	}()
+	ack, err := sender.Send(context.Background(), cannedMsg)
+	if err != nil {
+		t.Fatalf("Unexpected send error: %v", err)
+	}
+	if !bytes.Equal(cannedAck, ack) {
+		t.Errorf("Expected ack %v, got %v", cannedAck, ack)
+	}
+	if err := <-committed; err != nil {
+		t.Errorf("Expected ACK to be committed, got %v", err)
+	}
+	testingutil.CheckMetrics(t, metrics, map[string]int64{sentMetric: 1, commitNAKMetric: 1, retransmitMetric: 1, ackErrorMetric: 0})
+	span, _ := testingutil.FindSpan(t, exp, "mllp.send")
+	if len(span.Events) != 1 || span.Events[0].Name != "retransmit" {
+		t.Errorf("mllp.send events = %v, want one retransmit", span.Events)
+	}
+}
+
+func TestRelease2CommitTimeout(t *testing.T) {
+	listener, sender, metrics := setUpWithOption(Option{Release: mllp.Release2, CommitTimeout: 50 * time.Millisecond, MaxRetransmits: 2})
+	// Hold every connection open without committing the message.
+	conns := make(chan net.Conn, 3)
+	go func() {
+		for i := 0; i < 3; i++ {
+			conn := accept(t, listener)
+			mllp.ReadMsg(conn)
+			conns <- conn
+		}
+	}()
+	if _, err := sender.Send(context.Background(), cannedMsg); err == nil {
+		t.Errorf("Expected send error")
+	}
+	for i := 0; i < 3; i++ {
+		(<-conns).Close()
+	}
+	testingutil.CheckMetrics(t, metrics, map[string]int64{sentMetric: 1, commitTimeoutMetric: 3, retransmitMetric: 2, ackErrorMetric: 0})
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := testingutil.NewCertificateAuthority(t)
+	serverCert, serverKey := ca.Issue(t, "partner")
+	serverTLS, err := tlsconfig.Server(tlsconfig.ServerOption{
+		CertFile:     testingutil.WriteFile(t, dir, "server.pem", serverCert),
+		KeyFile:      testingutil.WriteFile(t, dir, "server-key.pem", serverKey),
+		ClientCAFile: testingutil.WriteFile(t, dir, "ca.pem", ca.PEM),
+	})
+	if err != nil {
+		t.Fatalf("tlsconfig.Server: %v", err)
+	}
+	clientCert, clientKey := ca.Issue(t, "adapter")
+	clientTLS, err := tlsconfig.Client(tlsconfig.ClientOption{
+		CertFile: testingutil.WriteFile(t, dir, "client.pem", clientCert),
+		KeyFile:  testingutil.WriteFile(t, dir, "client-key.pem", clientKey),
+		CAFile:   testingutil.WriteFile(t, dir, "ca.pem", ca.PEM),
+	})
+	if err != nil {
+		t.Fatalf("tlsconfig.Client: %v", err)
+	}
+
+	listener, sender, metrics := setUpWithOption(Option{TLS: clientTLS})
+	received := make(chan []byte)
+	go func() {
+		conn := tls.Server(accept(t, listener), serverTLS)
+		msg, _ := mllp.ReadMsg(conn)
+		mllp.WriteMsg(conn, cannedAck)
+		received <- msg
+		conn.Close()
+	}()
+	ack, err := sender.Send(context.Background(), cannedMsg)
+	if err != nil {
+		t.Fatalf("Unexpected send error: %v", err)
+	}
+	if !bytes.Equal(cannedAck, ack) {
+		t.Errorf("Expected ack %v, got %v", cannedAck, ack)
+	}
+	if msg := <-received; !bytes.Equal(cannedMsg, msg) {
+		t.Errorf("Expected msg %v, got %v", cannedMsg, msg)
+	}
+	testingutil.CheckMetrics(t, metrics, map[string]int64{sentMetric: 1, dialErrorMetric: 0, tlsErrorMetric: 0})
+}
+
+func TestTLSHandshakeError(t *testing.T) {
+	dir := t.TempDir()
+	// The partner's certificate is signed by a CA the sender does not trust.
+	partnerCert, partnerKey := testingutil.NewCertificateAuthority(t).Issue(t, "partner")
+	serverTLS, err := tlsconfig.Server(tlsconfig.ServerOption{
+		CertFile: testingutil.WriteFile(t, dir, "server.pem", partnerCert),
+		KeyFile:  testingutil.WriteFile(t, dir, "server-key.pem", partnerKey),
+	})
+	if err != nil {
+		t.Fatalf("tlsconfig.Server: %v", err)
+	}
+	clientTLS, err := tlsconfig.Client(tlsconfig.ClientOption{
+		CAFile: testingutil.WriteFile(t, dir, "ca.pem", testingutil.NewCertificateAuthority(t).PEM),
+	})
+	if err != nil {
+		t.Fatalf("tlsconfig.Client: %v", err)
+	}
+
+	listener, sender, metrics := setUpWithOption(Option{TLS: clientTLS})
+	go func() {
+		conn := tls.Server(accept(t, listener), serverTLS)
+		conn.Handshake()
+		conn.Close()
+	}()
+	if _, err := sender.Send(context.Background(), cannedMsg); err == nil {
+		t.Errorf("Expected send error")
+	}
+	testingutil.CheckMetrics(t, metrics, map[string]int64{sentMetric: 1, dialErrorMetric: 1, tlsErrorMetric: 1})
+}
@@ -0,0 +1,167 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mllpsender
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/mllp"
+)
+
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = time.Minute
+	// livenessProbeTimeout is how long to wait for a pooled connection to
+	// report that the partner closed it before reusing it.
+	livenessProbeTimeout = time.Millisecond
+)
+
+// pooledConn is a long-lived connection to the destination.
+type pooledConn struct {
+	net.Conn
+	buf    *bufio.Reader
+	reader *mllp.MessageReader
+}
+
+func newPooledConn(conn net.Conn) *pooledConn {
+	buf := bufio.NewReader(conn)
+	return &pooledConn{Conn: conn, buf: buf, reader: mllp.NewMessageReader(buf)}
+}
+
+// alive reports whether the connection can carry another message. A
+// connection the partner has closed reads EOF straight away, and one with
+// unsolicited data pending would pair that data with our next message.
+func (c *pooledConn) alive() bool {
+	if err := c.SetReadDeadline(time.Now().Add(livenessProbeTimeout)); err != nil {
+		return false
+	}
+	_, err := c.buf.Peek(1)
+	if err == nil {
+		return false
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// slot is a place in the pool for one connection. Holding a slot gives
+// exclusive use of its connection.
+type slot struct {
+	// conn is nil until the first message is sent and after a failure.
+	conn *pooledConn
+	// backoff and retryAt delay reconnecting after a failed dial.
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// sendPooled sends msg over a pooled connection, waiting for one to be free.
+func (m *MLLPSender) sendPooled(ctx context.Context, msg []byte) ([]byte, error) {
+	var s *slot
+	select {
+	case s = <-m.slots:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { m.slots <- s }()
+
+	if err := m.connect(ctx, s); err != nil {
+		return nil, err
+	}
+	ack, err := m.exchange(ctx, s.conn, s.conn.reader, msg)
+	// After a commit NAK the connection is still in step and can be reused,
+	// any other failure leaves it in an unknown state. If ctx is done the
+	// connection may have been closed.
+	if (err != nil && !errors.Is(err, mllp.ErrCommitNAK)) || ctx.Err() != nil {
+		m.discard(s)
+	}
+	return ack, err
+}
+
+// connect makes sure s holds a live connection, reconnecting with
+// exponential backoff if the previous one was lost.
+func (m *MLLPSender) connect(ctx context.Context, s *slot) error {
+	if s.conn != nil {
+		if s.conn.alive() {
+			return nil
+		}
+		m.metrics.IncCounter(staleMetric)
+		log.Infof("MLLP Sender: pooled connection to %v was closed, reconnecting", m.addr)
+		m.discard(s)
+	}
+	if wait := time.Until(s.retryAt); wait > 0 {
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+	conn, err := m.dial(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			// The destination is not to blame.
+			return err
+		}
+		s.backoff = nextBackoff(s.backoff)
+		s.retryAt = time.Now().Add(s.backoff)
+		return err
+	}
+	s.conn, s.backoff, s.retryAt = newPooledConn(conn), 0, time.Time{}
+	return nil
+}
+
+// discard closes the connection held by s, if any.
+func (m *MLLPSender) discard(s *slot) {
+	if s.conn == nil {
+		return
+	}
+	if err := s.conn.Close(); err != nil {
+		log.Warningf("MLLP Sender: failed to clean up connection: %v", err)
+	}
+	s.conn = nil
+}
+
+// Close closes all pooled connections, waiting for messages in flight on
+// them to finish. The sender can still be used afterwards, in which case new
+// connections are dialed.
+func (m *MLLPSender) Close() {
+	if m.slots == nil {
+		return
+	}
+	var held []*slot
+	for i := 0; i < cap(m.slots); i++ {
+		s := <-m.slots
+		m.discard(s)
+		held = append(held, s)
+	}
+	for _, s := range held {
+		m.slots <- s
+	}
+}
+
+func nextBackoff(b time.Duration) time.Duration {
+	if b < minReconnectBackoff {
+		return minReconnectBackoff
+	}
+	if b *= 2; b > maxReconnectBackoff {
+		return maxReconnectBackoff
+	}
+	return b
+}
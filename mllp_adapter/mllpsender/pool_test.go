@@ -0,0 +1,156 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mllpsender
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/mllp"
+	"github.com/GoogleCloudPlatform/mllp/shared/testingutil"
+)
+
+func TestPoolReusesConnection(t *testing.T) {
+	listener, sender, metrics := setUpWithOption(Option{PoolSize: 1})
+	go func() {
+		conn := accept(t, listener)
+		reader := mllp.NewMessageReader(conn)
+		for i := 0; i < 3; i++ {
+			reader.Next()
+			mllp.WriteMsg(conn, cannedAck)
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		if _, err := sender.Send(context.Background(), cannedMsg); err != nil {
+			t.Fatalf("Unexpected send error: %v", err)
+		}
+	}
+	sender.Close()
+	testingutil.CheckMetrics(t, metrics, map[string]int64{sentMetric: 3, openedMetric: 1, staleMetric: 0})
+}
+
+func TestPoolReconnectsAfterPartnerClose(t *testing.T) {
+	listener, sender, metrics := setUpWithOption(Option{PoolSize: 1})
+	closed := make(chan struct{})
+	go func() {
+		conn := accept(t, listener)
+		mllp.ReadMsg(conn)
+		mllp.WriteMsg(conn, cannedAck)
+		conn.Close()
+		close(closed)
+		conn = accept(t, listener)
+		mllp.ReadMsg(conn)
+		mllp.WriteMsg(conn, cannedAck)
+	}()
+	if _, err := sender.Send(context.Background(), cannedMsg); err != nil {
+		t.Fatalf("Unexpected send error: %v", err)
+	}
+	<-closed
+	if _, err := sender.Send(context.Background(), cannedMsg); err != nil {
+		t.Fatalf("Unexpected send error: %v", err)
+	}
+	sender.Close()
+	testingutil.CheckMetrics(t, metrics, map[string]int64{sentMetric: 2, openedMetric: 2, staleMetric: 1, ackErrorMetric: 0})
+}
+
+func TestPoolSerializesMessagesPerConnection(t *testing.T) {
+	const poolSize, messages = 2, 10
+	listener, sender, metrics := setUpWithOption(Option{PoolSize: poolSize})
+	for i := 0; i < poolSize; i++ {
+		go func() {
+			conn := accept(t, listener)
+			reader := mllp.NewMessageReader(conn)
+			for {
+				msg, err := reader.Next()
+				if err != nil {
+					return
+				}
+				// Echo the message so each caller can check it got its own ACK.
+				mllp.WriteMsg(conn, msg)
+			}
+		}()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < messages; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := []byte{byte('a' + i)}
+			ack, err := sender.Send(context.Background(), msg)
+			if err != nil {
+				t.Errorf("Unexpected send error: %v", err)
+			}
+			if string(ack) != string(msg) {
+				t.Errorf("Got ACK %q for message %q", ack, msg)
+			}
+		}(i)
+	}
+	wg.Wait()
+	sender.Close()
+	testingutil.CheckMetrics(t, metrics, map[string]int64{sentMetric: messages, openedMetric: poolSize})
+}
+
+func TestPoolACKTimeout(t *testing.T) {
+	listener, sender, metrics := setUpWithOption(Option{PoolSize: 1, ACKTimeout: 50 * time.Millisecond})
+	go func() {
+		// Accept the message but never answer, like a half-open connection.
+		conn := accept(t, listener)
+		mllp.ReadMsg(conn)
+	}()
+	if _, err := sender.Send(context.Background(), cannedMsg); err == nil {
+		t.Errorf("Expected send error")
+	}
+	testingutil.CheckMetrics(t, metrics, map[string]int64{sentMetric: 1, ackErrorMetric: 1})
+}
+
+func TestPoolWaitCancelled(t *testing.T) {
+	listener, sender, _ := setUpWithOption(Option{PoolSize: 1})
+	go func() {
+		conn := accept(t, listener)
+		// Hold the only connection by never ACKing.
+		mllp.ReadMsg(conn)
+	}()
+	busyCtx, stopBusy := context.WithCancel(context.Background())
+	busy := make(chan struct{})
+	go func() {
+		sender.Send(busyCtx, cannedMsg)
+		close(busy)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := sender.Send(ctx, cannedMsg); err != context.DeadlineExceeded {
+		t.Errorf("Send() while the pool is busy = %v, want %v", err, context.DeadlineExceeded)
+	}
+	stopBusy()
+	<-busy
+	sender.Close()
+}
+
+func TestNextBackoff(t *testing.T) {
+	testCases := []struct {
+		in, want time.Duration
+	}{
+		{0, minReconnectBackoff},
+		{minReconnectBackoff, 2 * minReconnectBackoff},
+		{maxReconnectBackoff, maxReconnectBackoff},
+	}
+	for _, tc := range testCases {
+		if got := nextBackoff(tc.in); got != tc.want {
+			t.Errorf("nextBackoff(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package queue implements a durable on-disk queue that stores inbound HL7
+// messages before they are forwarded to the HL7v2 store, so that partners can
+// be acknowledged while the API is unavailable.
+package queue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/hl7ack"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/mllp"
+	"github.com/GoogleCloudPlatform/mllp/shared/monitoring"
+)
+
+const (
+	enqueuedMetric     = "receiver-queue-enqueued"
+	forwardedMetric    = "receiver-queue-forwarded"
+	forwardErrorMetric = "receiver-queue-forward-error"
+	replayedMetric     = "receiver-queue-replayed"
+	failedMetric       = "receiver-queue-failed"
+	depthMetric        = "receiver-queue-depth"
+	oldestAgeMetric    = "receiver-queue-oldest-age-seconds"
+	ageMetric          = "receiver-queue-age"
+
+	msgSuffix = ".msg"
+	tmpSuffix = ".tmp"
+	// failedDir is the subdirectory that messages are moved to once they are
+	// rejected or run out of attempts.
+	failedDir = "failed"
+
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = time.Minute
+)
+
+// The sender interface represents the destination to which queued messages
+// are forwarded, one at a time.
+type sender interface {
+	Send(context.Context, []byte) ([]byte, error)
+}
+
+// Option contains optional settings for the Queue.
+type Option struct {
+	// Release is the MLLP release spoken by the partners whose messages are
+	// queued. In Release 2 mode Send returns no ACK, because the commit ACK
+	// written by the receiver already tells the partner that the message is
+	// safe. Otherwise Send returns a locally generated accept ACK (AA).
+	Release mllp.Release
+	// MaxAttempts is the number of times a message is sent before it is moved
+	// to the failed subdirectory. If zero, messages are retried forever.
+	MaxAttempts int
+	// MinBackoff and MaxBackoff bound the exponential backoff between failed
+	// attempts. They default to one second and one minute.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// entry is a message waiting in the queue.
+type entry struct {
+	seq      uint64
+	enqueued time.Time
+	attempts int
+}
+
+// Queue is a write-ahead queue of HL7 messages backed by a directory, one file
+// per message. Messages are forwarded in the order they were enqueued.
+type Queue struct {
+	dir         string
+	sender      sender
+	metrics     monitoring.Client
+	release     mllp.Release
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	// mu guards next and pending.
+	mu      sync.Mutex
+	next    uint64
+	pending []*entry
+	// wake is signalled when a message is enqueued.
+	wake chan struct{}
+}
+
+// New opens the queue in dir, creating the directory if needed. Messages left
+// over from a previous run are forwarded again once Run is called.
+func New(dir string, sender sender, mt monitoring.Client, opt Option) (*Queue, error) {
+	if err := os.MkdirAll(filepath.Join(dir, failedDir), 0700); err != nil {
+		return nil, fmt.Errorf("creating queue directory: %v", err)
+	}
+	mt.NewCounter(enqueuedMetric, "Number of HL7 messages written to the local queue")
+	mt.NewCounter(forwardedMetric, "Number of queued HL7 messages forwarded to the HL7v2 store")
+	mt.NewCounter(forwardErrorMetric, "Number of failed attempts to forward a queued HL7 message")
+	mt.NewCounter(replayedMetric, "Number of queued HL7 messages found on disk at startup")
+	mt.NewCounter(failedMetric, "Number of queued HL7 messages rejected by the HL7v2 store or given up on after too many attempts")
+	mt.NewGauge(depthMetric, "Number of HL7 messages waiting in the local queue")
+	mt.NewGauge(oldestAgeMetric, "Age in seconds of the oldest HL7 message waiting in the local queue")
+	mt.NewLatency(ageMetric, "The latency between \"HL7 message queued\" to \"HL7 message written to HL7v2 store\"")
+
+	minBackoff := opt.MinBackoff
+	if minBackoff <= 0 {
+		minBackoff = defaultMinBackoff
+	}
+	maxBackoff := opt.MaxBackoff
+	if maxBackoff < minBackoff {
+		maxBackoff = defaultMaxBackoff
+	}
+	q := &Queue{
+		dir:         dir,
+		sender:      sender,
+		metrics:     mt,
+		release:     opt.Release,
+		maxAttempts: opt.MaxAttempts,
+		minBackoff:  minBackoff,
+		maxBackoff:  maxBackoff,
+		wake:        make(chan struct{}, 1),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// load reads the messages left in the queue directory by a previous run.
+func (q *Queue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("reading queue directory: %v", err)
+	}
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasSuffix(name, tmpSuffix) {
+			// The write never completed, so the partner was never ACKed.
+			if err := os.Remove(filepath.Join(q.dir, name)); err != nil {
+				log.Warningf("Queue: failed to remove partial message %v: %v", name, err)
+			}
+			continue
+		}
+		if f.IsDir() || !strings.HasSuffix(name, msgSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, msgSuffix), 10, 64)
+		if err != nil {
+			log.Warningf("Queue: ignoring unexpected file %v", name)
+			continue
+		}
+		q.pending = append(q.pending, &entry{seq: seq, enqueued: f.ModTime()})
+		if seq >= q.next {
+			q.next = seq + 1
+		}
+		q.metrics.IncCounter(replayedMetric)
+	}
+	sort.Slice(q.pending, func(i, j int) bool { return q.pending[i].seq < q.pending[j].seq })
+	if len(q.pending) > 0 {
+		log.Infof("Queue: replaying %d messages from %v", len(q.pending), q.dir)
+	}
+	q.updateGauges()
+	return nil
+}
+
+// Send persists msg and returns the ACK for the partner. The message is
+// forwarded to the HL7v2 store later by Run, with the context given to Run.
+func (q *Queue) Send(ctx context.Context, msg []byte) ([]byte, error) {
+	var ack []byte
+	if q.release != mllp.Release2 {
+		var err error
+		if ack, err = hl7ack.Build(msg, hl7ack.ApplicationAccept, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	q.mu.Lock()
+	seq := q.next
+	q.next++
+	q.mu.Unlock()
+
+	if err := q.write(seq, msg); err != nil {
+		return nil, fmt.Errorf("queueing message: %v", err)
+	}
+
+	q.mu.Lock()
+	q.pending = append(q.pending, &entry{seq: seq, enqueued: time.Now()})
+	// Concurrent writers may finish out of order.
+	sort.Slice(q.pending, func(i, j int) bool { return q.pending[i].seq < q.pending[j].seq })
+	q.updateGauges()
+	q.mu.Unlock()
+	q.metrics.IncCounter(enqueuedMetric)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return ack, nil
+}
+
+// write stores msg under seq, so that it is either complete on disk or absent
+// after a crash.
+func (q *Queue) write(seq uint64, msg []byte) error {
+	tmp := q.path(seq) + tmpSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(msg); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, q.path(seq)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(q.dir)
+}
+
+// Run forwards queued messages until ctx is done. A message that cannot be
+// forwarded is retried with exponential backoff and holds back the messages
+// behind it, so that they reach the HL7v2 store in order.
+func (q *Queue) Run(ctx context.Context) {
+	var backoff time.Duration
+	for ctx.Err() == nil {
+		e := q.head()
+		if e == nil {
+			select {
+			case <-ctx.Done():
+			case <-q.wake:
+			}
+			continue
+		}
+		if err := q.forward(ctx, e); err != nil {
+			if ctx.Err() != nil {
+				// The message is forwarded after the next start.
+				return
+			}
+			backoff = q.nextBackoff(backoff)
+			log.Warningf("Queue: failed to forward message %d (attempt %d), retrying in %v: %v", e.seq, e.attempts, backoff, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		backoff = 0
+	}
+}
+
+// Len returns the number of messages waiting in the queue.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+func (q *Queue) head() *entry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.updateGauges()
+	if len(q.pending) == 0 {
+		return nil
+	}
+	return q.pending[0]
+}
+
+// forward makes one attempt at sending e. It returns an error if e should be
+// retried. An attempt cut short by ctx does not count. A message that is not
+// accepted (AA or CA) is moved to the failed subdirectory, since its partner
+// was already ACKed and cannot resend it.
+func (q *Queue) forward(ctx context.Context, e *entry) error {
+	msg, err := ioutil.ReadFile(q.path(e.seq))
+	if err != nil {
+		log.Errorf("Queue: failed to read message %d, moving it to %v: %v", e.seq, failedDir, err)
+		q.fail(e)
+		return nil
+	}
+	ack, err := q.sender.Send(ctx, msg)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		e.attempts++
+		q.metrics.IncCounter(forwardErrorMetric)
+		if q.maxAttempts > 0 && e.attempts >= q.maxAttempts {
+			log.Errorf("Queue: giving up on message %d after %d attempts, moving it to %v: %v", e.seq, e.attempts, failedDir, err)
+			q.fail(e)
+			return nil
+		}
+		return err
+	}
+	if code, err := hl7ack.ParseCode(ack); err != nil || !code.Accepted() {
+		log.Errorf("Queue: message %d was not accepted (code %q, error %v), moving it to %v", e.seq, code, err, failedDir)
+		q.fail(e)
+		return nil
+	}
+	if err := os.Remove(q.path(e.seq)); err != nil {
+		log.Errorf("Queue: failed to remove forwarded message %d: %v", e.seq, err)
+	}
+	q.metrics.IncCounter(forwardedMetric)
+	q.metrics.AddLatency(ageMetric, float64(time.Since(e.enqueued).Milliseconds()))
+	q.remove(e)
+	return nil
+}
+
+// fail moves e out of the queue into the failed subdirectory.
+func (q *Queue) fail(e *entry) {
+	q.metrics.IncCounter(failedMetric)
+	if err := os.Rename(q.path(e.seq), filepath.Join(q.dir, failedDir, filepath.Base(q.path(e.seq)))); err != nil {
+		log.Errorf("Queue: failed to move message %d to %v: %v", e.seq, failedDir, err)
+	}
+	q.remove(e)
+}
+
+// remove drops e from pending. It is not necessarily still the head, since a
+// concurrent Send with a lower sequence number may have finished after it.
+func (q *Queue) remove(e *entry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, p := range q.pending {
+		if p == e {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			break
+		}
+	}
+	q.updateGauges()
+}
+
+// updateGauges must be called with mu held.
+func (q *Queue) updateGauges() {
+	q.metrics.SetGauge(depthMetric, int64(len(q.pending)))
+	var age time.Duration
+	if len(q.pending) > 0 {
+		age = time.Since(q.pending[0].enqueued)
+	}
+	q.metrics.SetGauge(oldestAgeMetric, int64(age.Seconds()))
+}
+
+func (q *Queue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%v", seq, msgSuffix))
+}
+
+func (q *Queue) nextBackoff(b time.Duration) time.Duration {
+	if b < q.minBackoff {
+		return q.minBackoff
+	}
+	if b *= 2; b > q.maxBackoff {
+		return q.maxBackoff
+	}
+	return b
+}
+
+// syncDir flushes a directory entry change, such as a rename, to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
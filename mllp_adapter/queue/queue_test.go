@@ -0,0 +1,279 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/hl7ack"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/mllp"
+	"github.com/GoogleCloudPlatform/mllp/shared/testingutil"
+)
+
+var (
+	msg1 = []byte("MSH|^~\\&|A|B|C|D|20180101000000||ADT^A01^ADT_A01|1|P|2.5\r")
+	msg2 = []byte("MSH|^~\\&|A|B|C|D|20180101000000||ADT^A01^ADT_A01|2|P|2.5\r")
+)
+
+type fakeSender struct {
+	mu   sync.Mutex
+	msgs [][]byte
+	// failures is the number of upcoming Send calls that return an error.
+	failures int
+	// sent receives a message after every Send call.
+	sent chan struct{}
+	// If block is set, Send fails once ctx is done.
+	block bool
+	// code is the acknowledgment code of the returned ACKs, AA if empty.
+	code hl7ack.Code
+}
+
+func newFakeSender() *fakeSender {
+	return &fakeSender{sent: make(chan struct{}, 10)}
+}
+
+func (s *fakeSender) Send(ctx context.Context, msg []byte) ([]byte, error) {
+	defer func() { s.sent <- struct{}{} }()
+	if s.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return nil, fmt.Errorf("send error")
+	}
+	s.msgs = append(s.msgs, msg)
+	code := s.code
+	if code == "" {
+		code = hl7ack.ApplicationAccept
+	}
+	return hl7ack.Build(msg, code, "")
+}
+
+func (s *fakeSender) messages() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.msgs
+}
+
+func newQueue(t *testing.T, dir string, s *fakeSender, opt Option) (*Queue, *testingutil.FakeMonitoringClient) {
+	t.Helper()
+	mt := testingutil.NewFakeMonitoringClient()
+	opt.MinBackoff = time.Millisecond
+	opt.MaxBackoff = time.Millisecond
+	q, err := New(dir, s, mt, opt)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return q, mt
+}
+
+// run runs q until the sender has been called n times.
+func run(q *Queue, s *fakeSender, n int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(done)
+	}()
+	for i := 0; i < n; i++ {
+		<-s.sent
+	}
+	cancel()
+	<-done
+}
+
+func TestForward(t *testing.T) {
+	s := newFakeSender()
+	q, mt := newQueue(t, t.TempDir(), s, Option{})
+	for _, m := range [][]byte{msg1, msg2} {
+		ack, err := q.Send(context.Background(), m)
+		if err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		if code, err := hl7ack.ParseCode(ack); err != nil || code != hl7ack.ApplicationAccept {
+			t.Errorf("Send returned ACK %q, want an AA ACK", ack)
+		}
+	}
+	if got := mt.GaugeValue(depthMetric); got != 2 {
+		t.Errorf("%v = %v, want 2", depthMetric, got)
+	}
+
+	run(q, s, 2)
+	if want := [][]byte{msg1, msg2}; !reflect.DeepEqual(s.messages(), want) {
+		t.Errorf("Forwarded %q, want %q", s.messages(), want)
+	}
+	if q.Len() != 0 {
+		t.Errorf("Len() = %v, want 0", q.Len())
+	}
+	testingutil.CheckMetrics(t, mt, map[string]int64{enqueuedMetric: 2, forwardedMetric: 2})
+	if got := mt.GaugeValue(depthMetric); got != 0 {
+		t.Errorf("%v = %v, want 0", depthMetric, got)
+	}
+}
+
+func TestRelease2ReturnsNoACK(t *testing.T) {
+	q, _ := newQueue(t, t.TempDir(), newFakeSender(), Option{Release: mllp.Release2})
+	ack, err := q.Send(context.Background(), msg1)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if ack != nil {
+		t.Errorf("Send returned ACK %q, want none", ack)
+	}
+}
+
+func TestSendRejectsMessageWithoutMSH(t *testing.T) {
+	q, _ := newQueue(t, t.TempDir(), newFakeSender(), Option{})
+	if _, err := q.Send(context.Background(), []byte("garbage")); err == nil {
+		t.Errorf("Send succeeded, want error")
+	}
+	if q.Len() != 0 {
+		t.Errorf("Len() = %v, want 0", q.Len())
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	s := newFakeSender()
+	q, _ := newQueue(t, dir, s, Option{})
+	for _, m := range [][]byte{msg1, msg2} {
+		if _, err := q.Send(context.Background(), m); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	// A write that was interrupted by a crash is discarded.
+	testingutil.WriteFile(t, dir, "00000000000000000005.msg.tmp", []byte("partial"))
+
+	q, mt := newQueue(t, dir, s, Option{})
+	if q.Len() != 2 {
+		t.Fatalf("Len() = %v after reopening, want 2", q.Len())
+	}
+	testingutil.CheckMetrics(t, mt, map[string]int64{replayedMetric: 2})
+
+	// New messages go behind the replayed ones.
+	if _, err := q.Send(context.Background(), msg1); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	run(q, s, 3)
+	if want := [][]byte{msg1, msg2, msg1}; !reflect.DeepEqual(s.messages(), want) {
+		t.Errorf("Forwarded %q, want %q", s.messages(), want)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(files) != 1 || files[0].Name() != failedDir {
+		t.Errorf("Queue directory contains %v, want only %v", files, failedDir)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	s := newFakeSender()
+	s.failures = 2
+	q, mt := newQueue(t, t.TempDir(), s, Option{})
+	if _, err := q.Send(context.Background(), msg1); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := q.Send(context.Background(), msg2); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	run(q, s, 4)
+	// The failing message holds back the one behind it.
+	if want := [][]byte{msg1, msg2}; !reflect.DeepEqual(s.messages(), want) {
+		t.Errorf("Forwarded %q, want %q", s.messages(), want)
+	}
+	testingutil.CheckMetrics(t, mt, map[string]int64{forwardErrorMetric: 2, forwardedMetric: 2, failedMetric: 0})
+}
+
+func TestMaxAttempts(t *testing.T) {
+	dir := t.TempDir()
+	s := newFakeSender()
+	s.failures = 2
+	q, mt := newQueue(t, dir, s, Option{MaxAttempts: 2})
+	if _, err := q.Send(context.Background(), msg1); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := q.Send(context.Background(), msg2); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	run(q, s, 3)
+	if want := [][]byte{msg2}; !reflect.DeepEqual(s.messages(), want) {
+		t.Errorf("Forwarded %q, want %q", s.messages(), want)
+	}
+	testingutil.CheckMetrics(t, mt, map[string]int64{forwardErrorMetric: 2, forwardedMetric: 1, failedMetric: 1})
+	failed, err := ioutil.ReadFile(filepath.Join(dir, failedDir, "00000000000000000000.msg"))
+	if err != nil {
+		t.Fatalf("Reading failed message: %v", err)
+	}
+	if string(failed) != string(msg1) {
+		t.Errorf("Failed message is %q, want %q", failed, msg1)
+	}
+}
+
+func TestRejected(t *testing.T) {
+	dir := t.TempDir()
+	s := newFakeSender()
+	s.code = hl7ack.ApplicationError
+	q, mt := newQueue(t, dir, s, Option{})
+	if _, err := q.Send(context.Background(), msg1); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	run(q, s, 1)
+	if q.Len() != 0 {
+		t.Errorf("Len() = %v, want 0", q.Len())
+	}
+	testingutil.CheckMetrics(t, mt, map[string]int64{forwardedMetric: 0, failedMetric: 1})
+	failed, err := ioutil.ReadFile(filepath.Join(dir, failedDir, "00000000000000000000.msg"))
+	if err != nil {
+		t.Fatalf("Reading rejected message: %v", err)
+	}
+	if string(failed) != string(msg1) {
+		t.Errorf("Rejected message is %q, want %q", failed, msg1)
+	}
+}
+
+func TestStopDuringForward(t *testing.T) {
+	s := newFakeSender()
+	s.block = true
+	q, mt := newQueue(t, t.TempDir(), s, Option{MaxAttempts: 1})
+	if _, err := q.Send(context.Background(), msg1); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	q.Run(ctx)
+	if len(s.sent) != 1 {
+		t.Fatalf("Sender was called %v times, want 1", len(s.sent))
+	}
+	// The interrupted attempt does not count against MaxAttempts.
+	if got := q.Len(); got != 1 {
+		t.Errorf("Len() = %v, want 1", got)
+	}
+	testingutil.CheckMetrics(t, mt, map[string]int64{forwardErrorMetric: 0, failedMetric: 0})
+}
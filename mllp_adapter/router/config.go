@@ -0,0 +1,82 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	// UnmatchedDefault sends unmatched messages to the default store.
+	UnmatchedDefault = "default"
+	// UnmatchedNACK answers unmatched messages with a NACK.
+	UnmatchedNACK = "nack"
+)
+
+// Config is a routing table, usually read from a JSON file such as:
+//
+//	{
+//	  "routes": [{
+//	    "name": "research",
+//	    "match": {"sending_facility": "LAB", "message_type": "ORU"},
+//	    "store": {"project_id": "p", "location_id": "l", "dataset_id": "research", "hl7_v2_store_id": "s"}
+//	  }],
+//	  "unmatched": "nack"
+//	}
+type Config struct {
+	Routes []RouteConfig `json:"routes"`
+	// Unmatched is UnmatchedDefault (the default) or UnmatchedNACK.
+	Unmatched string `json:"unmatched"`
+}
+
+// RouteConfig describes a route to an HL7v2 store.
+type RouteConfig struct {
+	Name  string `json:"name"`
+	Match Match  `json:"match"`
+	Store Store  `json:"store"`
+}
+
+// Store identifies an HL7v2 store.
+type Store struct {
+	ProjectID    string `json:"project_id"`
+	LocationID   string `json:"location_id"`
+	DatasetID    string `json:"dataset_id"`
+	HL7V2StoreID string `json:"hl7_v2_store_id"`
+}
+
+// LoadConfig reads a routing table from a JSON file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading routes: %v", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	c := &Config{}
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("parsing routes: %v", err)
+	}
+	switch c.Unmatched {
+	case "":
+		c.Unmatched = UnmatchedDefault
+	case UnmatchedDefault, UnmatchedNACK:
+	default:
+		return nil, fmt.Errorf("invalid unmatched %q, want %q or %q", c.Unmatched, UnmatchedDefault, UnmatchedNACK)
+	}
+	return c, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/mllp/shared/testingutil"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := testingutil.WriteFile(t, t.TempDir(), "routes.json", []byte(`{
+  "routes": [{
+    "name": "research",
+    "match": {"sending_facility": "LAB", "message_type": "ORU"},
+    "store": {"project_id": "p", "location_id": "l", "dataset_id": "d", "hl7_v2_store_id": "s"}
+  }]
+}`))
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	want := &Config{
+		Routes: []RouteConfig{{
+			Name:  "research",
+			Match: Match{SendingFacility: "LAB", MessageType: "ORU"},
+			Store: Store{ProjectID: "p", LocationID: "l", DatasetID: "d", HL7V2StoreID: "s"},
+		}},
+		Unmatched: UnmatchedDefault,
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("LoadConfig() = %+v, want %+v", c, want)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"syntax.json":    `{"routes": [`,
+		"unknown.json":   `{"routes": [{"name": "a", "match": {"sending_fac": "LAB"}}]}`,
+		"unmatched.json": `{"unmatched": "drop"}`,
+	} {
+		if _, err := LoadConfig(testingutil.WriteFile(t, dir, name, []byte(content))); err == nil {
+			t.Errorf("LoadConfig(%v) succeeded, want error", name)
+		}
+	}
+	if _, err := LoadConfig(dir + "/missing.json"); err == nil {
+		t.Errorf("LoadConfig() of a missing file succeeded, want error")
+	}
+}
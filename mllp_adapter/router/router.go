@@ -0,0 +1,153 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package router sends inbound HL7 messages to one of several destinations,
+// chosen by the fields of their MSH segment.
+package router
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/hl7ack"
+	"github.com/GoogleCloudPlatform/mllp/shared/hl7"
+	"github.com/GoogleCloudPlatform/mllp/shared/monitoring"
+)
+
+const (
+	unmatchedMetric  = "router-unmatched"
+	routedMetric     = "router-routed"
+	routeErrorMetric = "router-error"
+
+	// defaultRoute is the name under which the default route is reported.
+	defaultRoute  = "default"
+	noRouteReason = "No destination is configured for the message"
+)
+
+// Sender is a destination for routed messages.
+type Sender interface {
+	Send(context.Context, []byte) ([]byte, error)
+}
+
+// Match selects messages by fields of their MSH segment. Empty criteria match
+// any message. A criterion matches a field if its components equal the
+// leading components of the field, so "ADT" matches the message type
+// "ADT^A01^ADT_A01" and "LAB" matches the facility "LAB^1.2.3^ISO".
+type Match struct {
+	SendingApplication   string `json:"sending_application"`
+	SendingFacility      string `json:"sending_facility"`
+	ReceivingApplication string `json:"receiving_application"`
+	ReceivingFacility    string `json:"receiving_facility"`
+	MessageType          string `json:"message_type"`
+	ProcessingID         string `json:"processing_id"`
+}
+
+// Route sends the messages selected by Match to Sender.
+type Route struct {
+	Name   string
+	Match  Match
+	Sender Sender
+}
+
+// Router sends each message to the first route that matches it.
+type Router struct {
+	routes  []Route
+	def     Sender
+	metrics monitoring.Client
+}
+
+// New creates a Router. Messages that match none of routes are sent to def,
+// or answered with a locally built NACK (AR) if def is nil.
+func New(routes []Route, def Sender, mt monitoring.Client) (*Router, error) {
+	names := map[string]bool{defaultRoute: true}
+	for _, r := range routes {
+		if r.Name == "" || names[r.Name] {
+			return nil, fmt.Errorf("route names must be unique and not empty or %q, got %q", defaultRoute, r.Name)
+		}
+		names[r.Name] = true
+	}
+	mt.NewCounter(unmatchedMetric, "Number of HL7 messages that matched no route and were NACKed")
+	mt.NewCounter(routedMetric, "Number of HL7 messages sent to each route", monitoring.RouteKey)
+	mt.NewCounter(routeErrorMetric, "Number of errors when sending HL7 messages to each route", monitoring.RouteKey)
+	return &Router{routes: routes, def: def, metrics: mt}, nil
+}
+
+// Send sends msg to the destination selected by its MSH segment and returns
+// the ACK.
+func (r *Router) Send(ctx context.Context, msg []byte) ([]byte, error) {
+	name, s := r.route(msg)
+	if s == nil {
+		r.metrics.IncCounter(unmatchedMetric)
+		log.Warningf("Router: no route for message, sending NACK")
+		return hl7ack.Build(msg, hl7ack.ApplicationReject, noRouteReason)
+	}
+	r.metrics.IncCounter(routedMetric, monitoring.Route(name))
+	ack, err := s.Send(ctx, msg)
+	if err != nil {
+		r.metrics.IncCounter(routeErrorMetric, monitoring.Route(name))
+	}
+	return ack, err
+}
+
+// route returns the name and destination of the route for msg. Messages that
+// cannot be parsed can only take the default route.
+func (r *Router) route(msg []byte) (string, Sender) {
+	parsed, err := hl7.Parse(msg)
+	if err == nil {
+		for _, route := range r.routes {
+			if route.Match.matches(parsed) {
+				return route.Name, route.Sender
+			}
+		}
+	}
+	return defaultRoute, r.def
+}
+
+func (m Match) matches(msg *hl7.Message) bool {
+	for loc, want := range map[string]string{
+		"MSH-3":  m.SendingApplication,
+		"MSH-4":  m.SendingFacility,
+		"MSH-5":  m.ReceivingApplication,
+		"MSH-6":  m.ReceivingFacility,
+		"MSH-9":  m.MessageType,
+		"MSH-11": m.ProcessingID,
+	} {
+		if want == "" {
+			continue
+		}
+		got, _ := msg.Get(loc)
+		if !prefixMatch(want, got, msg.Delimiters.Component) {
+			return false
+		}
+	}
+	return true
+}
+
+// prefixMatch reports whether the components of want, written with "^",
+// equal the leading components of got.
+func prefixMatch(want, got string, sep byte) bool {
+	w := strings.Split(want, "^")
+	g := strings.Split(got, string(sep))
+	if len(w) > len(g) {
+		return false
+	}
+	for i := range w {
+		if w[i] != g[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/mllp/shared/monitoring"
+	"github.com/GoogleCloudPlatform/mllp/shared/testingutil"
+)
+
+type fakeSender struct {
+	name string
+	msgs [][]byte
+	err  error
+}
+
+func (s *fakeSender) Send(ctx context.Context, msg []byte) ([]byte, error) {
+	s.msgs = append(s.msgs, msg)
+	return []byte("ack from " + s.name), s.err
+}
+
+func hl7Msg(sendingFacility, msgType, processingID string) []byte {
+	return []byte(fmt.Sprintf("MSH|^~\\&|APP|%v|RECV|RECVFAC|20180101000000||%v|CTRL1|%v|2.5\r", sendingFacility, msgType, processingID))
+}
+
+func TestRoute(t *testing.T) {
+	research := &fakeSender{name: "research"}
+	clinical := &fakeSender{name: "clinical"}
+	def := &fakeSender{name: "default"}
+	mt := testingutil.NewFakeMonitoringClient()
+	r, err := New([]Route{
+		{Name: "research", Match: Match{SendingFacility: "LAB", MessageType: "ORU"}, Sender: research},
+		{Name: "clinical", Match: Match{MessageType: "ADT^A01", ProcessingID: "P"}, Sender: clinical},
+	}, def, mt)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	testCases := []struct {
+		name string
+		msg  []byte
+		want string
+	}{
+		{"facility and type", hl7Msg("LAB^1.2.3^ISO", "ORU^R01^ORU_R01", "P"), "research"},
+		{"type and trigger", hl7Msg("WARD", "ADT^A01^ADT_A01", "P"), "clinical"},
+		{"other trigger", hl7Msg("WARD", "ADT^A08^ADT_A01", "P"), "default"},
+		{"other processing ID", hl7Msg("WARD", "ADT^A01^ADT_A01", "T"), "default"},
+		{"facility prefix only", hl7Msg("LABX", "ORU^R01", "P"), "default"},
+		{"unparsable", []byte("garbage"), "default"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ack, err := r.Send(context.Background(), tc.msg)
+			if err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if want := "ack from " + tc.want; string(ack) != want {
+				t.Errorf("Send() = %q, want %q", ack, want)
+			}
+		})
+	}
+	testingutil.CheckMetrics(t, mt, map[string]int64{routedMetric: 6, unmatchedMetric: 0})
+	for route, want := range map[string]int64{"research": 1, "clinical": 1, "default": 4} {
+		if got := mt.LabeledCounterValue(routedMetric, monitoring.Route(route)); got != want {
+			t.Errorf("Messages routed to %v = %v, want %v", route, got, want)
+		}
+	}
+}
+
+func TestUnmatchedNACK(t *testing.T) {
+	mt := testingutil.NewFakeMonitoringClient()
+	r, err := New([]Route{{Name: "lab", Match: Match{SendingFacility: "LAB"}, Sender: &fakeSender{}}}, nil, mt)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ack, err := r.Send(context.Background(), hl7Msg("WARD", "ADT^A01", "P"))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if !bytes.Contains(ack, []byte("MSA|AR|CTRL1")) {
+		t.Errorf("Send() = %q, want a NACK with MSA|AR|CTRL1", ack)
+	}
+	if _, err := r.Send(context.Background(), []byte("garbage")); err == nil {
+		t.Errorf("Send() of a message without MSH succeeded, want error")
+	}
+	testingutil.CheckMetrics(t, mt, map[string]int64{unmatchedMetric: 2})
+}
+
+func TestRouteError(t *testing.T) {
+	mt := testingutil.NewFakeMonitoringClient()
+	lab := &fakeSender{err: fmt.Errorf("unavailable")}
+	r, err := New([]Route{{Name: "lab", Match: Match{SendingFacility: "LAB"}, Sender: lab}}, nil, mt)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := r.Send(context.Background(), hl7Msg("LAB", "ADT^A01", "P")); err == nil {
+		t.Errorf("Send() succeeded, want error")
+	}
+	for _, m := range []string{routedMetric, routeErrorMetric} {
+		if got := mt.LabeledCounterValue(m, monitoring.Route("lab")); got != 1 {
+			t.Errorf("%v for route lab = %v, want 1", m, got)
+		}
+	}
+}
+
+func TestNewInvalidNames(t *testing.T) {
+	for _, routes := range [][]Route{
+		{{Name: ""}},
+		{{Name: "default"}},
+		{{Name: "a"}, {Name: "a"}},
+	} {
+		if _, err := New(routes, nil, testingutil.NewFakeMonitoringClient()); err == nil {
+			t.Errorf("New(%v) succeeded, want error", routes)
+		}
+	}
+}
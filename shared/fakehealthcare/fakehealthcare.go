@@ -0,0 +1,534 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fakehealthcare implements an in-process fake of the HL7v2 message
+// methods of the Cloud Healthcare API, so that the adapter can be tested
+// without network access. It serves messages:ingest, messages.get,
+// messages.create and messages.list over HTTP, answers ingested messages with
+// ACKs and NACKs built like the real API's, and can delay or fail requests.
+package fakehealthcare
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/mllp/mllp_adapter/hl7ack"
+	"github.com/GoogleCloudPlatform/mllp/shared/hl7"
+)
+
+// Method is an API method served by the fake.
+type Method string
+
+const (
+	// Ingest is messages:ingest.
+	Ingest Method = "ingest"
+	// Get is messages.get.
+	Get Method = "get"
+	// Create is messages.create.
+	Create Method = "create"
+	// List is messages.list.
+	List Method = "list"
+)
+
+const (
+	hl7Time         = "20060102150405"
+	defaultPageSize = 100
+)
+
+// pathRE matches the request paths of the HL7v2 message methods. The first
+// group is the store name and the second what follows "messages".
+var pathRE = regexp.MustCompile(`^/v1/(projects/[^/]+/locations/[^/]+/datasets/[^/]+/hl7V2Stores/[^/]+)/messages(:ingest|/[^/]+)?$`)
+
+// Fault replaces the answer to requests for a method.
+type Fault struct {
+	// Method is the method whose requests fail. All methods fail if empty.
+	Method Method
+	// Code is the HTTP status of the error, e.g. 503. It defaults to 400 for
+	// a NACK and 500 otherwise.
+	Code int
+	// NACK, if set, is the acknowledgment code (AE or AR) of a NACK that is
+	// returned in the hl7Nack error details of an ingest request.
+	NACK string
+	// Hang makes requests wait until the client cancels them.
+	Hang bool
+	// Times is the number of requests the fault applies to. If zero it
+	// applies to all requests until ClearFaults is called.
+	Times int
+}
+
+// Notification is what the API publishes to Pub/Sub when a message is stored.
+type Notification struct {
+	// Name is the resource name of the message, which is the data of the
+	// Pub/Sub message.
+	Name string
+	// Attributes are the attributes of the Pub/Sub message.
+	Attributes map[string]string
+}
+
+// Option contains optional settings for the Server.
+type Option struct {
+	// Notify, if set, is called for every stored message, like the
+	// notification configs of a real store.
+	Notify func(Notification)
+}
+
+// Message is a message stored by the fake.
+type Message struct {
+	Name        string
+	Data        []byte
+	MessageType string
+	Created     bool
+	CreateTime  time.Time
+}
+
+// Server is a fake Cloud Healthcare API. Pass its URL as the endpoint of an
+// HL7v2 client with authentication disabled.
+type Server struct {
+	// URL is the address of the server, e.g. "http://127.0.0.1:1234".
+	URL string
+
+	srv    *httptest.Server
+	notify func(Notification)
+
+	// mu guards the fields below.
+	mu       sync.Mutex
+	stores   map[string][]*Message
+	faults   []*Fault
+	latency  time.Duration
+	requests map[Method]int
+	nextID   int
+}
+
+// New starts a server without stores.
+func New(opt Option) *Server {
+	s := &Server{
+		notify:   opt.Notify,
+		stores:   make(map[string][]*Message),
+		requests: make(map[Method]int),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// AddStore creates an empty HL7v2 store with the resource name store, e.g.
+// "projects/p/locations/l/datasets/d/hl7V2Stores/s". Requests for other stores
+// fail with 404.
+func (s *Server) AddStore(store string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.stores[store]; !ok {
+		s.stores[store] = nil
+	}
+}
+
+// Messages returns the messages in store in the order they were stored.
+func (s *Server) Messages(store string) []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Message(nil), s.stores[store]...)
+}
+
+// Inject makes requests fail as described by f. Faults are applied in the
+// order they were injected.
+func (s *Server) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// SetLatency delays the answer to every request by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// Requests returns the number of requests received for m, including failed
+// ones.
+func (s *Server) Requests(m Method) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[m]
+}
+
+// start counts a request and returns the latency to apply and the fault it
+// hits, if any.
+func (s *Server) start(m Method) (time.Duration, *Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[m]++
+	for i, f := range s.faults {
+		if f.Method != "" && f.Method != m {
+			continue
+		}
+		hit := *f
+		if f.Times > 0 {
+			if f.Times--; f.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return s.latency, &hit
+	}
+	return s.latency, nil
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	// The body is read first, so that the server notices when a client gives
+	// up on a delayed request.
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "reading request: %v", err)
+		return
+	}
+	match := pathRE.FindStringSubmatch(r.URL.EscapedPath())
+	if match == nil {
+		writeError(w, http.StatusNotFound, "unknown path %v", r.URL.Path)
+		return
+	}
+	store, suffix := match[1], match[2]
+	var m Method
+	switch {
+	case suffix == ":ingest" && r.Method == http.MethodPost:
+		m = Ingest
+	case suffix == "" && r.Method == http.MethodPost:
+		m = Create
+	case suffix == "" && r.Method == http.MethodGet:
+		m = List
+	case suffix != ":ingest" && suffix != "" && r.Method == http.MethodGet:
+		m = Get
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "%v is not supported on %v", r.Method, r.URL.Path)
+		return
+	}
+
+	latency, fault := s.start(m)
+	if latency > 0 {
+		t := time.NewTimer(latency)
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			t.Stop()
+			return
+		}
+	}
+	if fault != nil && s.fail(w, r, body, fault) {
+		return
+	}
+	if !s.hasStore(store) {
+		writeError(w, http.StatusNotFound, "HL7v2 store %v not found", store)
+		return
+	}
+	switch m {
+	case Ingest:
+		s.ingest(w, store, body)
+	case Create:
+		s.create(w, store, body)
+	case List:
+		s.list(w, r, store)
+	case Get:
+		s.get(w, store+"/messages"+suffix)
+	}
+}
+
+// fail answers a request that hit f. It returns false if the request should
+// be handled normally, which is the case for a NACK fault on a method other
+// than ingest.
+func (s *Server) fail(w http.ResponseWriter, r *http.Request, body []byte, f *Fault) bool {
+	if f.Hang {
+		<-r.Context().Done()
+		return true
+	}
+	if f.NACK == "" {
+		code := f.Code
+		if code == 0 {
+			code = http.StatusInternalServerError
+		}
+		writeError(w, code, "injected failure")
+		return true
+	}
+	var req struct {
+		Message messageJSON `json:"message"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return false
+	}
+	parsed, err := hl7.Parse(req.Message.Data)
+	if err != nil {
+		return false
+	}
+	code := f.Code
+	if code == 0 {
+		code = http.StatusBadRequest
+	}
+	writeNACK(w, code, hl7ack.BuildParsed(parsed, hl7ack.Code(f.NACK), "Injected failure"), "injected NACK")
+	return true
+}
+
+func (s *Server) hasStore(store string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.stores[store]
+	return ok
+}
+
+// messageJSON is the JSON form of a Message resource.
+type messageJSON struct {
+	Name         string `json:"name,omitempty"`
+	Data         []byte `json:"data,omitempty"`
+	MessageType  string `json:"messageType,omitempty"`
+	SendFacility string `json:"sendFacility,omitempty"`
+	SendTime     string `json:"sendTime,omitempty"`
+	CreateTime   string `json:"createTime,omitempty"`
+}
+
+// ingest stores a message sent by a partner and answers with an ACK. Messages
+// without a control ID are rejected with an AR NACK, like the real API does.
+func (s *Server) ingest(w http.ResponseWriter, store string, body []byte) {
+	var req struct {
+		Message messageJSON `json:"message"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: %v", err)
+		return
+	}
+	parsed, err := hl7.Parse(req.Message.Data)
+	if err != nil || parsed.Segments[0].Name != "MSH" {
+		writeError(w, http.StatusBadRequest, "invalid HL7v2 message: no MSH segment")
+		return
+	}
+	if controlID, _ := parsed.Get("MSH-10"); controlID == "" {
+		writeNACK(w, http.StatusBadRequest, hl7ack.BuildParsed(parsed, hl7ack.ApplicationReject, "MSH-10 is required"), "message has no control ID")
+		return
+	}
+	msg := s.store(store, req.Message.Data, false)
+	writeJSON(w, map[string]interface{}{
+		"hl7Ack":  hl7ack.BuildParsed(parsed, hl7ack.ApplicationAccept, ""),
+		"message": toJSON(msg),
+	})
+}
+
+// create stores a message to be sent to a partner.
+func (s *Server) create(w http.ResponseWriter, store string, body []byte) {
+	var req struct {
+		Message messageJSON `json:"message"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: %v", err)
+		return
+	}
+	if _, err := hl7.Parse(req.Message.Data); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid HL7v2 message: %v", err)
+		return
+	}
+	writeJSON(w, toJSON(s.store(store, req.Message.Data, true)))
+}
+
+func (s *Server) get(w http.ResponseWriter, name string) {
+	s.mu.Lock()
+	msg := s.find(name)
+	s.mu.Unlock()
+	if msg == nil {
+		writeError(w, http.StatusNotFound, "message %v not found", name)
+		return
+	}
+	writeJSON(w, toJSON(msg))
+}
+
+// list returns the messages of store in pages. Only the names are returned
+// unless the view is BASIC or FULL. Filters and ordering are not supported.
+func (s *Server) list(w http.ResponseWriter, r *http.Request, store string) {
+	q := r.URL.Query()
+	size := defaultPageSize
+	if v := q.Get("pageSize"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "invalid pageSize %q", v)
+			return
+		}
+		if n > 0 {
+			size = n
+		}
+	}
+	start := 0
+	if v := q.Get("pageToken"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "invalid pageToken %q", v)
+			return
+		}
+		start = n
+	}
+	full := q.Get("view") == "BASIC" || q.Get("view") == "FULL"
+
+	msgs := s.Messages(store)
+	resp := struct {
+		Messages      []messageJSON `json:"hl7V2Messages"`
+		NextPageToken string        `json:"nextPageToken,omitempty"`
+	}{Messages: []messageJSON{}}
+	for i := start; i < len(msgs) && i < start+size; i++ {
+		if full {
+			resp.Messages = append(resp.Messages, toJSON(msgs[i]))
+		} else {
+			resp.Messages = append(resp.Messages, messageJSON{Name: msgs[i].Name})
+		}
+	}
+	if start+size < len(msgs) {
+		resp.NextPageToken = strconv.Itoa(start + size)
+	}
+	writeJSON(w, resp)
+}
+
+// store adds data to store and sends its notification.
+func (s *Server) store(store string, data []byte, created bool) *Message {
+	s.mu.Lock()
+	s.nextID++
+	msg := &Message{
+		Name:        fmt.Sprintf("%v/messages/%d", store, s.nextID),
+		Data:        data,
+		MessageType: messageType(data),
+		Created:     created,
+		CreateTime:  time.Now().UTC(),
+	}
+	s.stores[store] = append(s.stores[store], msg)
+	s.mu.Unlock()
+
+	if s.notify != nil {
+		attrs := map[string]string{"msgType": msg.MessageType}
+		if created {
+			// Messages created through the API are the ones meant to be
+			// sent to partners.
+			attrs["publish"] = "true"
+		}
+		s.notify(Notification{Name: msg.Name, Attributes: attrs})
+	}
+	return msg
+}
+
+// find returns the message called name, or nil. s.mu must be held.
+func (s *Server) find(name string) *Message {
+	for _, msgs := range s.stores {
+		for _, m := range msgs {
+			if m.Name == name {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+func toJSON(m *Message) messageJSON {
+	j := messageJSON{
+		Name:        m.Name,
+		Data:        m.Data,
+		MessageType: m.MessageType,
+		CreateTime:  m.CreateTime.Format(time.RFC3339Nano),
+	}
+	if parsed, err := hl7.Parse(m.Data); err == nil {
+		j.SendFacility, _ = parsed.Value("MSH-4")
+		sent := mustValue(parsed, "MSH-7")
+		if len(sent) > len(hl7Time) {
+			// Fractions of seconds and time zones are ignored.
+			sent = sent[:len(hl7Time)]
+		}
+		if t, err := time.Parse(hl7Time, sent); err == nil {
+			j.SendTime = t.Format(time.RFC3339)
+		}
+	}
+	return j
+}
+
+// messageType returns the message code (MSH-9.1) of data.
+func messageType(data []byte) string {
+	parsed, err := hl7.Parse(data)
+	if err != nil {
+		return ""
+	}
+	return mustValue(parsed, "MSH-9.1")
+}
+
+func mustValue(m *hl7.Message, loc string) string {
+	v, _ := m.Value(loc)
+	return v
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// status returns the canonical status name of an HTTP error code.
+func status(code int) string {
+	switch code {
+	case http.StatusBadRequest:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	}
+	return "INTERNAL"
+}
+
+// writeError writes an error in the format of Google APIs.
+func writeError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	writeErrorDetails(w, code, fmt.Sprintf(format, args...), nil)
+}
+
+// writeNACK writes an error carrying nack in its details, like the response of
+// messages:ingest to a message the store refused.
+func writeNACK(w http.ResponseWriter, code int, nack []byte, message string) {
+	writeErrorDetails(w, code, message, []interface{}{map[string]interface{}{"hl7Nack": nack}})
+}
+
+func writeErrorDetails(w http.ResponseWriter, code int, message string, details []interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	e := map[string]interface{}{
+		"code":    code,
+		"message": message,
+		"status":  status(code),
+	}
+	if details != nil {
+		e["details"] = details
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": e})
+}
@@ -0,0 +1,272 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakehealthcare
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	healthcare "google.golang.org/api/healthcare/v1"
+	"google.golang.org/api/option"
+	"github.com/GoogleCloudPlatform/mllp/shared/healthapiclient"
+	"github.com/GoogleCloudPlatform/mllp/shared/hl7"
+	"github.com/GoogleCloudPlatform/mllp/shared/testingutil"
+)
+
+const (
+	projectID    = "123"
+	locationID   = "test-central1"
+	datasetID    = "456"
+	hl7V2StoreID = "678"
+	store        = "projects/123/locations/test-central1/datasets/456/hl7V2Stores/678"
+)
+
+var (
+	msg          = []byte("MSH|^~\\&|LAB|HOSP|ADAPTER|CLOUD|20180101120000||ORU^R01|ctrl-1|P|2.5\rPID|1||12345\r")
+	noControlMsg = []byte("MSH|^~\\&|LAB|HOSP|ADAPTER|CLOUD|20180101120000||ORU^R01||P|2.5\r")
+)
+
+func newClient(t *testing.T, s *Server, retry healthapiclient.RetryPolicy) *healthapiclient.HL7V2Client {
+	t.Helper()
+	si := healthapiclient.StoreInfo{ProjectID: projectID, LocationID: locationID, DatasetID: datasetID, HL7V2StoreID: hl7V2StoreID}
+	c, err := healthapiclient.NewHL7V2Client(context.Background(), "", testingutil.NewFakeMonitoringClient(), si, healthapiclient.Option{Endpoint: s.URL, Insecure: true, Retry: retry})
+	if err != nil {
+		t.Fatalf("NewHL7V2Client: %v", err)
+	}
+	return c
+}
+
+func newService(t *testing.T, s *Server) *healthcare.ProjectsLocationsDatasetsHl7V2StoresMessagesService {
+	t.Helper()
+	svc, err := healthcare.NewService(context.Background(), option.WithEndpoint(s.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("healthcare.NewService: %v", err)
+	}
+	return svc.Projects.Locations.Datasets.Hl7V2Stores.Messages
+}
+
+// ackCode returns MSA-1 and MSA-2 of ack.
+func ackCode(t *testing.T, ack []byte) (string, string) {
+	t.Helper()
+	parsed, err := hl7.Parse(ack)
+	if err != nil {
+		t.Fatalf("Parsing ACK %q: %v", ack, err)
+	}
+	code, _ := parsed.Value("MSA-1")
+	ctrl, _ := parsed.Value("MSA-2")
+	return code, ctrl
+}
+
+func TestIngest(t *testing.T) {
+	var mu sync.Mutex
+	var notes []Notification
+	s := New(Option{Notify: func(n Notification) {
+		mu.Lock()
+		defer mu.Unlock()
+		notes = append(notes, n)
+	}})
+	defer s.Close()
+	s.AddStore(store)
+	c := newClient(t, s, healthapiclient.RetryPolicy{})
+
+	ack, err := c.Send(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if code, ctrl := ackCode(t, ack); code != "AA" || ctrl != "ctrl-1" {
+		t.Errorf("ACK code and control ID = %q, %q, want AA, ctrl-1", code, ctrl)
+	}
+	parsed, _ := hl7.Parse(ack)
+	if v, _ := parsed.Get("MSH-3"); v != "ADAPTER" {
+		t.Errorf("ACK MSH-3 = %q, want the receiving application of the message", v)
+	}
+
+	msgs := s.Messages(store)
+	if len(msgs) != 1 || string(msgs[0].Data) != string(msg) || msgs[0].MessageType != "ORU" || msgs[0].Created {
+		t.Fatalf("Messages() = %+v, want the ingested message", msgs)
+	}
+	mu.Lock()
+	if len(notes) != 1 || notes[0].Name != msgs[0].Name || notes[0].Attributes["publish"] != "" {
+		t.Errorf("Notifications = %+v, want one for %v without publish", notes, msgs[0].Name)
+	}
+	mu.Unlock()
+
+	got, err := c.Get(context.Background(), msgs[0].Name)
+	if err != nil || string(got) != string(msg) {
+		t.Errorf("Get(%v) = %q, %v, want %q", msgs[0].Name, got, err, msg)
+	}
+}
+
+func TestIngestNACK(t *testing.T) {
+	s := New(Option{})
+	defer s.Close()
+	s.AddStore(store)
+	c := newClient(t, s, healthapiclient.RetryPolicy{})
+
+	ack, err := c.Send(context.Background(), noControlMsg)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if code, _ := ackCode(t, ack); code != "AR" {
+		t.Errorf("ACK code of a message without control ID = %q, want AR", code)
+	}
+	parsed, _ := hl7.Parse(ack)
+	if parsed.Segment("ERR") == nil {
+		t.Errorf("NACK %q has no ERR segment", ack)
+	}
+
+	s.Inject(Fault{Method: Ingest, NACK: "AE", Times: 1})
+	ack, err = c.Send(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if code, ctrl := ackCode(t, ack); code != "AE" || ctrl != "ctrl-1" {
+		t.Errorf("ACK code and control ID = %q, %q, want AE, ctrl-1", code, ctrl)
+	}
+	if n := len(s.Messages(store)); n != 0 {
+		t.Errorf("%d messages stored, want none", n)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	s := New(Option{})
+	defer s.Close()
+	s.AddStore(store)
+	c := newClient(t, s, healthapiclient.RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond})
+
+	s.Inject(Fault{Code: http.StatusServiceUnavailable, Times: 2})
+	if _, err := c.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send after two transient failures: %v", err)
+	}
+	if n := s.Requests(Ingest); n != 3 {
+		t.Errorf("Requests(Ingest) = %d, want 3", n)
+	}
+
+	s.Inject(Fault{Method: Get, Code: http.StatusForbidden})
+	if _, err := c.Send(context.Background(), msg); err != nil {
+		t.Errorf("Send with a fault on Get: %v", err)
+	}
+	if _, err := c.Get(context.Background(), store+"/messages/1"); err == nil {
+		t.Errorf("Get with a fault succeeded, want error")
+	}
+	s.ClearFaults()
+	if _, err := c.Get(context.Background(), store+"/messages/1"); err != nil {
+		t.Errorf("Get after ClearFaults: %v", err)
+	}
+
+	s.Inject(Fault{Hang: true, Times: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Send(ctx, msg); err == nil {
+		t.Errorf("Send to a hanging server succeeded, want error")
+	}
+}
+
+func TestLatency(t *testing.T) {
+	s := New(Option{})
+	defer s.Close()
+	s.AddStore(store)
+	c := newClient(t, s, healthapiclient.RetryPolicy{})
+
+	s.SetLatency(100 * time.Millisecond)
+	start := time.Now()
+	if _, err := c.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("Send took %v, want at least 100ms", d)
+	}
+}
+
+func TestCreateAndList(t *testing.T) {
+	var mu sync.Mutex
+	var notes []Notification
+	s := New(Option{Notify: func(n Notification) {
+		mu.Lock()
+		defer mu.Unlock()
+		notes = append(notes, n)
+	}})
+	defer s.Close()
+	s.AddStore(store)
+	svc := newService(t, s)
+
+	var names []string
+	for i := 0; i < 3; i++ {
+		m, err := svc.Create(store, &healthcare.CreateMessageRequest{
+			Message: &healthcare.Message{Data: base64.StdEncoding.EncodeToString(msg)},
+		}).Do()
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if m.MessageType != "ORU" || m.SendFacility != "HOSP" || m.SendTime == "" {
+			t.Errorf("Create() = %+v, want the fields parsed from the MSH segment", m)
+		}
+		names = append(names, m.Name)
+	}
+	mu.Lock()
+	if len(notes) != 3 || notes[2].Name != names[2] || notes[2].Attributes["publish"] != "true" {
+		t.Errorf("Notifications = %+v, want three with publish set", notes)
+	}
+	mu.Unlock()
+
+	var listed []string
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages == 3 {
+			t.Fatalf("List did not end after %d pages", pages)
+		}
+		resp, err := svc.List(store).PageSize(2).PageToken(token).Do()
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		for _, m := range resp.Hl7V2Messages {
+			if m.Data != "" {
+				t.Errorf("List() without view returned data for %v", m.Name)
+			}
+			listed = append(listed, m.Name)
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	if len(listed) != len(names) {
+		t.Fatalf("List() = %v, want %v", listed, names)
+	}
+	for i := range names {
+		if listed[i] != names[i] {
+			t.Errorf("List()[%d] = %v, want %v", i, listed[i], names[i])
+		}
+	}
+
+	resp, err := svc.List(store).View("FULL").Do()
+	if err != nil || len(resp.Hl7V2Messages) != 3 || resp.Hl7V2Messages[0].Data == "" {
+		t.Errorf("List().View(FULL) = %+v, %v, want messages with data", resp, err)
+	}
+}
+
+func TestUnknownStore(t *testing.T) {
+	s := New(Option{})
+	defer s.Close()
+	c := newClient(t, s, healthapiclient.RetryPolicy{})
+	_, err := c.Send(context.Background(), msg)
+	if e, ok := err.(*googleapi.Error); !ok || e.Code != http.StatusNotFound {
+		t.Errorf("Send to an unknown store = %v, want a 404 error", err)
+	}
+}
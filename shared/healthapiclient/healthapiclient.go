@@ -19,15 +19,22 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"unicode/utf8"
 
 	log "github.com/golang/glog"
+	"golang.org/x/oauth2"
 	"golang.org/x/text/encoding"
 	"golang.org/x/text/encoding/htmlindex"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 	"github.com/GoogleCloudPlatform/mllp/shared/monitoring"
+	"github.com/GoogleCloudPlatform/mllp/shared/tracing"
 	"github.com/GoogleCloudPlatform/mllp/shared/util"
 
 	healthcare "google.golang.org/api/healthcare/v1"
@@ -39,11 +46,20 @@ const (
 	fhirJSONContentType = "application/fhir+json;charset=utf-8"
 	sendSuffix          = "messages:ingest"
 
+	// apiVersion is the version of the API the library adds to request paths.
+	apiVersion = "v1"
+
 	sentMetric               = "apiclient-sent"
 	sendErrorMetric          = "apiclient-send-error"
 	fetchedMetric            = "apiclient-fetched"
 	fetchErrorMetric         = "apiclient-fetch-error"
 	fetchErrorInternalMetric = "apiclient-fetch-error-internal"
+	sendRetryMetric          = "apiclient-send-retry"
+	fetchRetryMetric         = "apiclient-fetch-retry"
+
+	// unhealthyAfter is the number of consecutive failed calls after which
+	// Health reports an error.
+	unhealthyAfter = 3
 )
 
 // HL7V2Client represents a client of the HL7v2 API.
@@ -59,6 +75,14 @@ type HL7V2Client struct {
 	logACK                  bool
 	logInputMessageInBase64 bool
 	fallbackEncoding        string
+	retry                   RetryPolicy
+	ts                      oauth2.TokenSource
+
+	// mu guards failures and lastErr, which track the calls that failed for
+	// reasons unrelated to their message.
+	mu       sync.Mutex
+	failures int
+	lastErr  error
 }
 
 type sendMessageErrorResp struct {
@@ -85,6 +109,14 @@ type Option struct {
 	LogACK                  bool
 	LogInputMessageInBase64 bool
 	FallbackEncoding        string
+	// Retry controls retries of calls that fail with a transient error.
+	Retry RetryPolicy
+	// Endpoint, if set, replaces the address of the Cloud Healthcare API, e.g.
+	// for a regional or Private Service Connect endpoint. See ParseEndpoint.
+	Endpoint string
+	// Insecure sends requests without credentials and allows a plain http
+	// Endpoint. It is meant for local fakes and emulators.
+	Insecure bool
 }
 
 // NewHL7V2Client creates a properly authenticated client that talks to an HL7v2 backend.
@@ -93,7 +125,7 @@ func NewHL7V2Client(ctx context.Context, cred string, metrics monitoring.Client,
 		return nil, err
 	}
 
-	storeService, err := initHL7v2StoreService(ctx, cred)
+	storeService, ts, err := initHL7v2StoreService(ctx, cred, opt)
 	if err != nil {
 		return nil, err
 	}
@@ -110,17 +142,31 @@ func NewHL7V2Client(ctx context.Context, cred string, metrics monitoring.Client,
 		logACK:                  opt.LogACK,
 		logInputMessageInBase64: opt.LogInputMessageInBase64,
 		fallbackEncoding:        opt.FallbackEncoding,
+		retry:                   opt.Retry,
+		ts:                      ts,
 	}
 	c.initMetrics()
 	return c, nil
 }
 
 func (c *HL7V2Client) initMetrics() {
-	c.metrics.NewCounter(sentMetric, "Number of HL7 messages sent to HL7 store.")
-	c.metrics.NewCounter(sendErrorMetric, "Number of errors when sending HL7 message to HL7 store.")
-	c.metrics.NewCounter(fetchedMetric, "Number of HL7 messages fetched from HL7 Store.")
-	c.metrics.NewCounter(fetchErrorMetric, "Number of errors when fetching HL7 message from HL7 Store.")
-	c.metrics.NewCounter(fetchErrorInternalMetric, "Number of adapter internal errors when fetching HL7 message from HL7 Store.")
+	c.metrics.NewCounter(sentMetric, "Number of HL7 messages sent to HL7 store.", monitoring.StoreKey, monitoring.MessageTypeKey, monitoring.AckCodeKey)
+	c.metrics.NewCounter(sendErrorMetric, "Number of errors when sending HL7 message to HL7 store.", monitoring.StoreKey)
+	c.metrics.NewCounter(fetchedMetric, "Number of HL7 messages fetched from HL7 Store.", monitoring.StoreKey)
+	c.metrics.NewCounter(fetchErrorMetric, "Number of errors when fetching HL7 message from HL7 Store.", monitoring.StoreKey)
+	c.metrics.NewCounter(fetchErrorInternalMetric, "Number of adapter internal errors when fetching HL7 message from HL7 Store.", monitoring.StoreKey)
+	c.metrics.NewCounter(sendRetryMetric, "Number of retried attempts to send an HL7 message to HL7 Store.", monitoring.StoreKey)
+	c.metrics.NewCounter(fetchRetryMetric, "Number of retried attempts to fetch an HL7 message from HL7 Store.", monitoring.StoreKey)
+}
+
+// storeName returns the resource name of the HL7v2 store of the client.
+func (c *HL7V2Client) storeName() string {
+	return util.GenerateHL7V2StoreName(c.projectID, c.locationID, c.datasetID, c.hl7V2StoreID)
+}
+
+// store returns the label of the HL7v2 store of the client.
+func (c *HL7V2Client) store() monitoring.Label {
+	return monitoring.Store(c.storeName())
 }
 
 func validatesComponents(projectID, locationID, datasetID, storeID string) error {
@@ -139,39 +185,127 @@ func validatesComponents(projectID, locationID, datasetID, storeID string) error
 	return nil
 }
 
-// initHL7v2StoreService creates an HL7v2 store service and does the
-// authentication work.
-func initHL7v2StoreService(ctx context.Context, cred string) (*healthcare.ProjectsLocationsDatasetsHl7V2StoresService, error) {
-	ts, err := util.TokenSource(ctx, cred, scope)
+// ParseEndpoint checks an address of the Cloud Healthcare API and returns it
+// in the form expected by the API library, e.g. "https://localhost:8080/". The
+// address must be an http or https URL, and may only be http if insecure is
+// set, since credentials would be sent in the clear. A trailing API version
+// like "/v1" is ignored, since it is added to every request.
+func ParseEndpoint(endpoint string, insecure bool) (string, error) {
+	u, err := url.Parse(endpoint)
 	if err != nil {
-		return nil, fmt.Errorf("oauth2google.DefaultTokenSource: %v", err)
+		return "", err
+	}
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https":
+		return "", fmt.Errorf("endpoint %q must start with http:// or https://", endpoint)
+	case u.Scheme == "http" && !insecure:
+		return "", fmt.Errorf("endpoint %q would send credentials without TLS, use https or disable authentication", endpoint)
+	case u.Host == "":
+		return "", fmt.Errorf("endpoint %q has no host", endpoint)
+	case u.User != nil || u.RawQuery != "" || u.Fragment != "":
+		return "", fmt.Errorf("endpoint %q must not have user info, a query or a fragment", endpoint)
+	}
+	path := strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/"+apiVersion)
+	return u.Scheme + "://" + u.Host + path + "/", nil
+}
+
+// initHL7v2StoreService creates an HL7v2 store service and does the
+// authentication work, unless opt.Insecure is set. Requests carry the trace
+// context of their caller.
+func initHL7v2StoreService(ctx context.Context, cred string, opt Option) (*healthcare.ProjectsLocationsDatasetsHl7V2StoresService, oauth2.TokenSource, error) {
+	var opts []option.ClientOption
+	if opt.Endpoint != "" {
+		endpoint, err := ParseEndpoint(opt.Endpoint, opt.Insecure)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid Cloud Healthcare API endpoint: %v", err)
+		}
+		opts = append(opts, option.WithEndpoint(endpoint))
+		log.Infof("Sending Cloud Healthcare API requests to %v", endpoint)
 	}
 
-	healthcareService, err := healthcare.NewService(ctx, option.WithTokenSource(ts))
+	var ts oauth2.TokenSource
+	client := &http.Client{Transport: tracing.Transport(nil)}
+	if opt.Insecure {
+		log.Warningf("Sending Cloud Healthcare API requests without credentials")
+	} else {
+		var err error
+		ts, err = util.TokenSource(ctx, cred, scope)
+		if err != nil {
+			return nil, nil, fmt.Errorf("oauth2google.DefaultTokenSource: %v", err)
+		}
+		client.Transport = &oauth2.Transport{Source: ts, Base: client.Transport}
+	}
+	opts = append(opts, option.WithHTTPClient(client))
+	healthcareService, err := healthcare.NewService(ctx, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("healthcare.NewService: %v", err)
+		return nil, nil, fmt.Errorf("healthcare.NewService: %v", err)
 	}
-	return healthcareService.Projects.Locations.Datasets.Hl7V2Stores, nil
+	return healthcareService.Projects.Locations.Datasets.Hl7V2Stores, ts, nil
+}
+
+// Health returns an error if no access token can be obtained, or if the last
+// calls to the API all failed because it was unavailable or refused the
+// credentials. Calls rejected because of their message do not count.
+func (c *HL7V2Client) Health() error {
+	if c.ts != nil {
+		if _, err := c.ts.Token(); err != nil {
+			return fmt.Errorf("getting access token: %v", err)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures >= unhealthyAfter {
+		return fmt.Errorf("last %d API calls failed: %v", c.failures, c.lastErr)
+	}
+	return nil
+}
+
+// record tracks the outcome of a call for Health. Calls cancelled by their
+// caller say nothing about the API and are ignored.
+func (c *HL7V2Client) record(err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil || !unhealthy(err) {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	c.lastErr = err
 }
 
 // Send sends a message to the endpoint and returns the ACK/NACK response.
-// Returns an error if the request fails without a NACK response.
-func (c *HL7V2Client) Send(data []byte) ([]byte, error) {
-	c.metrics.IncCounter(sentMetric)
+// Returns an error if the request fails without a NACK response, or if ctx is
+// done first.
+func (c *HL7V2Client) Send(ctx context.Context, data []byte) ([]byte, error) {
+	ctx, span := tracing.StartSpan(ctx, "healthcare.ingest", data, tracing.StoreKey.String(c.storeName()))
+	ack, err := c.send(ctx, data)
+	span.SetAttributes(tracing.AckAttributes(ack)...)
+	tracing.End(span, err)
+	c.metrics.IncCounter(sentMetric, c.store(), monitoring.MessageType(data), monitoring.AckCode(ack))
+	return ack, err
+}
 
+func (c *HL7V2Client) send(ctx context.Context, data []byte) ([]byte, error) {
 	req := &healthcare.IngestMessageRequest{
 		Message: &healthcare.Message{
 			Data: encodeBase64DataForRequest(data, c.fallbackEncoding),
 		},
 	}
-	ctx := context.Background()
 	log.Infof("Received message of size %v bytes. Sending this message to the Cloud Healthcare API HL7V2 Store.", len(data))
-	parent := util.GenerateHL7V2StoreName(c.projectID, c.locationID, c.datasetID, c.hl7V2StoreID)
-	ingest := c.storeService.Messages.Ingest(parent, req)
-	ingest.Header().Add("X-GOOG-API-FORMAT-VERSION", "2")
-	resp, err := ingest.Context(ctx).Do()
+	parent := c.storeName()
+	var resp *healthcare.IngestMessageResponse
+	err := c.withRetry(ctx, sendRetryMetric, func(ctx context.Context) error {
+		ingest := c.storeService.Messages.Ingest(parent, req)
+		ingest.Header().Add("X-GOOG-API-FORMAT-VERSION", "2")
+		var err error
+		resp, err = ingest.Context(ctx).Do()
+		return err
+	})
 	if err != nil {
-		c.metrics.IncCounter(sendErrorMetric)
+		c.metrics.IncCounter(sendErrorMetric, c.store())
 		if e, ok := err.(*googleapi.Error); ok {
 			if len(e.Body) == 0 {
 				return nil, e
@@ -196,7 +330,7 @@ func (c *HL7V2Client) Send(data []byte) ([]byte, error) {
 
 	ack, err := base64.StdEncoding.DecodeString(resp.Hl7Ack)
 	if err != nil {
-		c.metrics.IncCounter(sendErrorMetric)
+		c.metrics.IncCounter(sendErrorMetric, c.store())
 		return nil, fmt.Errorf("unable to parse ACK response: %v", err)
 	}
 	if c.logACK {
@@ -232,42 +366,76 @@ func extractNACKAndErrorMessage(resp []byte) ([]byte, string, error) {
 	return nil, em, nil
 }
 
+// PermanentError is returned by Get when calling it again cannot succeed,
+// because the message name is invalid or the message does not exist.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
 // Get retrieves a message from the server.
-// Returns an error if the request fails.
-func (c *HL7V2Client) Get(msgName string) ([]byte, error) {
-	c.metrics.IncCounter(fetchedMetric)
+// Returns an error if the request fails or if ctx is done first. The error is
+// a *PermanentError if the message can never be fetched.
+func (c *HL7V2Client) Get(ctx context.Context, msgName string) ([]byte, error) {
+	ctx, span := tracing.StartSpan(ctx, "healthcare.get", nil, tracing.MessageNameKey.String(msgName))
+	msg, err := c.get(ctx, msgName)
+	span.SetAttributes(tracing.MessageAttributes(msg)...)
+	tracing.End(span, err)
+	return msg, err
+}
+
+func (c *HL7V2Client) get(ctx context.Context, msgName string) ([]byte, error) {
+	c.metrics.IncCounter(fetchedMetric, c.store())
 	projectID, locationID, datasetID, hl7V2StoreID, _, err := util.ParseHL7V2MessageName(msgName)
 	if err != nil {
-		c.metrics.IncCounter(fetchErrorInternalMetric)
-		return nil, fmt.Errorf("parsing message name: %v", err)
+		c.metrics.IncCounter(fetchErrorInternalMetric, c.store())
+		return nil, &PermanentError{fmt.Errorf("parsing message name: %v", err)}
 	}
 	if projectID != c.projectID {
-		c.metrics.IncCounter(fetchErrorInternalMetric)
-		return nil, fmt.Errorf("message name %v is not from expected project %v", msgName, c.projectID)
+		c.metrics.IncCounter(fetchErrorInternalMetric, c.store())
+		return nil, &PermanentError{fmt.Errorf("message name %v is not from expected project %v", msgName, c.projectID)}
 	}
 	if locationID != c.locationID {
-		c.metrics.IncCounter(fetchErrorInternalMetric)
-		return nil, fmt.Errorf("message name %v is not from expected location %v", msgName, c.locationID)
+		c.metrics.IncCounter(fetchErrorInternalMetric, c.store())
+		return nil, &PermanentError{fmt.Errorf("message name %v is not from expected location %v", msgName, c.locationID)}
 	}
 	if datasetID != c.datasetID {
-		c.metrics.IncCounter(fetchErrorInternalMetric)
-		return nil, fmt.Errorf("message name %v is not from expected dataset %v", msgName, c.datasetID)
+		c.metrics.IncCounter(fetchErrorInternalMetric, c.store())
+		return nil, &PermanentError{fmt.Errorf("message name %v is not from expected dataset %v", msgName, c.datasetID)}
 	}
 	if hl7V2StoreID != c.hl7V2StoreID {
-		c.metrics.IncCounter(fetchErrorInternalMetric)
-		return nil, fmt.Errorf("message name %v is not from expected HL7v2 store %v", msgName, c.hl7V2StoreID)
+		c.metrics.IncCounter(fetchErrorInternalMetric, c.store())
+		return nil, &PermanentError{fmt.Errorf("message name %v is not from expected HL7v2 store %v", msgName, c.hl7V2StoreID)}
 	}
 
 	log.Infof("Started to fetch message from the Cloud Healthcare API HL7V2 Store")
-	resp, err := c.storeService.Messages.Get(msgName).Context(context.Background()).Do()
+	var resp *healthcare.Message
+	err = c.withRetry(ctx, fetchRetryMetric, func(ctx context.Context) error {
+		var err error
+		resp, err = c.storeService.Messages.Get(msgName).Context(ctx).Do()
+		return err
+	})
+	var apiErr *googleapi.Error
+	gone := errors.As(err, &apiErr) && (apiErr.Code == http.StatusNotFound || apiErr.Code == http.StatusBadRequest)
 	if err != nil {
-		c.metrics.IncCounter(fetchErrorMetric)
-		return nil, fmt.Errorf("failed to fetch message: %v", err)
+		c.metrics.IncCounter(fetchErrorMetric, c.store())
+		err = fmt.Errorf("failed to fetch message: %v", err)
+		if gone {
+			return nil, &PermanentError{err}
+		}
+		return nil, err
 	}
 	msg, err := base64.StdEncoding.DecodeString(resp.Data)
 	if err != nil {
-		c.metrics.IncCounter(fetchErrorMetric)
-		return nil, fmt.Errorf("unable to parse data: %v", err)
+		c.metrics.IncCounter(fetchErrorMetric, c.store())
+		return nil, &PermanentError{fmt.Errorf("unable to parse data: %v", err)}
 	}
 	log.Infof("Message was successfully fetched from the Cloud Healthcare API HL7V2 Store.")
 	return msg, nil
@@ -17,6 +17,7 @@ package healthapiclient
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -25,9 +26,12 @@ import (
 	"testing"
 
 	"google.golang.org/api/option"
+	"github.com/GoogleCloudPlatform/mllp/shared/monitoring"
 	"github.com/GoogleCloudPlatform/mllp/shared/testingutil"
+	"github.com/GoogleCloudPlatform/mllp/shared/tracing"
 	"github.com/GoogleCloudPlatform/mllp/shared/util"
 
+	"go.opentelemetry.io/otel/attribute"
 	healthcare "google.golang.org/api/healthcare/v1"
 )
 
@@ -176,7 +180,7 @@ func TestSend(t *testing.T) {
 			c := newHL7V2Client(s.Client(), s.URL, tc.projectID, locationID, tc.datasetID, tc.hl7V2StoreID)
 			c.metrics = testingutil.NewFakeMonitoringClient()
 			for _, msg := range tc.msgs {
-				ack, err := c.Send(msg)
+				ack, err := c.Send(context.Background(), msg)
 				if err != nil {
 					t.Errorf("Unexpected send error: %v", err)
 				}
@@ -188,6 +192,14 @@ func TestSend(t *testing.T) {
 				t.Errorf("Messages differ: expected %v but got %v", tc.msgs, received)
 			}
 			testingutil.CheckMetrics(t, c.metrics.(*testingutil.FakeMonitoringClient), tc.expectedMetrics)
+			labels := []monitoring.Label{
+				monitoring.Store(util.GenerateHL7V2StoreName(tc.projectID, locationID, tc.datasetID, tc.hl7V2StoreID)),
+				monitoring.MessageType(cannedMsg),
+				monitoring.AckCode(cannedAck),
+			}
+			if got, want := c.metrics.(*testingutil.FakeMonitoringClient).LabeledCounterValue(sentMetric, labels...), tc.expectedMetrics[sentMetric]; got != want {
+				t.Errorf("%v%v = %v, want %v", sentMetric, labels, got, want)
+			}
 		})
 	}
 }
@@ -256,7 +268,7 @@ func TestSendError(t *testing.T) {
 			c := newHL7V2Client(s.Client(), s.URL, tc.projectID, locationID, tc.datasetID, tc.hl7V2StoreID)
 			c.metrics = testingutil.NewFakeMonitoringClient()
 			for _, msg := range tc.msgs {
-				ack, err := c.Send(msg)
+				ack, err := c.Send(context.Background(), msg)
 				if err == nil {
 					t.Errorf("Expected send error but got %v", ack)
 				}
@@ -278,7 +290,7 @@ func TestGet(t *testing.T) {
 	toSend = map[string][]byte{msgID: cannedMsg}
 	c := newHL7V2Client(s.Client(), s.URL, projectID, locationID, datasetID, hl7V2StoreID)
 	c.metrics = testingutil.NewFakeMonitoringClient()
-	msg, err := c.Get(util.GenerateHL7V2MessageName(projectID, locationID, datasetID, hl7V2StoreID, msgID))
+	msg, err := c.Get(context.Background(), util.GenerateHL7V2MessageName(projectID, locationID, datasetID, hl7V2StoreID, msgID))
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -327,15 +339,30 @@ func TestGetError(t *testing.T) {
 			defer s.Close()
 			c := newHL7V2Client(s.Client(), s.URL, projectID, locationID, datasetID, hl7V2StoreID)
 			c.metrics = testingutil.NewFakeMonitoringClient()
-			msg, err := c.Get(tc.msgName)
+			msg, err := c.Get(context.Background(), tc.msgName)
 			if err == nil {
 				t.Errorf("Expected error but got %v", msg)
 			}
+			var pe *PermanentError
+			if !errors.As(err, &pe) {
+				t.Errorf("Get() error = %v, want a *PermanentError", err)
+			}
 			testingutil.CheckMetrics(t, c.metrics.(*testingutil.FakeMonitoringClient), tc.expectedMetrics)
 		})
 	}
 }
 
+func TestGetUnavailableIsNotPermanent(t *testing.T) {
+	s := setUp()
+	c := newHL7V2Client(s.Client(), s.URL, projectID, locationID, datasetID, hl7V2StoreID)
+	s.Close()
+	_, err := c.Get(context.Background(), util.GenerateHL7V2MessageName(projectID, locationID, datasetID, hl7V2StoreID, msgID))
+	var pe *PermanentError
+	if err == nil || errors.As(err, &pe) {
+		t.Errorf("Get() from a stopped server = %v, want an error that is not permanent", err)
+	}
+}
+
 func TestSanitizeMessageForPrintout(t *testing.T) {
 	testCases := []struct {
 		name           string
@@ -416,3 +443,101 @@ func TestEncodeBase64DataForRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestTracing(t *testing.T) {
+	exp := testingutil.RecordSpans(t)
+	ack := []byte("MSH|^~\\&|RECV|RECVFAC|APP|FAC|20180101000001||ACK|A1|P|2.5\rMSA|AA|CTRL1\r")
+	traceparent := make(chan string, 1)
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparent <- req.Header.Get("traceparent")
+		json.NewEncoder(w).Encode(&sendMessageResp{Hl7Ack: ack})
+	}))
+	defer s.Close()
+	c := newHL7V2Client(&http.Client{Transport: tracing.Transport(s.Client().Transport)}, s.URL, projectID, locationID, datasetID, hl7V2StoreID)
+
+	msg := []byte("MSH|^~\\&|APP|FAC|RECV|RECVFAC|20180101000000||ADT^A01|CTRL1|P|2.5\rPID|1\r")
+	if _, err := c.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	span, attrs := testingutil.FindSpan(t, exp, "healthcare.ingest")
+	// The API call carries the context of the span.
+	want := "00-" + span.SpanContext.TraceID().String() + "-" + span.SpanContext.SpanID().String() + "-01"
+	if got := <-traceparent; got != want {
+		t.Errorf("traceparent = %q, want %q", got, want)
+	}
+	for k, v := range map[attribute.Key]string{
+		tracing.ControlIDKey: "CTRL1",
+		tracing.AckCodeKey:   "AA",
+		tracing.StoreKey:     util.GenerateHL7V2StoreName(projectID, locationID, datasetID, hl7V2StoreID),
+	} {
+		if attrs[k] != v {
+			t.Errorf("Attribute %v = %q, want %q", k, attrs[k], v)
+		}
+	}
+}
+
+func TestParseEndpoint(t *testing.T) {
+	testCases := []struct {
+		endpoint string
+		insecure bool
+		want     string
+	}{
+		{"https://healthcare.googleapis.com", false, "https://healthcare.googleapis.com/"},
+		{"https://healthcare.googleapis.com/v1/", false, "https://healthcare.googleapis.com/"},
+		{"https://psc.example.com/healthcare/v1", false, "https://psc.example.com/healthcare/"},
+		{"http://localhost:8080", true, "http://localhost:8080/"},
+		{"https://localhost:8443", true, "https://localhost:8443/"},
+	}
+	for _, tc := range testCases {
+		got, err := ParseEndpoint(tc.endpoint, tc.insecure)
+		if err != nil || got != tc.want {
+			t.Errorf("ParseEndpoint(%q, %v) = %q, %v, want %q", tc.endpoint, tc.insecure, got, err, tc.want)
+		}
+	}
+	for _, endpoint := range []string{
+		"",
+		"localhost:8080",
+		"ftp://localhost",
+		"http://localhost:8080",
+		"https://",
+		"https://user@localhost",
+		"https://localhost?key=1",
+		"https://local host",
+	} {
+		if got, err := ParseEndpoint(endpoint, false); err == nil {
+			t.Errorf("ParseEndpoint(%q, false) = %q, want error", endpoint, got)
+		}
+	}
+}
+
+func TestInsecureEndpoint(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if auth := req.Header.Get("Authorization"); auth != "" {
+			t.Errorf("Request carries credentials %q, want none", auth)
+		}
+		if req.URL.EscapedPath() != sendPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, _ := json.Marshal(&sendMessageResp{Hl7Ack: cannedAck})
+		w.Write(data)
+	}))
+	defer s.Close()
+
+	si := StoreInfo{ProjectID: projectID, LocationID: locationID, DatasetID: datasetID, HL7V2StoreID: hl7V2StoreID}
+	c, err := NewHL7V2Client(context.Background(), "", testingutil.NewFakeMonitoringClient(), si, Option{Endpoint: s.URL + "/v1", Insecure: true})
+	if err != nil {
+		t.Fatalf("NewHL7V2Client: %v", err)
+	}
+	ack, err := c.Send(context.Background(), cannedMsg)
+	if err != nil || !reflect.DeepEqual(ack, cannedAck) {
+		t.Errorf("Send() = %s, %v, want %s", ack, err, cannedAck)
+	}
+	if err := c.Health(); err != nil {
+		t.Errorf("Health() = %v, want nil", err)
+	}
+
+	if _, err := NewHL7V2Client(context.Background(), "", testingutil.NewFakeMonitoringClient(), si, Option{Endpoint: s.URL}); err == nil {
+		t.Errorf("NewHL7V2Client() with an http endpoint and credentials succeeded, want error")
+	}
+}
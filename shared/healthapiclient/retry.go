@@ -0,0 +1,172 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthapiclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+	"google.golang.org/api/googleapi"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultBaseBackoff = 500 * time.Millisecond
+	defaultMaxBackoff  = 30 * time.Second
+)
+
+// RetryPolicy controls how API calls that fail with a transient error are
+// retried. The zero value makes a single attempt.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts per call, including the
+	// first one.
+	MaxAttempts int
+	// BaseBackoff is the wait before the first retry, doubled for every
+	// following one up to MaxBackoff. They default to 500ms and 30s.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// Jitter is the fraction, between 0 and 1, of each backoff that is
+	// randomly taken off so that clients do not retry in lockstep.
+	Jitter float64
+	// Deadline bounds the total time spent on a call, including retries. No
+	// deadline is applied if zero.
+	Deadline time.Duration
+	// AttemptTimeout bounds each attempt of a call, so that a request that
+	// hangs is retried instead of using up the whole Deadline. No timeout is
+	// applied if zero.
+	AttemptTimeout time.Duration
+}
+
+// backoff returns the wait before retry number n, starting at 1.
+func (p RetryPolicy) backoff(n int) time.Duration {
+	base, max := p.BaseBackoff, p.MaxBackoff
+	if base <= 0 {
+		base = defaultBaseBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	d := base
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// withRetry runs call until it succeeds, fails with an error that is not
+// retryable, or the policy is exhausted. Every retry increments metric and is
+// recorded as an event of the span in ctx.
+func (c *HL7V2Client) withRetry(ctx context.Context, metric string, call func(context.Context) error) error {
+	err := c.retryCall(ctx, metric, call)
+	c.record(err)
+	return err
+}
+
+func (c *HL7V2Client) retryCall(ctx context.Context, metric string, call func(context.Context) error) error {
+	if c.retry.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.retry.Deadline)
+		defer cancel()
+	}
+	for attempt := 1; ; attempt++ {
+		timedOut, err := c.attempt(ctx, call)
+		if err == nil || attempt >= c.retry.MaxAttempts || !(timedOut || retryable(err)) {
+			return err
+		}
+		wait := c.retry.backoff(attempt)
+		log.Warningf("Call to the Cloud Healthcare API failed (attempt %d of %d), retrying in %v: %v", attempt, c.retry.MaxAttempts, wait, err)
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			attribute.Int("attempt", attempt),
+			attribute.String("error", err.Error()),
+		))
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		c.metrics.IncCounter(metric, c.store())
+	}
+}
+
+// attempt runs call once, bounded by the attempt timeout of the policy. It
+// reports whether the attempt ran out of time while ctx did not.
+func (c *HL7V2Client) attempt(ctx context.Context, call func(context.Context) error) (bool, error) {
+	if c.retry.AttemptTimeout <= 0 {
+		return false, call(ctx)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, c.retry.AttemptTimeout)
+	defer cancel()
+	err := call(attemptCtx)
+	return err != nil && attemptCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil, err
+}
+
+// unhealthy reports whether err means that the API cannot be used at all, as
+// opposed to rejecting one message. Unlike retries, it covers every transport
+// error, e.g. failed TLS verification.
+func unhealthy(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && (apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden) {
+		return true
+	}
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) || retryable(err)
+}
+
+// retryable reports whether err is worth retrying: throttling, server side
+// failures, timeouts and dropped or refused connections. Responses that carry
+// an HL7 NACK are final, since the store has already processed the message,
+// and so are other transport errors such as failed TLS verification.
+func retryable(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		if nack, _, _ := extractNACKAndErrorMessage([]byte(apiErr.Body)); nack != nil {
+			return false
+		}
+		switch apiErr.Code {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+			http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		// The overall deadline has passed.
+		return false
+	}
+	for _, transient := range []error{syscall.ECONNRESET, syscall.ECONNREFUSED, io.EOF, io.ErrUnexpectedEOF} {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
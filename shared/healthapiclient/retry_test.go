@@ -0,0 +1,291 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthapiclient
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"github.com/GoogleCloudPlatform/mllp/shared/testingutil"
+	"github.com/GoogleCloudPlatform/mllp/shared/util"
+)
+
+var fastRetry = RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+// flakyServer fails the first failures requests with status and body, then
+// answers like the real API. With status 0 the failed requests hang until
+// they are cancelled.
+type flakyServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests int
+}
+
+func newFlakyServer(failures, status int, body string) *flakyServer {
+	f := &flakyServer{}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f.mu.Lock()
+		f.requests++
+		n := f.requests
+		f.mu.Unlock()
+		if n <= failures && status == 0 {
+			// The server only notices that the client went away once the
+			// body is read.
+			ioutil.ReadAll(req.Body)
+			<-req.Context().Done()
+			return
+		}
+		if n <= failures {
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+			return
+		}
+		var data []byte
+		if req.URL.EscapedPath() == getPath {
+			data, _ = json.Marshal(&message{Data: cannedMsg})
+		} else {
+			data, _ = json.Marshal(&sendMessageResp{Hl7Ack: cannedAck})
+		}
+		w.Write(data)
+	}))
+	return f
+}
+
+func (f *flakyServer) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+func TestSendRetry(t *testing.T) {
+	nack, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": "invalid message",
+			"details": []interface{}{map[string]interface{}{"hl7Nack": []byte("nack")}},
+		},
+	})
+	testCases := []struct {
+		name         string
+		failures     int
+		status       int
+		body         string
+		wantAck      []byte
+		wantRequests int
+		wantRetries  int64
+	}{
+		{"unavailable then success", 2, http.StatusServiceUnavailable, "", cannedAck, 3, 2},
+		{"throttled then success", 1, http.StatusTooManyRequests, "{}", cannedAck, 2, 1},
+		{"unavailable until attempts run out", 5, http.StatusServiceUnavailable, "", nil, 3, 2},
+		{"permanent error", 1, http.StatusForbidden, "{}", nil, 1, 0},
+		{"NACK is not retried", 1, http.StatusServiceUnavailable, string(nack), []byte("nack"), 1, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newFlakyServer(tc.failures, tc.status, tc.body)
+			defer s.Close()
+			c := newHL7V2Client(s.Client(), s.URL, projectID, locationID, datasetID, hl7V2StoreID)
+			c.retry = fastRetry
+			ack, err := c.Send(context.Background(), cannedMsg)
+			if tc.wantAck == nil && err == nil {
+				t.Errorf("Send() returned %s, want error", ack)
+			}
+			if tc.wantAck != nil && (err != nil || !reflect.DeepEqual(ack, tc.wantAck)) {
+				t.Errorf("Send() returned %s, %v, want %s", ack, err, tc.wantAck)
+			}
+			if got := s.requestCount(); got != tc.wantRequests {
+				t.Errorf("Server got %v requests, want %v", got, tc.wantRequests)
+			}
+			testingutil.CheckMetrics(t, c.metrics.(*testingutil.FakeMonitoringClient), map[string]int64{sentMetric: 1, sendRetryMetric: tc.wantRetries})
+		})
+	}
+}
+
+// timeoutError is a network error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryable(t *testing.T) {
+	urlErr := func(err error) error { return &url.Error{Op: "Post", URL: "https://example.com", Err: err} }
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection reset", urlErr(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), true},
+		{"connection refused", urlErr(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), true},
+		{"unexpected EOF", urlErr(io.ErrUnexpectedEOF), true},
+		{"timeout", urlErr(timeoutError{}), true},
+		{"unsupported scheme", urlErr(errors.New("unsupported protocol scheme \"ftp\"")), false},
+		{"bad certificate", urlErr(x509.UnknownAuthorityError{}), false},
+		{"not found", &googleapi.Error{Code: http.StatusNotFound}, false},
+		{"unavailable", &googleapi.Error{Code: http.StatusServiceUnavailable}, true},
+	} {
+		if got := retryable(tc.err); got != tc.want {
+			t.Errorf("retryable(%v) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSendTLSErrorNotRetried(t *testing.T) {
+	s := newFlakyServer(0, 0, "")
+	defer s.Close()
+	// The default client does not trust the certificate of the test server.
+	c := newHL7V2Client(&http.Client{}, s.URL, projectID, locationID, datasetID, hl7V2StoreID)
+	c.retry = fastRetry
+	if _, err := c.Send(context.Background(), cannedMsg); err == nil {
+		t.Errorf("Send() succeeded, want error")
+	}
+	testingutil.CheckMetrics(t, c.metrics.(*testingutil.FakeMonitoringClient), map[string]int64{sendRetryMetric: 0})
+}
+
+func TestSendRetryDeadline(t *testing.T) {
+	s := newFlakyServer(100, http.StatusServiceUnavailable, "")
+	defer s.Close()
+	c := newHL7V2Client(s.Client(), s.URL, projectID, locationID, datasetID, hl7V2StoreID)
+	c.retry = RetryPolicy{MaxAttempts: 100, BaseBackoff: 20 * time.Millisecond, MaxBackoff: 20 * time.Millisecond, Deadline: 50 * time.Millisecond}
+	if _, err := c.Send(context.Background(), cannedMsg); err == nil {
+		t.Errorf("Send() succeeded, want error")
+	}
+	if got := s.requestCount(); got >= 10 {
+		t.Errorf("Server got %v requests, want the deadline to stop retries", got)
+	}
+}
+
+func TestAttemptTimeout(t *testing.T) {
+	s := newFlakyServer(1, 0, "")
+	defer s.Close()
+	c := newHL7V2Client(s.Client(), s.URL, projectID, locationID, datasetID, hl7V2StoreID)
+	c.retry = fastRetry
+	c.retry.AttemptTimeout = 50 * time.Millisecond
+	ack, err := c.Send(context.Background(), cannedMsg)
+	if err != nil || !reflect.DeepEqual(ack, cannedAck) {
+		t.Errorf("Send() returned %s, %v, want %s", ack, err, cannedAck)
+	}
+	if got := s.requestCount(); got != 2 {
+		t.Errorf("Server got %v requests, want the hung one to be retried once", got)
+	}
+}
+
+func TestSendCancelled(t *testing.T) {
+	s := newFlakyServer(100, 0, "")
+	defer s.Close()
+	c := newHL7V2Client(s.Client(), s.URL, projectID, locationID, datasetID, hl7V2StoreID)
+	c.retry = fastRetry
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Send(ctx, cannedMsg); err == nil {
+		t.Fatalf("Send() succeeded, want error")
+	}
+	if got := s.requestCount(); got != 1 {
+		t.Errorf("Server got %v requests, want no retry after the caller's deadline", got)
+	}
+
+	// Calls cancelled by the caller do not make the client unhealthy.
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		c.Send(ctx, cannedMsg)
+	}
+	if err := c.Health(); err != nil {
+		t.Errorf("Health() after cancelled calls = %v, want nil", err)
+	}
+}
+
+func TestGetRetry(t *testing.T) {
+	s := newFlakyServer(2, http.StatusInternalServerError, "")
+	defer s.Close()
+	c := newHL7V2Client(s.Client(), s.URL, projectID, locationID, datasetID, hl7V2StoreID)
+	c.retry = fastRetry
+	msg, err := c.Get(context.Background(), util.GenerateHL7V2MessageName(projectID, locationID, datasetID, hl7V2StoreID, msgID))
+	if err != nil {
+		t.Fatalf("Get() returned %v", err)
+	}
+	if !reflect.DeepEqual(msg, cannedMsg) {
+		t.Errorf("Get() returned %s, want %s", msg, cannedMsg)
+	}
+	testingutil.CheckMetrics(t, c.metrics.(*testingutil.FakeMonitoringClient), map[string]int64{fetchedMetric: 1, fetchRetryMetric: 2, fetchErrorMetric: 0})
+}
+
+func TestHealth(t *testing.T) {
+	s := newFlakyServer(4, http.StatusServiceUnavailable, "")
+	defer s.Close()
+	c := newHL7V2Client(s.Client(), s.URL, projectID, locationID, datasetID, hl7V2StoreID)
+	c.retry = RetryPolicy{MaxAttempts: 1}
+	for i := 0; i < 3; i++ {
+		if err := c.Health(); err != nil {
+			t.Errorf("Health() after %d failed calls = %v, want nil", i, err)
+		}
+		c.Send(context.Background(), cannedMsg)
+	}
+	if err := c.Health(); err == nil {
+		t.Errorf("Health() after 3 failed calls = nil, want error")
+	}
+	// A message rejected by the store does not count.
+	c.record(&googleapi.Error{Code: http.StatusBadRequest})
+	if err := c.Health(); err != nil {
+		t.Errorf("Health() after a rejected message = %v, want nil", err)
+	}
+	for i := 0; i < 3; i++ {
+		c.record(&googleapi.Error{Code: http.StatusForbidden})
+	}
+	if err := c.Health(); err == nil {
+		t.Errorf("Health() after 3 refused calls = nil, want error")
+	}
+	if _, err := c.Send(context.Background(), cannedMsg); err == nil {
+		t.Fatalf("Send() succeeded, want error")
+	}
+	if err := c.Health(); err == nil {
+		t.Errorf("Health() after 4 failed calls = nil, want error")
+	}
+	if _, err := c.Send(context.Background(), cannedMsg); err != nil {
+		t.Fatalf("Send() = %v", err)
+	}
+	if err := c.Health(); err != nil {
+		t.Errorf("Health() after a successful call = %v, want nil", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{BaseBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for n, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if got := p.backoff(n); got != want {
+			t.Errorf("backoff(%v) = %v, want %v", n, got, want)
+		}
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.backoff(1); got < 500*time.Millisecond || got > time.Second {
+			t.Fatalf("backoff(1) with jitter = %v, want within [500ms, 1s]", got)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hl7
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// processStart is the start time of the process in milliseconds, in base
+	// 36. It takes 8 characters until 2059.
+	processStart = strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 36)
+	// controlIDs is the number of control IDs generated, accessed atomically.
+	controlIDs uint64
+)
+
+// NewControlID returns a new control ID for a message built by the adapter,
+// e.g. the MSH-10 of an ACK. It is prefix followed by the start time of the
+// process and a counter, both in base 36, so that IDs are unique and fit in
+// the 20 characters of the field with a prefix of up to 3 characters.
+func NewControlID(prefix string) string {
+	return prefix + processStart + strconv.FormatUint(atomic.AddUint64(&controlIDs, 1), 36)
+}
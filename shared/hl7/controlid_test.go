@@ -0,0 +1,34 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hl7
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewControlID(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id := NewControlID("ACK")
+		if !strings.HasPrefix(id, "ACK") || len(id) > 20 {
+			t.Errorf("NewControlID(%q) = %q, want at most 20 characters starting with the prefix", "ACK", id)
+		}
+		if seen[id] {
+			t.Errorf("NewControlID returned %q twice", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hl7
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// Decode replaces the escape sequences in s: \F\, \S\, \T\, \R\ and \E\
+// become the delimiter they stand for and \Xhh...\ the bytes hh... Other
+// sequences, such as formatting commands or character set changes, are left
+// as they are.
+func (d Delimiters) Decode(s string) string {
+	if d.Escape == 0 || strings.IndexByte(s, d.Escape) < 0 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != d.Escape {
+			b.WriteByte(s[i])
+			continue
+		}
+		end := strings.IndexByte(s[i+1:], d.Escape)
+		if end < 0 {
+			b.WriteString(s[i:])
+			break
+		}
+		seq := s[i+1 : i+1+end]
+		if r, ok := d.unescape(seq); ok {
+			b.WriteString(r)
+		} else {
+			b.WriteString(s[i : i+end+2])
+		}
+		i += end + 1
+	}
+	return b.String()
+}
+
+func (d Delimiters) unescape(seq string) (string, bool) {
+	var c byte
+	switch seq {
+	case "F":
+		c = d.Field
+	case "S":
+		c = d.Component
+	case "T":
+		c = d.Subcomponent
+	case "R":
+		c = d.Repetition
+	case "E":
+		c = d.Escape
+	default:
+		if len(seq) > 1 && seq[0] == 'X' {
+			if b, err := hex.DecodeString(seq[1:]); err == nil {
+				return string(b), true
+			}
+		}
+		return "", false
+	}
+	if c == 0 {
+		return "", false
+	}
+	return string(c), true
+}
+
+// Encode escapes the delimiters in s, and line endings that would otherwise
+// end the segment, so that s can be used as a value.
+func (d Delimiters) Encode(s string) string {
+	if d.Escape == 0 {
+		return s
+	}
+	seqs := map[byte]string{
+		d.Field:        "F",
+		d.Component:    "S",
+		d.Subcomponent: "T",
+		d.Repetition:   "R",
+		d.Escape:       "E",
+		'\r':           "X0D",
+		'\n':           "X0A",
+	}
+	delete(seqs, 0)
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		seq, ok := seqs[s[i]]
+		if !ok {
+			b.WriteByte(s[i])
+			continue
+		}
+		b.WriteByte(d.Escape)
+		b.WriteString(seq)
+		b.WriteByte(d.Escape)
+	}
+	return b.String()
+}
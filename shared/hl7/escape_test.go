@@ -0,0 +1,70 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hl7
+
+import (
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	testCases := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"a\\F\\b\\S\\c\\T\\d\\R\\e\\E\\f", "a|b^c&d~e\\f"},
+		{"\\X0D0A\\", "\r\n"},
+		{"\\X41\\BC", "ABC"},
+		// Formatting and unknown sequences are kept.
+		{"line\\.br\\break", "line\\.br\\break"},
+		{"\\H\\bold\\N\\", "\\H\\bold\\N\\"},
+		{"\\XZZ\\", "\\XZZ\\"},
+		// An unterminated sequence is kept.
+		{"a\\F", "a\\F"},
+	}
+	for _, tc := range testCases {
+		if got := DefaultDelimiters.Decode(tc.in); got != tc.want {
+			t.Errorf("Decode(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	testCases := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"a|b^c&d~e\\f", "a\\F\\b\\S\\c\\T\\d\\R\\e\\E\\f"},
+		{"one\rtwo\n", "one\\X0D\\two\\X0A\\"},
+	}
+	for _, tc := range testCases {
+		got := DefaultDelimiters.Encode(tc.in)
+		if got != tc.want {
+			t.Errorf("Encode(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+		if back := DefaultDelimiters.Decode(got); back != tc.in {
+			t.Errorf("Decode(Encode(%q)) = %q", tc.in, back)
+		}
+	}
+}
+
+func TestEncodeCustomDelimiters(t *testing.T) {
+	d := Delimiters{Field: '#', Component: '$', Repetition: '%', Escape: '*', Subcomponent: '@'}
+	if got, want := d.Encode("a#b|c"), "a*F*b|c"; got != want {
+		t.Errorf("Encode() = %q, want %q", got, want)
+	}
+	if got, want := d.Decode("a*F*b*S*c"), "a#b$c"; got != want {
+		t.Errorf("Decode() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hl7 parses HL7 v2 messages into segments, fields, repetitions,
+// components and subcomponents. Values are kept in their escaped form so that
+// a parsed message serializes back to exactly the bytes it was parsed from.
+package hl7
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Delimiters are the separators and escape character of a message, defined by
+// MSH-1 and MSH-2. A zero byte means the delimiter is not used.
+type Delimiters struct {
+	Field        byte
+	Component    byte
+	Repetition   byte
+	Escape       byte
+	Subcomponent byte
+}
+
+// DefaultDelimiters are the delimiters recommended by the standard, "|^~\&".
+var DefaultDelimiters = Delimiters{Field: '|', Component: '^', Repetition: '~', Escape: '\\', Subcomponent: '&'}
+
+// Message is a parsed HL7 v2 message.
+type Message struct {
+	Delimiters Delimiters
+	Segments   []*Segment
+}
+
+// Segment is a single segment of a message.
+type Segment struct {
+	Name string
+	// Fields holds the fields of the segment, Fields[0] being field 1. In
+	// header segments (MSH, FHS and BHS) field 1 is the field separator and
+	// field 2 the encoding characters, neither of which is split further.
+	Fields []Field
+	// Terminator holds the line ending characters that followed the segment,
+	// usually "\r". It is empty for a last segment without one.
+	Terminator string
+}
+
+// Field is a field made up of one or more repetitions.
+type Field []Repetition
+
+// Repetition is one occurrence of a repeating field.
+type Repetition []Component
+
+// Component is a component made up of one or more subcomponents, still in
+// their escaped form.
+type Component []string
+
+// headers are the segments that define delimiters at their start.
+var headers = map[string]bool{"MSH": true, "FHS": true, "BHS": true}
+
+// Parse parses an HL7 v2 message, which must start with an MSH, FHS or BHS
+// segment.
+func Parse(data []byte) (*Message, error) {
+	if len(data) < 5 || !headers[string(data[:3])] {
+		return nil, fmt.Errorf("message does not start with an MSH, FHS or BHS segment")
+	}
+	d, err := parseDelimiters(data)
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{Delimiters: d}
+	rest := string(data)
+	for len(rest) > 0 {
+		end := strings.IndexAny(rest, "\r\n")
+		if end < 0 {
+			end = len(rest)
+		}
+		termEnd := end
+		for termEnd < len(rest) && (rest[termEnd] == '\r' || rest[termEnd] == '\n') {
+			termEnd++
+		}
+		m.Segments = append(m.Segments, d.parseSegment(rest[:end], rest[end:termEnd]))
+		rest = rest[termEnd:]
+	}
+	return m, nil
+}
+
+// parseDelimiters reads the delimiters from the start of a header segment.
+func parseDelimiters(data []byte) (Delimiters, error) {
+	d := Delimiters{Field: data[3]}
+	if isText(d.Field) {
+		return d, fmt.Errorf("invalid field separator %q", d.Field)
+	}
+	enc := data[4:]
+	if i := bytes.IndexAny(enc, string([]byte{d.Field, '\r', '\n'})); i >= 0 {
+		enc = enc[:i]
+	}
+	if len(enc) == 0 {
+		return d, fmt.Errorf("missing encoding characters")
+	}
+	seen := map[byte]bool{d.Field: true}
+	for _, c := range enc {
+		if isText(c) || seen[c] {
+			return d, fmt.Errorf("invalid encoding characters %q", enc)
+		}
+		seen[c] = true
+	}
+	// Any character past the fourth, such as the v2.7 truncation character,
+	// is not a delimiter.
+	for i, p := range []*byte{&d.Component, &d.Repetition, &d.Escape, &d.Subcomponent} {
+		if i < len(enc) {
+			*p = enc[i]
+		}
+	}
+	return d, nil
+}
+
+func isText(c byte) bool {
+	return c == '\r' || c == '\n' || c == ' ' ||
+		'0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func (d Delimiters) parseSegment(line, terminator string) *Segment {
+	parts := split(line, d.Field)
+	s := &Segment{Name: parts[0], Terminator: terminator}
+	parts = parts[1:]
+	if headers[s.Name] && len(parts) > 0 {
+		s.Fields = append(s.Fields, Field{{{string(d.Field)}}}, Field{{{parts[0]}}})
+		parts = parts[1:]
+	}
+	for _, p := range parts {
+		s.Fields = append(s.Fields, d.parseField(p))
+	}
+	return s
+}
+
+func (d Delimiters) parseField(s string) Field {
+	var f Field
+	for _, r := range split(s, d.Repetition) {
+		var rep Repetition
+		for _, c := range split(r, d.Component) {
+			rep = append(rep, Component(split(c, d.Subcomponent)))
+		}
+		f = append(f, rep)
+	}
+	return f
+}
+
+func split(s string, sep byte) []string {
+	if sep == 0 {
+		return []string{s}
+	}
+	return strings.Split(s, string(sep))
+}
+
+func join(parts []string, sep byte) string {
+	if sep == 0 {
+		return strings.Join(parts, "")
+	}
+	return strings.Join(parts, string(sep))
+}
+
+// Bytes serializes the message. For a message returned by Parse that has not
+// been modified, the result is identical to the parsed data.
+func (m *Message) Bytes() []byte {
+	var b bytes.Buffer
+	for _, s := range m.Segments {
+		b.WriteString(s.Encode(m.Delimiters))
+		b.WriteString(s.Terminator)
+	}
+	return b.Bytes()
+}
+
+// Segment returns the first segment called name, or nil if there is none.
+func (m *Message) Segment(name string) *Segment {
+	for _, s := range m.Segments {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Encode serializes the segment, without its terminator.
+func (s *Segment) Encode(d Delimiters) string {
+	fields := s.Fields
+	if headers[s.Name] && len(fields) > 0 {
+		// The field separator is written between the name and MSH-2 anyway.
+		fields = fields[1:]
+	}
+	parts := []string{s.Name}
+	for _, f := range fields {
+		parts = append(parts, f.Encode(d))
+	}
+	return join(parts, d.Field)
+}
+
+// Field returns field n, counting from 1, or nil if the segment has fewer
+// fields.
+func (s *Segment) Field(n int) Field {
+	if n < 1 || n > len(s.Fields) {
+		return nil
+	}
+	return s.Fields[n-1]
+}
+
+// Encode serializes the field.
+func (f Field) Encode(d Delimiters) string {
+	var parts []string
+	for _, r := range f {
+		parts = append(parts, r.Encode(d))
+	}
+	return join(parts, d.Repetition)
+}
+
+// Repetition returns repetition n, counting from 1, or nil if there is none.
+func (f Field) Repetition(n int) Repetition {
+	if n < 1 || n > len(f) {
+		return nil
+	}
+	return f[n-1]
+}
+
+// Encode serializes the repetition.
+func (r Repetition) Encode(d Delimiters) string {
+	var parts []string
+	for _, c := range r {
+		parts = append(parts, c.Encode(d))
+	}
+	return join(parts, d.Component)
+}
+
+// Component returns component n, counting from 1, or nil if there is none.
+func (r Repetition) Component(n int) Component {
+	if n < 1 || n > len(r) {
+		return nil
+	}
+	return r[n-1]
+}
+
+// Encode serializes the component.
+func (c Component) Encode(d Delimiters) string {
+	return join(c, d.Subcomponent)
+}
+
+// Subcomponent returns subcomponent n, counting from 1, or "" if there is
+// none.
+func (c Component) Subcomponent(n int) string {
+	if n < 1 || n > len(c) {
+		return ""
+	}
+	return c[n-1]
+}
+
+// locationRE matches locations like "MSH-9", "PID-3(2).1" or "PID-5.1.2".
+var locationRE = regexp.MustCompile(`^([A-Z][A-Z0-9]{2})-([0-9]+)(?:\(([0-9]+)\))?(?:\.([0-9]+))?(?:\.([0-9]+))?$`)
+
+// Get returns the escaped value at loc, written as SEG-F(R).C.S, for example
+// "MSH-9.2" or "PID-3(2).1". The repetition, component and subcomponent are
+// optional; if the repetition is left out the first one is used, and if the
+// component or subcomponent are left out the whole element is returned with
+// its delimiters. The first segment with the given name is used. Elements
+// missing from the message are returned as "".
+func (m *Message) Get(loc string) (string, error) {
+	match := locationRE.FindStringSubmatch(loc)
+	if match == nil {
+		return "", fmt.Errorf("invalid location %q", loc)
+	}
+	idx := make([]int, 4)
+	for i, s := range match[2:] {
+		idx[i] = 1
+		if s != "" {
+			idx[i], _ = strconv.Atoi(s)
+		}
+	}
+	s := m.Segment(match[1])
+	if s == nil {
+		return "", nil
+	}
+	r := s.Field(idx[0]).Repetition(idx[1])
+	switch {
+	case match[4] == "":
+		return r.Encode(m.Delimiters), nil
+	case match[5] == "":
+		return r.Component(idx[2]).Encode(m.Delimiters), nil
+	}
+	return r.Component(idx[2]).Subcomponent(idx[3]), nil
+}
+
+// Value is like Get but returns the value with its escape sequences decoded.
+// It is meant for elements that are not split any further.
+func (m *Message) Value(loc string) (string, error) {
+	v, err := m.Get(loc)
+	if err != nil {
+		return "", err
+	}
+	return m.Delimiters.Decode(v), nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hl7
+
+import (
+	"reflect"
+	"testing"
+)
+
+const adt = "MSH|^~\\&|SENDAPP|SENDFAC|RECVAPP|RECVFAC|20180101000000||ADT^A01^ADT_A01|CTRL1|P|2.5\r" +
+	"PID|||123^^^HOSP&1.2.3&ISO~456^^^CLINIC||Doe^John\\S\\Jr||19700101|M\r" +
+	"NTE|1||Line one\\X0D\\line two \\T\\ more\r"
+
+func TestParse(t *testing.T) {
+	m, err := Parse([]byte(adt))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if m.Delimiters != DefaultDelimiters {
+		t.Errorf("Delimiters = %+v, want %+v", m.Delimiters, DefaultDelimiters)
+	}
+	var names []string
+	for _, s := range m.Segments {
+		names = append(names, s.Name)
+	}
+	if want := []string{"MSH", "PID", "NTE"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Segments = %v, want %v", names, want)
+	}
+	pid3 := m.Segment("PID").Field(3)
+	want := Field{
+		{{"123"}, {""}, {""}, {"HOSP", "1.2.3", "ISO"}},
+		{{"456"}, {""}, {""}, {"CLINIC"}},
+	}
+	if !reflect.DeepEqual(pid3, want) {
+		t.Errorf("PID-3 = %q, want %q", pid3, want)
+	}
+	if got := m.Segment("MSH").Field(2); !reflect.DeepEqual(got, Field{{{"^~\\&"}}}) {
+		t.Errorf("MSH-2 = %q, want the encoding characters unsplit", got)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, msg := range []string{
+		adt,
+		// No trailing terminator, Unix and Windows line endings.
+		"MSH|^~\\&|A|B\nPID|1\r\nPV1",
+		// Empty fields, segments without fields and a blank line.
+		"MSH|^~\\&|||||||||\rZZZ\r\rZZ1|\r",
+		// Non-standard delimiters and a truncation character.
+		"MSH#$%*@#A$B%C@D#E\rPID#1$2%3\r",
+		"MSH|^~\\&#|A\r",
+		// Batches start with other header segments.
+		"FHS|^~\\&|A\rBHS|^~\\&|B\rMSH|^~\\&|C\rBTS|1\rFTS|1\r",
+	} {
+		m, err := Parse([]byte(msg))
+		if err != nil {
+			t.Errorf("Parse(%q): %v", msg, err)
+			continue
+		}
+		if got := string(m.Bytes()); got != msg {
+			t.Errorf("Bytes() = %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, msg := range []string{
+		"",
+		"PID|1\r",
+		"MSH",
+		"MSH||\r",
+		"MSHA^~\\&\r",
+		"MSH|^^\\&\r",
+	} {
+		if _, err := Parse([]byte(msg)); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", msg)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	m, err := Parse([]byte(adt))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	testCases := []struct {
+		loc       string
+		wantRaw   string
+		wantValue string
+	}{
+		{"MSH-1", "|", "|"},
+		{"MSH-2", "^~\\&", "^~\\&"},
+		{"MSH-9", "ADT^A01^ADT_A01", "ADT^A01^ADT_A01"},
+		{"MSH-9.2", "A01", "A01"},
+		{"MSH-10", "CTRL1", "CTRL1"},
+		{"PID-3", "123^^^HOSP&1.2.3&ISO", "123^^^HOSP&1.2.3&ISO"},
+		{"PID-3(2).1", "456", "456"},
+		{"PID-3.4.2", "1.2.3", "1.2.3"},
+		{"PID-5.2", "John\\S\\Jr", "John^Jr"},
+		{"NTE-3", "Line one\\X0D\\line two \\T\\ more", "Line one\rline two & more"},
+		{"PID-30", "", ""},
+		{"PID-3(5)", "", ""},
+		{"OBX-1", "", ""},
+	}
+	for _, tc := range testCases {
+		raw, err := m.Get(tc.loc)
+		if err != nil {
+			t.Errorf("Get(%q): %v", tc.loc, err)
+		}
+		if raw != tc.wantRaw {
+			t.Errorf("Get(%q) = %q, want %q", tc.loc, raw, tc.wantRaw)
+		}
+		value, err := m.Value(tc.loc)
+		if err != nil {
+			t.Errorf("Value(%q): %v", tc.loc, err)
+		}
+		if value != tc.wantValue {
+			t.Errorf("Value(%q) = %q, want %q", tc.loc, value, tc.wantValue)
+		}
+	}
+	for _, loc := range []string{"", "MSH", "MSH-", "msh-9", "MSH-9.1.2.3", "MSH-a"} {
+		if _, err := m.Get(loc); err == nil {
+			t.Errorf("Get(%q) succeeded, want error", loc)
+		}
+	}
+}
+
+func TestModify(t *testing.T) {
+	m, err := Parse([]byte("MSH|^~\\&|A|B\rPID|1\r"))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	m.Segment("PID").Fields = append(m.Segment("PID").Fields, Field{{{m.Delimiters.Encode("a|b")}}})
+	if got, want := string(m.Bytes()), "MSH|^~\\&|A|B\rPID|1|a\\F\\b\r"; got != want {
+		t.Errorf("Bytes() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hl7batch splits HL7 v2 batches, messages wrapped in FHS/BHS headers
+// and BTS/FTS trailers, into their messages and builds batch
+// acknowledgements.
+package hl7batch
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/GoogleCloudPlatform/mllp/shared/hl7"
+)
+
+const hl7Time = "20060102150405"
+
+// Batch is a batch with at most one FHS and one BHS segment.
+type Batch struct {
+	Delimiters hl7.Delimiters
+	// FileHeader and BatchHeader are the FHS and BHS segments, or nil if
+	// the batch has none.
+	FileHeader  *hl7.Segment
+	BatchHeader *hl7.Segment
+	// Messages holds the messages of the batch, each starting with its MSH
+	// segment, in their original encoding.
+	Messages [][]byte
+}
+
+// IsBatch reports whether data starts with an FHS or BHS segment.
+func IsBatch(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("FHS")) || bytes.HasPrefix(data, []byte("BHS"))
+}
+
+// Split parses a batch. It fails if the batch is not well formed, or if the
+// message count in BTS-1 does not match the messages found, which usually
+// means the batch was truncated.
+func Split(data []byte) (*Batch, error) {
+	if !IsBatch(data) {
+		return nil, fmt.Errorf("batch does not start with an FHS or BHS segment")
+	}
+	parsed, err := hl7.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	b := &Batch{Delimiters: parsed.Delimiters}
+	var msg *hl7.Message
+	var bts, fts *hl7.Segment
+	flush := func() {
+		if msg != nil {
+			b.Messages = append(b.Messages, msg.Bytes())
+			msg = nil
+		}
+	}
+	for _, s := range parsed.Segments {
+		if s.Name == "" {
+			// A blank line.
+			continue
+		}
+		if fts != nil {
+			return nil, fmt.Errorf("%v segment after FTS", s.Name)
+		}
+		if bts != nil && s.Name != "FTS" {
+			return nil, fmt.Errorf("%v segment after BTS", s.Name)
+		}
+		switch s.Name {
+		case "FHS":
+			if b.FileHeader != nil || b.BatchHeader != nil {
+				return nil, fmt.Errorf("unexpected FHS segment")
+			}
+			b.FileHeader = s
+		case "BHS":
+			if b.BatchHeader != nil {
+				return nil, fmt.Errorf("batch files with more than one batch are not supported")
+			}
+			if msg != nil {
+				return nil, fmt.Errorf("BHS segment after the first message")
+			}
+			b.BatchHeader = s
+		case "MSH":
+			flush()
+			msg = &hl7.Message{Delimiters: b.Delimiters}
+			msg.Segments = append(msg.Segments, s)
+		case "BTS":
+			flush()
+			bts = s
+		case "FTS":
+			if b.FileHeader == nil {
+				return nil, fmt.Errorf("FTS segment without FHS")
+			}
+			flush()
+			fts = s
+		default:
+			if msg == nil {
+				return nil, fmt.Errorf("%v segment outside of a message", s.Name)
+			}
+			msg.Segments = append(msg.Segments, s)
+		}
+	}
+	flush()
+	if bts != nil {
+		if count := bts.Field(1).Encode(b.Delimiters); count != "" {
+			n, err := strconv.Atoi(count)
+			if err != nil {
+				return nil, fmt.Errorf("invalid message count %q in BTS-1", count)
+			}
+			if n != len(b.Messages) {
+				return nil, fmt.Errorf("BTS-1 counts %d messages, found %d", n, len(b.Messages))
+			}
+		}
+	}
+	return b, nil
+}
+
+// Ack builds the acknowledgement of b from the ACKs of its messages, in
+// order. The response has the same FHS and BHS headers as b, addressed back to
+// the sender and referring to the control IDs of b in FHS-12 and BHS-12.
+func (b *Batch) Ack(acks [][]byte) []byte {
+	now := time.Now()
+	var out bytes.Buffer
+	header := func(in *hl7.Segment, name string) {
+		if in == nil {
+			return
+		}
+		d := b.Delimiters
+		field := func(n int) string { return in.Field(n).Encode(d) }
+		s := &hl7.Segment{Name: name, Fields: []hl7.Field{
+			in.Field(1), in.Field(2),
+			value(field(5)), value(field(6)), value(field(3)), value(field(4)),
+			value(now.Format(hl7Time)), nil, nil, nil,
+			value(hl7.NewControlID(name)),
+			value(field(11)),
+		}}
+		out.WriteString(s.Encode(d))
+		out.WriteByte('\r')
+	}
+	header(b.FileHeader, "FHS")
+	header(b.BatchHeader, "BHS")
+	for _, ack := range acks {
+		out.Write(ack)
+		if !bytes.HasSuffix(ack, []byte("\r")) && !bytes.HasSuffix(ack, []byte("\n")) {
+			out.WriteByte('\r')
+		}
+	}
+	if b.BatchHeader != nil {
+		fmt.Fprintf(&out, "BTS%c%d\r", b.Delimiters.Field, len(acks))
+	}
+	if b.FileHeader != nil {
+		batches := 0
+		if b.BatchHeader != nil {
+			batches = 1
+		}
+		fmt.Fprintf(&out, "FTS%c%d\r", b.Delimiters.Field, batches)
+	}
+	return out.Bytes()
+}
+
+// value returns a field holding the already escaped value v.
+func value(v string) hl7.Field {
+	return hl7.Field{{{v}}}
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hl7batch
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const (
+	msg1 = "MSH|^~\\&|APP|FAC|RECV|RECVFAC|20180101000000||ADT^A01|CTRL1|P|2.5\rPID|1\r"
+	msg2 = "MSH|^~\\&|APP|FAC|RECV|RECVFAC|20180101000000||ADT^A08|CTRL2|P|2.5\rPID|2\rNTE|1\r"
+	fhs  = "FHS|^~\\&|APP|FAC|RECV|RECVFAC|20180101000000||||FILE1\r"
+	bhs  = "BHS|^~\\&|APP|FAC|RECV|RECVFAC|20180101000000||||BATCH1\r"
+)
+
+func TestSplit(t *testing.T) {
+	testCases := []struct {
+		name     string
+		in       string
+		file     bool
+		batch    bool
+		wantMsgs []string
+	}{
+		{"file", fhs + bhs + msg1 + msg2 + "BTS|2\rFTS|1\r", true, true, []string{msg1, msg2}},
+		{"batch", bhs + msg1 + "BTS|1\r", false, true, []string{msg1}},
+		{"no trailers", bhs + msg1 + msg2, false, true, []string{msg1, msg2}},
+		{"empty count", bhs + msg1 + "BTS\r", false, true, []string{msg1}},
+		{"empty batch", bhs + "BTS|0\r", false, true, nil},
+		{"file without batch", fhs + msg1 + "FTS|0\r", true, false, []string{msg1}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := Split([]byte(tc.in))
+			if err != nil {
+				t.Fatalf("Split: %v", err)
+			}
+			if got := b.FileHeader != nil; got != tc.file {
+				t.Errorf("FileHeader present = %v, want %v", got, tc.file)
+			}
+			if got := b.BatchHeader != nil; got != tc.batch {
+				t.Errorf("BatchHeader present = %v, want %v", got, tc.batch)
+			}
+			var got []string
+			for _, m := range b.Messages {
+				got = append(got, string(m))
+			}
+			if !reflect.DeepEqual(got, tc.wantMsgs) {
+				t.Errorf("Messages = %q, want %q", got, tc.wantMsgs)
+			}
+		})
+	}
+}
+
+func TestSplitErrors(t *testing.T) {
+	for _, in := range []string{
+		msg1,
+		bhs + "PID|1\r" + msg1,
+		bhs + msg1 + "BTS|2\r",
+		bhs + msg1 + "BTS|x\r",
+		bhs + msg1 + "BTS|1\r" + msg2,
+		bhs + msg1 + bhs + msg2,
+		fhs + bhs + msg1 + "BTS|1\r" + bhs + msg2 + "BTS|1\rFTS|2\r",
+		bhs + msg1 + "FTS|1\r",
+		fhs + msg1 + "FTS|0\rPID|1\r",
+	} {
+		if _, err := Split([]byte(in)); err == nil {
+			t.Errorf("Split(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func TestAck(t *testing.T) {
+	b, err := Split([]byte(fhs + bhs + msg1 + msg2 + "BTS|2\rFTS|1\r"))
+	if err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+	got := string(b.Ack([][]byte{
+		[]byte("MSH|^~\\&|RECV|RECVFAC|APP|FAC|20180101000001||ACK^A01^ACK|A1|P|2.5\rMSA|AA|CTRL1\r"),
+		// A missing terminator is added.
+		[]byte("MSH|^~\\&|RECV|RECVFAC|APP|FAC|20180101000001||ACK^A08^ACK|A2|P|2.5\rMSA|AE|CTRL2"),
+	}))
+	want := regexp.MustCompile(`^FHS\|\^~\\&\|RECV\|RECVFAC\|APP\|FAC\|\d{14}\|\|\|\|FHS[0-9a-z]+\|FILE1\r` +
+		`BHS\|\^~\\&\|RECV\|RECVFAC\|APP\|FAC\|\d{14}\|\|\|\|BHS[0-9a-z]+\|BATCH1\r` +
+		`MSH\|[^\r]*\rMSA\|AA\|CTRL1\r` +
+		`MSH\|[^\r]*\rMSA\|AE\|CTRL2\r` +
+		`BTS\|2\rFTS\|1\r$`)
+	if !want.MatchString(got) {
+		t.Errorf("Ack() = %q, want match for %v", got, want)
+	}
+	for _, s := range strings.Split(got, "\r")[:2] {
+		if id := strings.Split(s, "|")[10]; len(id) > 20 {
+			t.Errorf("Control ID %q of %.3s is longer than 20 characters", id, s)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitoring
+
+import (
+	"bytes"
+	"net"
+	"regexp"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/mllp/shared/hl7"
+)
+
+// Label keys shared by the components of the adapter.
+const (
+	// AckCodeKey is the acknowledgment code (MSA-1) of an ACK.
+	AckCodeKey = "ack_code"
+	// ListenerKey is the name of the MLLP listener that received a message.
+	ListenerKey = "listener"
+	// MessageTypeKey is the message code and trigger event (MSH-9.1 and
+	// MSH-9.2) of a message.
+	MessageTypeKey = "message_type"
+	// PeerKey is the IP address of the other end of a connection.
+	PeerKey = "peer"
+	// RouteKey is the name of the route a message was sent to.
+	RouteKey = "route"
+	// StoreKey is the resource name of an HL7v2 store.
+	StoreKey = "store"
+)
+
+const (
+	// MaxLabelValues is the number of distinct values a label of one metric
+	// can take. Further values are recorded as OtherValue, so that a
+	// misbehaving partner cannot create an unbounded number of time series.
+	MaxLabelValues = 100
+	// OtherValue replaces label values that are over the limit or malformed.
+	OtherValue = "other"
+	// NoneValue is recorded when there is nothing to take a value from, e.g.
+	// no ACK was received.
+	NoneValue = "none"
+)
+
+// Label is the value of a label key for one recording of a metric.
+type Label struct {
+	Key   string
+	Value string
+}
+
+var (
+	ackCodes = map[string]bool{"AA": true, "AE": true, "AR": true, "CA": true, "CE": true, "CR": true}
+	// messageTypeRE matches message types like "ADT" or "ADT^A01".
+	messageTypeRE = regexp.MustCompile(`^[A-Z0-9]{3}(\^[A-Z0-9]{2,3})?$`)
+)
+
+// MessageType returns the message code and trigger event of msg as a label,
+// e.g. "ADT^A01". Messages without a readable MSH-9 get OtherValue.
+func MessageType(msg []byte) Label {
+	// Only the MSH segment is parsed.
+	if i := bytes.IndexAny(msg, "\r\n"); i >= 0 {
+		msg = msg[:i]
+	}
+	v := OtherValue
+	if parsed, err := hl7.Parse(msg); err == nil {
+		code, _ := parsed.Value("MSH-9.1")
+		event, _ := parsed.Value("MSH-9.2")
+		if event != "" {
+			code += "^" + event
+		}
+		if messageTypeRE.MatchString(code) {
+			v = code
+		}
+	}
+	return Label{Key: MessageTypeKey, Value: v}
+}
+
+// AckCode returns the acknowledgment code of ack (MSA-1) as a label.
+// NoneValue is used if ack is empty and OtherValue if it has no valid code.
+func AckCode(ack []byte) Label {
+	if len(ack) == 0 {
+		return Label{Key: AckCodeKey, Value: NoneValue}
+	}
+	v := OtherValue
+	if parsed, err := hl7.Parse(ack); err == nil {
+		if code, _ := parsed.Value("MSA-1"); ackCodes[code] {
+			v = code
+		}
+	}
+	return Label{Key: AckCodeKey, Value: v}
+}
+
+// Peer returns the IP address of addr as a label, leaving out the port,
+// which changes with every connection.
+func Peer(addr net.Addr) Label {
+	v := OtherValue
+	if addr != nil {
+		v = addr.String()
+		if host, _, err := net.SplitHostPort(v); err == nil {
+			v = host
+		}
+	}
+	return Label{Key: PeerKey, Value: v}
+}
+
+// Listener returns the name of an MLLP listener as a label.
+func Listener(name string) Label {
+	return Label{Key: ListenerKey, Value: name}
+}
+
+// Route returns the name of a route as a label.
+func Route(name string) Label {
+	return Label{Key: RouteKey, Value: name}
+}
+
+// Store returns the resource name of an HL7v2 store as a label.
+func Store(name string) Label {
+	return Label{Key: StoreKey, Value: name}
+}
+
+// labelLimiter caps the number of distinct values of each label of each
+// metric at MaxLabelValues. The zero value is ready for use.
+type labelLimiter struct {
+	mu sync.Mutex
+	// seen holds the values recorded so far, by metric and label key.
+	seen map[[2]string]map[string]bool
+}
+
+// limit returns labels with the values over the limit replaced by
+// OtherValue.
+func (l *labelLimiter) limit(name string, labels []Label) []Label {
+	if len(labels) == 0 {
+		return labels
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seen == nil {
+		l.seen = make(map[[2]string]map[string]bool)
+	}
+	out := make([]Label, len(labels))
+	for i, lb := range labels {
+		k := [2]string{name, lb.Key}
+		values := l.seen[k]
+		if values == nil {
+			values = make(map[string]bool)
+			l.seen[k] = values
+		}
+		if !values[lb.Value] {
+			if len(values) >= MaxLabelValues {
+				lb.Value = OtherValue
+			} else {
+				values[lb.Value] = true
+			}
+		}
+		out[i] = lb
+	}
+	return out
+}
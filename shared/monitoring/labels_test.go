@@ -0,0 +1,122 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitoring
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"go.opencensus.io/stats/view"
+)
+
+func TestMessageType(t *testing.T) {
+	testCases := []struct {
+		msg  string
+		want string
+	}{
+		{"MSH|^~\\&|A|B|C|D|20180101000000||ADT^A01|1|P|2.5\rPID|1\r", "ADT^A01"},
+		{"MSH|^~\\&|A|B|C|D|20180101000000||ADT^A01^ADT_A01|1|P|2.5\r", "ADT^A01"},
+		{"MSH|^~\\&|A|B|C|D|20180101000000||ORU|1|P|2.5\r", "ORU"},
+		{"MSH|^~\\&|A|B|C|D|20180101000000||adt^a01\"|1|P|2.5\r", OtherValue},
+		{"MSH|^~\\&|A|B|C|D|20180101000000|||1|P|2.5\r", OtherValue},
+		{"garbage", OtherValue},
+		{"", OtherValue},
+	}
+	for _, tc := range testCases {
+		if got := MessageType([]byte(tc.msg)); got != (Label{MessageTypeKey, tc.want}) {
+			t.Errorf("MessageType(%q) = %v, want %v", tc.msg, got, tc.want)
+		}
+	}
+}
+
+func TestAckCode(t *testing.T) {
+	testCases := []struct {
+		ack  string
+		want string
+	}{
+		{"MSH|^~\\&|A|B|C|D|20180101000000||ACK|1|P|2.5\rMSA|AA|1\r", "AA"},
+		{"MSH|^~\\&|A|B|C|D|20180101000000||ACK|1|P|2.5\rMSA|CR|1\r", "CR"},
+		{"MSH|^~\\&|A|B|C|D|20180101000000||ACK|1|P|2.5\rMSA|XX|1\r", OtherValue},
+		{"MSH|^~\\&|A|B|C|D|20180101000000||ACK|1|P|2.5\r", OtherValue},
+		{"", NoneValue},
+	}
+	for _, tc := range testCases {
+		if got := AckCode([]byte(tc.ack)); got != (Label{AckCodeKey, tc.want}) {
+			t.Errorf("AckCode(%q) = %v, want %v", tc.ack, got, tc.want)
+		}
+	}
+}
+
+func TestPeer(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 53210}
+	if got := Peer(addr); got != (Label{PeerKey, "10.0.0.1"}) {
+		t.Errorf("Peer(%v) = %v, want 10.0.0.1", addr, got)
+	}
+	if got := Peer(nil); got != (Label{PeerKey, OtherValue}) {
+		t.Errorf("Peer(nil) = %v, want %v", got, OtherValue)
+	}
+}
+
+func TestLabelLimiter(t *testing.T) {
+	var l labelLimiter
+	for i := 0; i < MaxLabelValues; i++ {
+		v := fmt.Sprintf("10.0.0.%d", i)
+		if got := l.limit("reads", []Label{{PeerKey, v}}); got[0].Value != v {
+			t.Fatalf("limit() = %v, want %v", got[0].Value, v)
+		}
+	}
+	if got := l.limit("reads", []Label{{PeerKey, "10.0.1.1"}}); got[0].Value != OtherValue {
+		t.Errorf("limit() over the limit = %v, want %v", got[0].Value, OtherValue)
+	}
+	// Values seen before and other metrics are not affected.
+	if got := l.limit("reads", []Label{{PeerKey, "10.0.0.1"}}); got[0].Value != "10.0.0.1" {
+		t.Errorf("limit() of a known value = %v, want 10.0.0.1", got[0].Value)
+	}
+	if got := l.limit("writes", []Label{{PeerKey, "10.0.1.1"}}); got[0].Value != "10.0.1.1" {
+		t.Errorf("limit() of another metric = %v, want 10.0.1.1", got[0].Value)
+	}
+}
+
+func TestLabeledCounter(t *testing.T) {
+	cl := NewExportingClient()
+	cl.NewCounter("test-labeled", "", AckCodeKey, PeerKey)
+	cl.IncCounter("test-labeled", Label{AckCodeKey, "AA"}, Label{PeerKey, "10.0.0.1"})
+	cl.IncCounter("test-labeled", Label{AckCodeKey, "AA"}, Label{PeerKey, "10.0.0.1"})
+	cl.IncCounter("test-labeled", Label{AckCodeKey, "AE"}, Label{PeerKey, "10.0.0.1"})
+
+	rows, err := view.RetrieveData(metricPrefix + "test-labeled")
+	if err != nil {
+		t.Fatalf("Failed to get counter: %v", err)
+	}
+	got := make(map[string]int64)
+	for _, r := range rows {
+		var tags []string
+		for _, tg := range r.Tags {
+			tags = append(tags, tg.Key.Name()+"="+tg.Value)
+		}
+		got[strings.Join(tags, ",")] = r.Data.(*view.CountData).Value
+	}
+	want := map[string]int64{"ack_code=AA,peer=10.0.0.1": 2, "ack_code=AE,peer=10.0.0.1": 1}
+	if len(got) != len(want) {
+		t.Errorf("Rows = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("Counter %v = %v, want %v", k, got[k], v)
+		}
+	}
+}
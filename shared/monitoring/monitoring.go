@@ -13,7 +13,7 @@
 // limitations under the License.
 
 // Package monitoring implements the functionality to export timeseries data to
-// the Cloud Monitoring service.
+// the Cloud Monitoring service, or to serve it to Prometheus.
 package monitoring
 
 import (
@@ -31,18 +31,120 @@ import (
 	timestamppb "github.com/golang/protobuf/ptypes/timestamp"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
 	"contrib.go.opencensus.io/exporter/stackdriver"
 )
 
 const scope = "https://www.googleapis.com/auth/monitoring.write"
 const metricPrefix = "custom.googleapis.com/cloud/healthcare/mllp/"
 
-// Client interface provides basic functionality to create, record and retrieve metric values
+// Client interface provides basic functionality to create, record and retrieve metric values.
+// Counters and latencies can be broken down by the label keys given when they
+// are created. Labels with other keys are ignored, and a missing label is
+// recorded with an empty value.
+//
+// Creating a metric that already exists keeps the existing one, so that
+// several instances of a component can share a client.
 type Client interface {
-	IncCounter(name string)
-	NewCounter(name, desc string)
-	AddLatency(name string, value float64)
-	NewLatency(name, desc string)
+	IncCounter(name string, labels ...Label)
+	NewCounter(name, desc string, keys ...string)
+	AddLatency(name string, value float64, labels ...Label)
+	NewLatency(name, desc string, keys ...string)
+	SetGauge(name string, value int64, labels ...Label)
+	NewGauge(name, desc string, keys ...string)
+}
+
+// WithLabels returns a client that adds labels to every metric recorded
+// through c, and their keys to every metric created, so that several
+// instances of a component can report separately under the same metric
+// names.
+func WithLabels(c Client, labels ...Label) Client {
+	return &labeledClient{c: c, labels: labels}
+}
+
+type labeledClient struct {
+	c      Client
+	labels []Label
+}
+
+func (l *labeledClient) with(labels []Label) []Label {
+	return append(append([]Label(nil), labels...), l.labels...)
+}
+
+func (l *labeledClient) keys(keys []string) []string {
+	keys = append([]string(nil), keys...)
+	for _, lb := range l.labels {
+		keys = append(keys, lb.Key)
+	}
+	return keys
+}
+
+func (l *labeledClient) IncCounter(name string, labels ...Label) {
+	l.c.IncCounter(name, l.with(labels)...)
+}
+
+func (l *labeledClient) NewCounter(name, desc string, keys ...string) {
+	l.c.NewCounter(name, desc, l.keys(keys)...)
+}
+
+func (l *labeledClient) AddLatency(name string, value float64, labels ...Label) {
+	l.c.AddLatency(name, value, l.with(labels)...)
+}
+
+func (l *labeledClient) NewLatency(name, desc string, keys ...string) {
+	l.c.NewLatency(name, desc, l.keys(keys)...)
+}
+
+func (l *labeledClient) SetGauge(name string, value int64, labels ...Label) {
+	l.c.SetGauge(name, value, l.with(labels)...)
+}
+
+func (l *labeledClient) NewGauge(name, desc string, keys ...string) {
+	l.c.NewGauge(name, desc, l.keys(keys)...)
+}
+
+// Multi returns a client that records every metric in each of clients. With no
+// clients, metrics are discarded.
+func Multi(clients ...Client) Client {
+	return multiClient(clients)
+}
+
+type multiClient []Client
+
+func (m multiClient) IncCounter(name string, labels ...Label) {
+	for _, c := range m {
+		c.IncCounter(name, labels...)
+	}
+}
+
+func (m multiClient) NewCounter(name, desc string, keys ...string) {
+	for _, c := range m {
+		c.NewCounter(name, desc, keys...)
+	}
+}
+
+func (m multiClient) AddLatency(name string, value float64, labels ...Label) {
+	for _, c := range m {
+		c.AddLatency(name, value, labels...)
+	}
+}
+
+func (m multiClient) NewLatency(name, desc string, keys ...string) {
+	for _, c := range m {
+		c.NewLatency(name, desc, keys...)
+	}
+}
+
+func (m multiClient) SetGauge(name string, value int64, labels ...Label) {
+	for _, c := range m {
+		c.SetGauge(name, value, labels...)
+	}
+}
+
+func (m multiClient) NewGauge(name, desc string, keys ...string) {
+	for _, c := range m {
+		c.NewGauge(name, desc, keys...)
+	}
 }
 
 // NewExportingClient returns a client that can export to metrics to Cloud Monitoring.
@@ -50,7 +152,8 @@ func NewExportingClient() *ExportingClient {
 	return &ExportingClient{
 		labels:    &stackdriver.Labels{},
 		counters:  make(map[string]*stats.Int64Measure),
-		latencies: make(map[string]*stats.Float64Measure)}
+		latencies: make(map[string]*stats.Float64Measure),
+		gauges:    make(map[string]*stats.Int64Measure)}
 }
 
 // ExportingClient represents a client that exports to Cloud Monitoring
@@ -63,29 +166,37 @@ type ExportingClient struct {
 	mu        sync.RWMutex
 	counters  map[string]*stats.Int64Measure
 	latencies map[string]*stats.Float64Measure
+	gauges    map[string]*stats.Int64Measure
+
+	limiter labelLimiter
 }
 
 // IncCounter increases a counter metric or does nothing if the client is nil.
-func (m *ExportingClient) IncCounter(name string) {
+func (m *ExportingClient) IncCounter(name string, labels ...Label) {
 	if m == nil {
 		return
 	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	ctx := context.Background()
-	stats.Record(ctx, m.counters[name].M(1))
+	stats.Record(m.tagged(name, labels), m.counters[name].M(1))
 }
 
 // NewCounter creates a new counter metrics or does nothing if the client is nil.
-func (m *ExportingClient) NewCounter(name, description string) {
+func (m *ExportingClient) NewCounter(name, description string, keys ...string) {
 	if m == nil {
 		return
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.counters[name]; ok {
+		return
+	}
 	m.counters[name] = stats.Int64(name, description, stats.UnitDimensionless)
 	v := &view.View{
 		Name:        metricPrefix + name,
 		Measure:     m.counters[name],
 		Aggregation: view.Count(),
+		TagKeys:     tagKeys(keys),
 	}
 	if err := view.Register(v); err != nil {
 		log.Errorf("Failed to register the view: %v", err)
@@ -93,25 +204,30 @@ func (m *ExportingClient) NewCounter(name, description string) {
 }
 
 // AddLatency adds a latency metric or does nothing if the client is nil.
-func (m *ExportingClient) AddLatency(name string, value float64) {
+func (m *ExportingClient) AddLatency(name string, value float64, labels ...Label) {
 	if m == nil {
 		return
 	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	ctx := context.Background()
-	stats.Record(ctx, m.latencies[name].M(value))
+	stats.Record(m.tagged(name, labels), m.latencies[name].M(value))
 }
 
 // NewLatency creates a new latency metrics or does nothing if the client is nil.
-func (m *ExportingClient) NewLatency(name, description string) {
+func (m *ExportingClient) NewLatency(name, description string, keys ...string) {
 	if m == nil {
 		return
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.latencies[name]; ok {
+		return
+	}
 	m.latencies[name] = stats.Float64(name, description, stats.UnitMilliseconds)
 	v := &view.View{
 		Name:    metricPrefix + name,
 		Measure: m.latencies[name],
+		TagKeys: tagKeys(keys),
 		// Latency in buckets:
 		// [>=0ms, >=50ms, >=100ms, >=200ms, >=400ms, >=1s, >=2s, >=4s]
 		Aggregation: view.Distribution(0, 50, 100, 200, 400, 1000, 2000, 4000),
@@ -121,6 +237,75 @@ func (m *ExportingClient) NewLatency(name, description string) {
 	}
 }
 
+// SetGauge sets the current value of a gauge metric or does nothing if the
+// client is nil.
+func (m *ExportingClient) SetGauge(name string, value int64, labels ...Label) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats.Record(m.tagged(name, labels), m.gauges[name].M(value))
+}
+
+// NewGauge creates a new gauge metric or does nothing if the client is nil.
+func (m *ExportingClient) NewGauge(name, description string, keys ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.gauges[name]; ok {
+		return
+	}
+	m.gauges[name] = stats.Int64(name, description, stats.UnitDimensionless)
+	v := &view.View{
+		Name:        metricPrefix + name,
+		Measure:     m.gauges[name],
+		Aggregation: view.LastValue(),
+		TagKeys:     tagKeys(keys),
+	}
+	if err := view.Register(v); err != nil {
+		log.Errorf("Failed to register the view: %v", err)
+	}
+}
+
+// tagged returns a context carrying labels as tags, after applying the
+// cardinality limit of metric name.
+func (m *ExportingClient) tagged(name string, labels []Label) context.Context {
+	ctx := context.Background()
+	if len(labels) == 0 {
+		return ctx
+	}
+	var mutators []tag.Mutator
+	for _, l := range m.limiter.limit(name, labels) {
+		k, err := tag.NewKey(l.Key)
+		if err != nil {
+			continue
+		}
+		mutators = append(mutators, tag.Upsert(k, l.Value))
+	}
+	tagged, err := tag.New(ctx, mutators...)
+	if err != nil {
+		// Values that are not valid tags are recorded without them.
+		return ctx
+	}
+	return tagged
+}
+
+func tagKeys(keys []string) []tag.Key {
+	var tks []tag.Key
+	for _, k := range keys {
+		tk, err := tag.NewKey(k)
+		if err != nil {
+			log.Errorf("Invalid label key %q: %v", k, err)
+			continue
+		}
+		tks = append(tks, tk)
+	}
+	return tks
+}
+
 // StartExport metrics to the monitoring service roughly once a minute.
 // It fetches metadata about the GCP environment and fails if not
 // running on GCE or GKE.
@@ -30,6 +30,7 @@ func TestClient(t *testing.T) {
 		labels:    &stackdriver.Labels{},
 		counters:  make(map[string]*stats.Int64Measure),
 		latencies: make(map[string]*stats.Float64Measure),
+		gauges:    make(map[string]*stats.Int64Measure),
 	}
 	cl.labels.Set("job", "mllp_adapter", "")
 	cl.labels.Set("instance", "instance1", "")
@@ -47,6 +48,10 @@ func TestClient(t *testing.T) {
 	cl.AddLatency("test-latency", 20)
 	cl.AddLatency("test-latency", 100)
 	cl.AddLatency("test-latency", 130)
+
+	cl.NewGauge("test-gauge", "")
+	cl.SetGauge("test-gauge", 7)
+	cl.SetGauge("test-gauge", 4)
 	exporter.ReadAndExport()
 
 	rows, err := view.RetrieveData(metricPrefix + "test-counter")
@@ -86,4 +91,50 @@ func TestClient(t *testing.T) {
 	if d.SumOfSquaredDev != wantDistribution.SumOfSquaredDev {
 		t.Errorf("Unexpected distribution, expecting SumOfSquaredDev = %v, got SumOfSquaredDev = %v", wantDistribution.SumOfSquaredDev, d.SumOfSquaredDev)
 	}
+
+	rows, err = view.RetrieveData(metricPrefix + "test-gauge")
+	if err != nil || len(rows) == 0 {
+		t.Fatalf("Failed to get gauge")
+	}
+	g, ok := rows[0].Data.(*view.LastValueData)
+	if !ok {
+		t.Errorf("want LastValueData, got %+v", rows[0].Data)
+	}
+	if g.Value != 4 {
+		t.Errorf("Wrong gauge result, expected 4, got %v", g.Value)
+	}
+}
+
+func TestWithLabels(t *testing.T) {
+	cl := NewExportingClient()
+	lab, er := WithLabels(cl, Listener("lab")), WithLabels(cl, Listener("er"))
+	lab.NewCounter("test-with-labels", "test counter", AckCodeKey)
+	er.NewCounter("test-with-labels", "test counter", AckCodeKey)
+	lab.IncCounter("test-with-labels", Label{AckCodeKey, "AA"})
+	lab.IncCounter("test-with-labels", Label{AckCodeKey, "AA"})
+	er.IncCounter("test-with-labels", Label{AckCodeKey, "AA"})
+
+	rows, err := view.RetrieveData(metricPrefix + "test-with-labels")
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("Failed to get labeled counter: %v, %v", rows, err)
+	}
+	want := map[string]int64{"lab": 2, "er": 1}
+	for _, r := range rows {
+		var listener, code string
+		for _, tg := range r.Tags {
+			switch tg.Key.Name() {
+			case ListenerKey:
+				listener = tg.Value
+			case AckCodeKey:
+				code = tg.Value
+			}
+		}
+		c, ok := r.Data.(*view.CountData)
+		if !ok {
+			t.Fatalf("want CountData, got %+v", r.Data)
+		}
+		if code != "AA" || c.Value != want[listener] {
+			t.Errorf("Wrong counter result for listener %q and code %q, expected %v, got %v", listener, code, want[listener], c.Value)
+		}
+	}
 }
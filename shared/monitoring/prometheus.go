@@ -0,0 +1,267 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitoring
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	promPrefix      = "mllp_"
+	promContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// promBuckets are the upper bounds of the latency histogram buckets, matching
+// the distribution exported to Cloud Monitoring.
+var promBuckets = []float64{50, 100, 200, 400, 1000, 2000, 4000}
+
+type promKind int
+
+const (
+	promCounter promKind = iota
+	promHistogram
+	promGauge
+)
+
+type promMetric struct {
+	kind promKind
+	help string
+	keys []string
+	// series holds the values of the metric by their label values, joined
+	// by promSep.
+	series map[string]*promSeries
+}
+
+type promSeries struct {
+	values []string
+	// value is the count of a counter or the value of a gauge.
+	value int64
+	// buckets, sum and count describe a histogram. buckets[i] counts the
+	// observations up to promBuckets[i].
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// promSep separates label values in the keys of promMetric.series.
+const promSep = "\xff"
+
+// PrometheusClient keeps metrics in memory and serves them over HTTP in the
+// Prometheus text exposition format. Counters are exposed with a "_total"
+// suffix and latencies as histograms in milliseconds. Characters that are not
+// allowed in Prometheus metric names are replaced by "_".
+type PrometheusClient struct {
+	mu      sync.Mutex
+	metrics map[string]*promMetric
+	limiter labelLimiter
+}
+
+// NewPrometheusClient returns a client whose metrics are served by its
+// ServeHTTP method.
+func NewPrometheusClient() *PrometheusClient {
+	return &PrometheusClient{metrics: make(map[string]*promMetric)}
+}
+
+// IncCounter increases a counter metric. Metrics that were not created are
+// ignored.
+func (p *PrometheusClient) IncCounter(name string, labels ...Label) {
+	if s := p.series(name, promCounter, labels); s != nil {
+		s.value++
+		p.mu.Unlock()
+	}
+}
+
+// NewCounter creates a new counter metric.
+func (p *PrometheusClient) NewCounter(name, desc string, keys ...string) {
+	p.add(name, promCounter, desc, keys)
+}
+
+// AddLatency records a latency in milliseconds.
+func (p *PrometheusClient) AddLatency(name string, value float64, labels ...Label) {
+	s := p.series(name, promHistogram, labels)
+	if s == nil {
+		return
+	}
+	defer p.mu.Unlock()
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(promBuckets))
+	}
+	for i, b := range promBuckets {
+		if value <= b {
+			s.buckets[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// NewLatency creates a new latency metric.
+func (p *PrometheusClient) NewLatency(name, desc string, keys ...string) {
+	p.add(name, promHistogram, desc, keys)
+}
+
+// SetGauge sets the current value of a gauge metric.
+func (p *PrometheusClient) SetGauge(name string, value int64, labels ...Label) {
+	if s := p.series(name, promGauge, labels); s != nil {
+		s.value = value
+		p.mu.Unlock()
+	}
+}
+
+// NewGauge creates a new gauge metric.
+func (p *PrometheusClient) NewGauge(name, desc string, keys ...string) {
+	p.add(name, promGauge, desc, keys)
+}
+
+// add registers a metric, keeping the values of a metric that already
+// exists.
+func (p *PrometheusClient) add(name string, kind promKind, help string, keys []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.metrics[name]; !ok {
+		p.metrics[name] = &promMetric{kind: kind, help: help, keys: keys, series: make(map[string]*promSeries)}
+	}
+}
+
+// series returns the series of metric name for labels, with p.mu held, or nil
+// if there is no such metric of that kind.
+func (p *PrometheusClient) series(name string, kind promKind, labels []Label) *promSeries {
+	labels = p.limiter.limit(name, labels)
+	p.mu.Lock()
+	m, ok := p.metrics[name]
+	if !ok || m.kind != kind {
+		p.mu.Unlock()
+		return nil
+	}
+	values := make([]string, len(m.keys))
+	for i, k := range m.keys {
+		for _, l := range labels {
+			if l.Key == k {
+				values[i] = l.Value
+			}
+		}
+	}
+	id := strings.Join(values, promSep)
+	s, ok := m.series[id]
+	if !ok {
+		s = &promSeries{values: values}
+		m.series[id] = s
+	}
+	return s
+}
+
+// ServeHTTP writes all metrics, sorted by name.
+func (p *PrometheusClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", promContentType)
+	bw := bufio.NewWriter(w)
+	p.write(bw)
+	bw.Flush()
+}
+
+func (p *PrometheusClient) write(w *bufio.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := make([]string, 0, len(p.metrics))
+	for name := range p.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := p.metrics[name]
+		prom := promName(name)
+		switch m.kind {
+		case promCounter:
+			prom += "_total"
+			writeHeader(w, prom, m.help, "counter")
+		case promGauge:
+			writeHeader(w, prom, m.help, "gauge")
+		case promHistogram:
+			prom += "_milliseconds"
+			writeHeader(w, prom, m.help, "histogram")
+		}
+		if len(m.keys) == 0 && len(m.series) == 0 {
+			// Metrics without labels are exposed from the start.
+			m.series[""] = &promSeries{}
+		}
+		ids := make([]string, 0, len(m.series))
+		for id := range m.series {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			s := m.series[id]
+			labels := promLabels(m.keys, s.values)
+			switch m.kind {
+			case promCounter, promGauge:
+				fmt.Fprintf(w, "%v%v %d\n", prom, wrapLabels(labels), s.value)
+			case promHistogram:
+				for i, b := range promBuckets {
+					var n uint64
+					if s.buckets != nil {
+						n = s.buckets[i]
+					}
+					le := fmt.Sprintf("le=%q", strconv.FormatFloat(b, 'g', -1, 64))
+					fmt.Fprintf(w, "%v_bucket%v %d\n", prom, wrapLabels(append(labels, le)), n)
+				}
+				fmt.Fprintf(w, "%v_bucket%v %d\n", prom, wrapLabels(append(labels, `le="+Inf"`)), s.count)
+				fmt.Fprintf(w, "%v_sum%v %v\n", prom, wrapLabels(labels), strconv.FormatFloat(s.sum, 'g', -1, 64))
+				fmt.Fprintf(w, "%v_count%v %d\n", prom, wrapLabels(labels), s.count)
+			}
+		}
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promLabels formats label pairs like `peer="10.0.0.1"`.
+func promLabels(keys, values []string) []string {
+	var labels []string
+	for i, k := range keys {
+		labels = append(labels, fmt.Sprintf(`%v="%v"`, promName(k)[len(promPrefix):], labelValueEscaper.Replace(values[i])))
+	}
+	return labels
+}
+
+func wrapLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	if help != "" {
+		help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+		fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	}
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, kind)
+}
+
+// promName turns a metric name like "receiver-reads" into a valid Prometheus
+// name like "mllp_receiver_reads".
+func promName(name string) string {
+	return promPrefix + strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
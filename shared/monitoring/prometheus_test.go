@@ -0,0 +1,114 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitoring
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrometheusClient(t *testing.T) {
+	p := NewPrometheusClient()
+	p.NewCounter("test-counter", "A counter")
+	p.IncCounter("test-counter")
+	p.IncCounter("test-counter")
+	p.IncCounter("unknown")
+	p.NewLatency("test-latency", "A latency\nwith \\ escapes")
+	p.AddLatency("test-latency", 20)
+	p.AddLatency("test-latency", 100)
+	p.AddLatency("test-latency", 5000)
+	lab := WithLabels(p, Listener("lab"))
+	lab.NewGauge("test-gauge", "")
+	lab.SetGauge("test-gauge", 7)
+	lab.SetGauge("test-gauge", 4)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if got := rec.Header().Get("Content-Type"); got != promContentType {
+		t.Errorf("Content-Type = %q, want %q", got, promContentType)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	want := `# HELP mllp_test_counter_total A counter
+# TYPE mllp_test_counter_total counter
+mllp_test_counter_total 2
+# TYPE mllp_test_gauge gauge
+mllp_test_gauge{listener="lab"} 4
+# HELP mllp_test_latency_milliseconds A latency\nwith \\ escapes
+# TYPE mllp_test_latency_milliseconds histogram
+mllp_test_latency_milliseconds_bucket{le="50"} 1
+mllp_test_latency_milliseconds_bucket{le="100"} 2
+mllp_test_latency_milliseconds_bucket{le="200"} 2
+mllp_test_latency_milliseconds_bucket{le="400"} 2
+mllp_test_latency_milliseconds_bucket{le="1000"} 2
+mllp_test_latency_milliseconds_bucket{le="2000"} 2
+mllp_test_latency_milliseconds_bucket{le="4000"} 2
+mllp_test_latency_milliseconds_bucket{le="+Inf"} 3
+mllp_test_latency_milliseconds_sum 5120
+mllp_test_latency_milliseconds_count 3
+`
+	if string(body) != want {
+		t.Errorf("ServeHTTP() wrote\n%v\nwant\n%v", string(body), want)
+	}
+}
+
+func TestPrometheusLabels(t *testing.T) {
+	p := NewPrometheusClient()
+	p.NewCounter("test-writes", "", PeerKey, AckCodeKey)
+	p.IncCounter("test-writes", Label{AckCodeKey, "AE"}, Label{PeerKey, "10.0.0.2"})
+	p.IncCounter("test-writes", Label{PeerKey, "10.0.0.1"}, Label{AckCodeKey, "AA"})
+	p.IncCounter("test-writes", Label{PeerKey, "10.0.0.1"}, Label{AckCodeKey, "AA"})
+	// Missing labels are empty and unknown ones are ignored.
+	p.IncCounter("test-writes", Label{PeerKey, "a\"b"}, Label{StoreKey, "s"})
+	p.NewLatency("test-latency", "", MessageTypeKey)
+	p.AddLatency("test-latency", 20, Label{MessageTypeKey, "ADT^A01"})
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	want := `# TYPE mllp_test_latency_milliseconds histogram
+mllp_test_latency_milliseconds_bucket{message_type="ADT^A01",le="50"} 1
+mllp_test_latency_milliseconds_bucket{message_type="ADT^A01",le="100"} 1
+mllp_test_latency_milliseconds_bucket{message_type="ADT^A01",le="200"} 1
+mllp_test_latency_milliseconds_bucket{message_type="ADT^A01",le="400"} 1
+mllp_test_latency_milliseconds_bucket{message_type="ADT^A01",le="1000"} 1
+mllp_test_latency_milliseconds_bucket{message_type="ADT^A01",le="2000"} 1
+mllp_test_latency_milliseconds_bucket{message_type="ADT^A01",le="4000"} 1
+mllp_test_latency_milliseconds_bucket{message_type="ADT^A01",le="+Inf"} 1
+mllp_test_latency_milliseconds_sum{message_type="ADT^A01"} 20
+mllp_test_latency_milliseconds_count{message_type="ADT^A01"} 1
+# TYPE mllp_test_writes_total counter
+mllp_test_writes_total{peer="10.0.0.1",ack_code="AA"} 2
+mllp_test_writes_total{peer="10.0.0.2",ack_code="AE"} 1
+mllp_test_writes_total{peer="a\"b",ack_code=""} 1
+`
+	if string(body) != want {
+		t.Errorf("ServeHTTP() wrote\n%v\nwant\n%v", string(body), want)
+	}
+}
+
+func TestMulti(t *testing.T) {
+	a, b := NewPrometheusClient(), NewPrometheusClient()
+	m := Multi(a, b)
+	m.NewCounter("test-multi", "")
+	m.IncCounter("test-multi")
+	for _, p := range []*PrometheusClient{a, b} {
+		if got := p.metrics["test-multi"].series[""].value; got != 1 {
+			t.Errorf("counter = %v, want 1", got)
+		}
+	}
+	// Without clients metrics are discarded.
+	Multi().IncCounter("test-multi")
+}
@@ -19,6 +19,7 @@ package pubsub
 import (
 	"context"
 	"fmt"
+	"os"
 
 	"cloud.google.com/go/pubsub"
 	"google.golang.org/api/option"
@@ -32,11 +33,16 @@ const (
 	ignoredMetric    = "pubsub-messages-ignored"
 
 	scope = "https://www.googleapis.com/auth/pubsub"
+	// emulatorHostEnv names the address of a Pub/Sub emulator, which the
+	// client library uses instead of the service when it is set.
+	emulatorHostEnv = "PUBSUB_EMULATOR_HOST"
 )
 
-// Message represents a pubsub message.
+// Message represents a pubsub message. Nack asks for the message to be
+// delivered again.
 type Message interface {
 	Ack()
+	Nack()
 	Data() []byte
 	Attrs() map[string]string
 }
@@ -49,6 +55,10 @@ func (m *messageWrapper) Ack() {
 	m.msg.Ack()
 }
 
+func (m *messageWrapper) Nack() {
+	m.msg.Nack()
+}
+
 func (m *messageWrapper) Data() []byte {
 	return m.msg.Data
 }
@@ -57,15 +67,20 @@ func (m *messageWrapper) Attrs() map[string]string {
 	return m.msg.Attributes
 }
 
-// MessageHandler is the interface for handling HL7v2 messages.
+// MessageHandler is the interface for handling HL7v2 messages. The context
+// passed to Handle is cancelled when listening stops.
 type MessageHandler interface {
-	Handle(Message)
+	Handle(context.Context, Message)
 }
 
 // Listen listens for notifications from a pubsub subscription, uses the ids
 // in the messages to fetch content with the HL7v2 API, then sends the message
-// to the partner over MLLP.
+// to the partner over MLLP. If the PUBSUB_EMULATOR_HOST environment variable
+// is set, the client connects to that emulator without credentials.
 func Listen(ctx context.Context, cred string, h MessageHandler, projectID string, topic string, opts ...option.ClientOption) error {
+	if os.Getenv(emulatorHostEnv) != "" {
+		return listen(ctx, h, projectID, topic, opts...)
+	}
 	ts, err := util.TokenSource(ctx, cred, scope)
 	if err != nil {
 		return fmt.Errorf("getting default token source: %v", err)
@@ -83,6 +98,6 @@ func listen(ctx context.Context, h MessageHandler, projectID string, topic strin
 	}
 
 	return client.Subscription(topic).Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-		h.Handle(&messageWrapper{msg: msg})
+		h.Handle(ctx, &messageWrapper{msg: msg})
 	})
 }
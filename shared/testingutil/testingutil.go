@@ -16,8 +16,12 @@
 package testingutil
 
 import (
+	"sort"
+	"strings"
 	"sync"
 	"testing"
+
+	"github.com/GoogleCloudPlatform/mllp/shared/monitoring"
 )
 
 // CheckMetrics checks whether metrics match expected.
@@ -34,40 +38,94 @@ func CheckMetrics(t *testing.T, metrics *FakeMonitoringClient, expected map[stri
 type FakeMonitoringClient struct {
 	latencies map[string][]float64
 	counters  map[string]int64
+	gauges    map[string]int64
+	// labeled holds the counters by name and labels, see labelKey.
+	labeled map[string]int64
 
 	mu sync.RWMutex
 }
 
 // NewFakeMonitoringClient creates a new FakeMonitoringClient.
 func NewFakeMonitoringClient() *FakeMonitoringClient {
-	return &FakeMonitoringClient{latencies: make(map[string][]float64), counters: make(map[string]int64)}
+	return &FakeMonitoringClient{latencies: make(map[string][]float64), counters: make(map[string]int64), gauges: make(map[string]int64), labeled: make(map[string]int64)}
 }
 
-// CounterValue returns the value of a counter metric.
+// CounterValue returns the value of a counter metric, summed over all labels.
 func (c *FakeMonitoringClient) CounterValue(name string) int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.counters[name]
 }
 
+// LabeledCounterValue returns the number of times a counter metric was
+// increased with exactly the given labels, in any order.
+func (c *FakeMonitoringClient) LabeledCounterValue(name string, labels ...monitoring.Label) int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.labeled[labelKey(name, labels)]
+}
+
 // IncCounter increment a counter metric.
-func (c *FakeMonitoringClient) IncCounter(name string) {
+func (c *FakeMonitoringClient) IncCounter(name string, labels ...monitoring.Label) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.counters[name]++
+	c.labeled[labelKey(name, labels)]++
 }
 
-// NewCounter creates a new counter metric.
-func (c *FakeMonitoringClient) NewCounter(name, desc string) {
-	c.counters[name] = 0
+// NewCounter creates a new counter metric, unless it exists.
+func (c *FakeMonitoringClient) NewCounter(name, desc string, keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.counters[name]; !ok {
+		c.counters[name] = 0
+	}
 }
 
 // AddLatency adds a latency value to a latency metric.
-func (c *FakeMonitoringClient) AddLatency(name string, value float64) {
+func (c *FakeMonitoringClient) AddLatency(name string, value float64, labels ...monitoring.Label) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.latencies[name] = append(c.latencies[name], value)
 }
 
-// NewLatency creates a new latency metric.
-func (c *FakeMonitoringClient) NewLatency(name, desc string) {
-	c.latencies[name] = nil
+// NewLatency creates a new latency metric, unless it exists.
+func (c *FakeMonitoringClient) NewLatency(name, desc string, keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.latencies[name]; !ok {
+		c.latencies[name] = nil
+	}
+}
+
+// GaugeValue returns the last value set on the named gauge, with any labels.
+func (c *FakeMonitoringClient) GaugeValue(name string) int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.gauges[name]
+}
+
+// SetGauge sets a gauge metric.
+func (c *FakeMonitoringClient) SetGauge(name string, value int64, labels ...monitoring.Label) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gauges[name] = value
+}
+
+// NewGauge creates a new gauge metric, unless it exists.
+func (c *FakeMonitoringClient) NewGauge(name, desc string, keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.gauges[name]; !ok {
+		c.gauges[name] = 0
+	}
+}
+
+func labelKey(name string, labels []monitoring.Label) string {
+	parts := make([]string, 0, len(labels))
+	for _, l := range labels {
+		parts = append(parts, l.Key+"="+l.Value)
+	}
+	sort.Strings(parts)
+	return name + "{" + strings.Join(parts, ",") + "}"
 }
@@ -0,0 +1,54 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testingutil
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/mllp/shared/tracing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// RecordSpans installs a tracer provider that keeps the spans ended during the
+// test in memory. Tests that use it must not run in parallel.
+func RecordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exp := tracetest.NewInMemoryExporter()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tracing.NewProvider(sdktrace.NewSimpleSpanProcessor(exp), tracing.Option{}))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return exp
+}
+
+// FindSpan returns the first recorded span named name and its attributes, or
+// fails the test if there is none.
+func FindSpan(t *testing.T, exp *tracetest.InMemoryExporter, name string) (tracetest.SpanStub, map[attribute.Key]string) {
+	t.Helper()
+	for _, s := range exp.GetSpans() {
+		if s.Name == name {
+			attrs := make(map[attribute.Key]string)
+			for _, a := range s.Attributes {
+				attrs[a.Key] = a.Value.Emit()
+			}
+			return s, attrs
+		}
+	}
+	t.Fatalf("No span named %q", name)
+	return tracetest.SpanStub{}, nil
+}
@@ -0,0 +1,281 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tlsconfig builds TLS configurations for MLLP connections from
+// certificate files on disk.
+package tlsconfig
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ServerOption contains the settings for a TLS server configuration.
+type ServerOption struct {
+	// CertFile and KeyFile are the PEM encoded certificate chain and private
+	// key presented to clients. Both files are reloaded when they change.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is a PEM bundle of CAs used to verify client certificates.
+	// If set, clients must present a certificate signed by one of them.
+	ClientCAFile string
+	// MinVersion is the lowest accepted TLS version, e.g. "1.2". Defaults to
+	// 1.2.
+	MinVersion string
+	// CipherSuites restricts the TLS 1.0-1.2 cipher suites, using the names
+	// from crypto/tls (e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"). Go's
+	// defaults are used if empty. TLS 1.3 suites are not configurable.
+	CipherSuites []string
+}
+
+// Server creates a TLS configuration for accepting connections.
+func Server(opt ServerOption) (*tls.Config, error) {
+	if opt.CertFile == "" || opt.KeyFile == "" {
+		return nil, fmt.Errorf("both a certificate and a key file are required")
+	}
+	minVersion, err := parseVersion(opt.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := parseCipherSuites(opt.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	r := &certReloader{certFile: opt.CertFile, keyFile: opt.KeyFile}
+	// Fail at startup rather than on the first handshake.
+	if _, err := r.get(); err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: suites,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.get()
+		},
+	}
+	if opt.ClientCAFile != "" {
+		pool, err := LoadCertPool(opt.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// ClientOption contains the settings for a TLS client configuration.
+type ClientOption struct {
+	// CertFile and KeyFile are an optional PEM encoded client certificate
+	// chain and private key, for partners that require mutual TLS. Both files
+	// are reloaded when they change.
+	CertFile string
+	KeyFile  string
+	// CAFile is a PEM bundle of CAs used to verify the partner's certificate.
+	// The system roots are used if empty.
+	CAFile string
+	// ServerName overrides the name used for SNI and to verify the partner's
+	// certificate. Defaults to the host being dialed.
+	ServerName string
+	// PinnedCerts are SHA-256 fingerprints of the DER encoded certificates
+	// the partner may present, in hex with or without colons. If set, the
+	// partner's leaf certificate must match one of them in addition to
+	// passing chain verification.
+	PinnedCerts []string
+	// MinVersion is the lowest accepted TLS version, e.g. "1.2". Defaults to
+	// 1.2.
+	MinVersion string
+}
+
+// Client creates a TLS configuration for dialing partners.
+func Client(opt ClientOption) (*tls.Config, error) {
+	minVersion, err := parseVersion(opt.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion: minVersion,
+		ServerName: opt.ServerName,
+	}
+	if opt.CertFile != "" || opt.KeyFile != "" {
+		if opt.CertFile == "" || opt.KeyFile == "" {
+			return nil, fmt.Errorf("both a certificate and a key file are required")
+		}
+		r := &certReloader{certFile: opt.CertFile, keyFile: opt.KeyFile}
+		if _, err := r.get(); err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.get()
+		}
+	}
+	if opt.CAFile != "" {
+		if cfg.RootCAs, err = LoadCertPool(opt.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(opt.PinnedCerts) > 0 {
+		pins, err := parsePins(opt.PinnedCerts)
+		if err != nil {
+			return nil, err
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPin(pins, cs)
+		}
+	}
+	return cfg, nil
+}
+
+func parsePins(pins []string) ([][]byte, error) {
+	var parsed [][]byte
+	for _, p := range pins {
+		b, err := hex.DecodeString(strings.ReplaceAll(p, ":", ""))
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 certificate fingerprint %q", p)
+		}
+		parsed = append(parsed, b)
+	}
+	return parsed, nil
+}
+
+func verifyPin(pins [][]byte, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("no peer certificate to check against pinned fingerprints")
+	}
+	sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+	for _, p := range pins {
+		if bytes.Equal(p, sum[:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer certificate %v with fingerprint %x is not pinned", cs.PeerCertificates[0].Subject, sum)
+}
+
+// LoadCertPool reads a PEM bundle of certificates into a pool.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %v", file)
+	}
+	return pool, nil
+}
+
+func parseVersion(v string) (uint16, error) {
+	if v == "" {
+		return tls.VersionTLS12, nil
+	}
+	version, ok := versions[v]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, want one of 1.0, 1.1, 1.2, 1.3", v)
+	}
+	return version, nil
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+	var ids []uint16
+	for _, n := range names {
+		id, ok := known[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", n)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// certReloader serves a key pair from disk and reloads it whenever the
+// modification time of either file changes, e.g. when a mounted secret is
+// rotated.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	// mu guards the fields below.
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func (r *certReloader) get() (*tls.Certificate, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return r.stale(fmt.Errorf("reading certificate: %v", err))
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return r.stale(fmt.Errorf("reading key: %v", err))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			// The files may be half way through being replaced.
+			log.Warningf("Failed to reload TLS certificate, serving the previous one: %v", err)
+			return r.cert, nil
+		}
+		return nil, fmt.Errorf("loading key pair: %v", err)
+	}
+	if r.cert != nil {
+		log.Infof("Reloaded TLS certificate from %v", r.certFile)
+	}
+	r.cert, r.certMod, r.keyMod = &cert, certInfo.ModTime(), keyInfo.ModTime()
+	return r.cert, nil
+}
+
+// stale returns the previously loaded certificate if there is one, err
+// otherwise.
+func (r *certReloader) stale(err error) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert == nil {
+		return nil, err
+	}
+	log.Warningf("Failed to reload TLS certificate, serving the previous one: %v", err)
+	return r.cert, nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlsconfig
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/mllp/shared/testingutil"
+)
+
+func commonName(t *testing.T, c *tls.Certificate) string {
+	t.Helper()
+	cert, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		t.Fatalf("Parsing certificate: %v", err)
+	}
+	return cert.Subject.CommonName
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	ca := testingutil.NewCertificateAuthority(t)
+	cert, key := ca.Issue(t, "server")
+	opt := ServerOption{
+		CertFile:     testingutil.WriteFile(t, dir, "cert.pem", cert),
+		KeyFile:      testingutil.WriteFile(t, dir, "key.pem", key),
+		ClientCAFile: testingutil.WriteFile(t, dir, "ca.pem", ca.PEM),
+		MinVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	}
+	cfg, err := Server(opt)
+	if err != nil {
+		t.Fatalf("Server(%+v) returned error: %v", opt, err)
+	}
+	if cfg.MinVersion != tls.VersionTLS13 {
+		t.Errorf("MinVersion = %v, want %v", cfg.MinVersion, tls.VersionTLS13)
+	}
+	if len(cfg.CipherSuites) != 1 || cfg.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("CipherSuites = %v, want [%v]", cfg.CipherSuites, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)
+	}
+	if cfg.ClientAuth != tls.RequireAndVerifyClientCert || cfg.ClientCAs == nil {
+		t.Errorf("Expected client certificates to be required and verified")
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := testingutil.NewCertificateAuthority(t)
+	cert, key := ca.Issue(t, "server")
+	certFile := testingutil.WriteFile(t, dir, "cert.pem", cert)
+	keyFile := testingutil.WriteFile(t, dir, "key.pem", key)
+
+	testCases := []struct {
+		name string
+		opt  ServerOption
+	}{
+		{"missing key", ServerOption{CertFile: certFile}},
+		{"key not found", ServerOption{CertFile: certFile, KeyFile: dir + "/missing.pem"}},
+		{"mismatched files", ServerOption{CertFile: keyFile, KeyFile: certFile}},
+		{"bad version", ServerOption{CertFile: certFile, KeyFile: keyFile, MinVersion: "2.0"}},
+		{"bad cipher suite", ServerOption{CertFile: certFile, KeyFile: keyFile, CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}},
+		{"bad client CA", ServerOption{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Server(tc.opt); err == nil {
+				t.Errorf("Server(%+v) expected error", tc.opt)
+			}
+		})
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := testingutil.NewCertificateAuthority(t)
+	cert, key := ca.Issue(t, "first")
+	certFile := testingutil.WriteFile(t, dir, "cert.pem", cert)
+	keyFile := testingutil.WriteFile(t, dir, "key.pem", key)
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+
+	c, err := r.get()
+	if err != nil {
+		t.Fatalf("get() returned error: %v", err)
+	}
+	if got := commonName(t, c); got != "first" {
+		t.Errorf("Got certificate for %q, want %q", got, "first")
+	}
+
+	// Rotate the files and make sure the modification time moves.
+	cert, key = ca.Issue(t, "second")
+	testingutil.WriteFile(t, dir, "cert.pem", cert)
+	testingutil.WriteFile(t, dir, "key.pem", key)
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+	}
+	if c, err = r.get(); err != nil {
+		t.Fatalf("get() returned error: %v", err)
+	}
+	if got := commonName(t, c); got != "second" {
+		t.Errorf("Got certificate for %q, want %q", got, "second")
+	}
+
+	// A broken rotation keeps serving the last good certificate.
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if c, err = r.get(); err != nil {
+		t.Fatalf("get() returned error: %v", err)
+	}
+	if got := commonName(t, c); got != "second" {
+		t.Errorf("Got certificate for %q, want %q", got, "second")
+	}
+}
+
+func TestClientPinning(t *testing.T) {
+	dir := t.TempDir()
+	ca := testingutil.NewCertificateAuthority(t)
+	cert, key := ca.Issue(t, "partner")
+	keyPair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		t.Fatalf("X509KeyPair: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	sum := sha256.Sum256(leaf.Raw)
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+	caFile := testingutil.WriteFile(t, dir, "ca.pem", ca.PEM)
+
+	testCases := []struct {
+		name    string
+		pin     string
+		wantErr bool
+	}{
+		{"matching pin", hex.EncodeToString(sum[:]), false},
+		{"matching pin with colons", strings.ToUpper(strings.Join(splitPairs(hex.EncodeToString(sum[:])), ":")), false},
+		{"other pin", strings.Repeat("ab", sha256.Size), true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := Client(ClientOption{CAFile: caFile, PinnedCerts: []string{tc.pin}})
+			if err != nil {
+				t.Fatalf("Client returned error: %v", err)
+			}
+			if err := cfg.VerifyConnection(state); (err != nil) != tc.wantErr {
+				t.Errorf("VerifyConnection returned %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := testingutil.NewCertificateAuthority(t)
+	cert, _ := ca.Issue(t, "client")
+	certFile := testingutil.WriteFile(t, dir, "cert.pem", cert)
+
+	testCases := []struct {
+		name string
+		opt  ClientOption
+	}{
+		{"missing key", ClientOption{CertFile: certFile}},
+		{"bad CA", ClientOption{CAFile: dir + "/missing.pem"}},
+		{"bad pin", ClientOption{PinnedCerts: []string{"abcd"}}},
+		{"bad version", ClientOption{MinVersion: "1.4"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Client(tc.opt); err == nil {
+				t.Errorf("Client(%+v) expected error", tc.opt)
+			}
+		})
+	}
+}
+
+// splitPairs splits s into two character chunks.
+func splitPairs(s string) []string {
+	var pairs []string
+	for i := 0; i < len(s); i += 2 {
+		pairs = append(pairs, s[i:i+2])
+	}
+	return pairs
+}
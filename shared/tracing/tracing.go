@@ -0,0 +1,181 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing records OpenTelemetry spans for the stages a message goes
+// through in the adapter and exports them over OTLP.
+//
+// Spans of the same HL7 message carry its control ID (MSH-10) as the
+// hl7.control_id attribute, so that the stages can be correlated where no
+// trace context is passed between them, e.g. across the Pub/Sub notification.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/mllp/shared/hl7"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName  = "github.com/GoogleCloudPlatform/mllp"
+	serviceName = "mllp_adapter"
+)
+
+// Attribute keys shared by the spans of the adapter.
+const (
+	// ControlIDKey is the message control ID (MSH-10) of an HL7 message.
+	ControlIDKey = attribute.Key("hl7.control_id")
+	// MessageTypeKey is the message type (MSH-9) of an HL7 message.
+	MessageTypeKey = attribute.Key("hl7.message_type")
+	// AckCodeKey is the acknowledgment code (MSA-1) of an ACK.
+	AckCodeKey = attribute.Key("hl7.ack_code")
+	// BatchKey marks spans of HL7 batches rather than single messages.
+	BatchKey = attribute.Key("hl7.batch")
+	// MessageNameKey is the resource name of a message in an HL7v2 store.
+	MessageNameKey = attribute.Key("hl7v2.message_name")
+	// StoreKey is the resource name of an HL7v2 store.
+	StoreKey = attribute.Key("hl7v2.store")
+	// PeerKey is the address of the other end of an MLLP connection.
+	PeerKey = attribute.Key("net.peer.address")
+)
+
+// Option contains the settings of the exporter.
+type Option struct {
+	// Endpoint is the host:port of an OTLP/HTTP collector.
+	Endpoint string
+	// Insecure sends spans over plain HTTP instead of HTTPS.
+	Insecure bool
+	// SampleRatio is the fraction of traces that are recorded. All traces
+	// are recorded if zero.
+	SampleRatio float64
+}
+
+// Start installs a tracer provider that exports spans to an OTLP collector.
+// The returned function flushes the remaining spans and stops the export.
+func Start(ctx context.Context, opt Option) (func(context.Context) error, error) {
+	if opt.Endpoint == "" {
+		return nil, fmt.Errorf("missing OTLP endpoint")
+	}
+	httpOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(opt.Endpoint)}
+	if opt.Insecure {
+		httpOpts = append(httpOpts, otlptracehttp.WithInsecure())
+	}
+	exp, err := otlptracehttp.New(ctx, httpOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP exporter: %v", err)
+	}
+	tp := NewProvider(sdktrace.NewBatchSpanProcessor(exp), opt)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// NewProvider returns a tracer provider that hands spans to sp, e.g. a
+// processor around an in-memory exporter in tests.
+func NewProvider(sp sdktrace.SpanProcessor, opt Option) *sdktrace.TracerProvider {
+	sampler := sdktrace.AlwaysSample()
+	if opt.SampleRatio > 0 && opt.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(opt.SampleRatio)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(sp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+}
+
+// StartSpan starts a span named name. If msg is not nil, the span is tagged
+// with its control ID and message type.
+func StartSpan(ctx context.Context, name string, msg []byte, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+	if msg != nil && span.IsRecording() {
+		span.SetAttributes(MessageAttributes(msg)...)
+	}
+	return ctx, span
+}
+
+// MessageAttributes returns the control ID and message type of msg, as far as
+// they can be read from its MSH segment.
+func MessageAttributes(msg []byte) []attribute.KeyValue {
+	if i := bytes.IndexAny(msg, "\r\n"); i >= 0 {
+		msg = msg[:i]
+	}
+	parsed, err := hl7.Parse(msg)
+	if err != nil {
+		return nil
+	}
+	var attrs []attribute.KeyValue
+	if id, _ := parsed.Value("MSH-10"); id != "" {
+		attrs = append(attrs, ControlIDKey.String(id))
+	}
+	if t, _ := parsed.Get("MSH-9"); t != "" {
+		attrs = append(attrs, MessageTypeKey.String(t))
+	}
+	return attrs
+}
+
+// AckAttributes returns the acknowledgment code of ack, if it has one.
+func AckAttributes(ack []byte) []attribute.KeyValue {
+	parsed, err := hl7.Parse(ack)
+	if err != nil {
+		return nil
+	}
+	if code, _ := parsed.Value("MSA-1"); code != "" {
+		return []attribute.KeyValue{AckCodeKey.String(code)}
+	}
+	return nil
+}
+
+// End marks span as failed if err is not nil and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Transport returns a round tripper that adds the trace context of each
+// request to its headers, in the W3C Trace Context format, before passing it
+// to base, or to http.DefaultTransport if base is nil.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{base: base}
+}
+
+type transport struct {
+	base http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !trace.SpanContextFromContext(req.Context()).IsValid() {
+		return t.base.RoundTrip(req)
+	}
+	// A round tripper must not modify the request it was given.
+	req = req.Clone(req.Context())
+	propagation.TraceContext{}.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	return t.base.RoundTrip(req)
+}
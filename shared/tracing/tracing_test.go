@@ -0,0 +1,153 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const msg = "MSH|^~\\&|APP|FAC|RECV|RECVFAC|20180101000000||ADT^A01|CTRL1|P|2.5\rPID|1\r"
+
+func TestStartSpan(t *testing.T) {
+	exp := record(t)
+	_, span := StartSpan(context.Background(), "test", []byte(msg), PeerKey.String("10.0.0.1"))
+	span.SetAttributes(AckAttributes([]byte("MSH|^~\\&|RECV|RECVFAC|APP|FAC|20180101000001||ACK|A1|P|2.5\rMSA|AE|CTRL1\r"))...)
+	End(span, errors.New("failed"))
+
+	spans := exp.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("Got %d spans, want 1", len(spans))
+	}
+	got := make(map[attribute.Key]string)
+	for _, a := range spans[0].Attributes {
+		got[a.Key] = a.Value.Emit()
+	}
+	want := map[attribute.Key]string{
+		PeerKey:        "10.0.0.1",
+		ControlIDKey:   "CTRL1",
+		MessageTypeKey: "ADT^A01",
+		AckCodeKey:     "AE",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("Attribute %v = %q, want %q", k, got[k], v)
+		}
+	}
+	if spans[0].Status.Code != codes.Error {
+		t.Errorf("Status = %v, want %v", spans[0].Status.Code, codes.Error)
+	}
+}
+
+func TestMessageAttributesInvalid(t *testing.T) {
+	if attrs := MessageAttributes([]byte("garbage")); len(attrs) != 0 {
+		t.Errorf("MessageAttributes() = %v, want none", attrs)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	record(t)
+	headers := make(chan string, 2)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("traceparent")
+	}))
+	defer s.Close()
+	client := &http.Client{Transport: Transport(nil)}
+
+	// Requests outside of a span are left alone.
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	resp.Body.Close()
+	if h := <-headers; h != "" {
+		t.Errorf("traceparent = %q, want none", h)
+	}
+
+	ctx, span := StartSpan(context.Background(), "test", nil)
+	defer span.End()
+	req, _ := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+	want := regexp.MustCompile("^00-" + span.SpanContext().TraceID().String() + "-" + span.SpanContext().SpanID().String() + "-01$")
+	if h := <-headers; !want.MatchString(h) {
+		t.Errorf("traceparent = %q, want match for %v", h, want)
+	}
+	if req.Header.Get("traceparent") != "" {
+		t.Errorf("Transport modified the original request")
+	}
+}
+
+func TestStartExports(t *testing.T) {
+	prev := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(prev)
+	requests := make(chan *http.Request, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requests <- r:
+		default:
+		}
+	}))
+	defer collector.Close()
+
+	stop, err := Start(context.Background(), Option{Endpoint: strings.TrimPrefix(collector.URL, "http://"), Insecure: true})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	_, span := StartSpan(context.Background(), "test", []byte(msg))
+	span.End()
+	// Stopping flushes the span to the collector.
+	if err := stop(context.Background()); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	select {
+	case r := <-requests:
+		if r.Method != "POST" || r.URL.Path != "/v1/traces" {
+			t.Errorf("Collector got %v %v, want POST /v1/traces", r.Method, r.URL.Path)
+		}
+	default:
+		t.Errorf("No spans were exported")
+	}
+}
+
+func TestStartRequiresEndpoint(t *testing.T) {
+	if _, err := Start(context.Background(), Option{}); err == nil {
+		t.Errorf("Start() without endpoint succeeded, want error")
+	}
+}
+
+// record installs a tracer provider that keeps spans in memory for the
+// duration of the test.
+func record(t *testing.T) *tracetest.InMemoryExporter {
+	exp := tracetest.NewInMemoryExporter()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(NewProvider(sdktrace.NewSimpleSpanProcessor(exp), Option{}))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return exp
+}